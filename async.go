@@ -0,0 +1,170 @@
+package redisstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultAsyncVisitedLimit is the default of AsyncVisitedLimit
+const defaultAsyncVisitedLimit = 10000
+
+// asyncVisits writes the visits of AsyncVisited in the background. Its
+// methods do nothing on a nil receiver.
+type asyncVisits struct {
+	s     *Storage
+	limit int
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu       sync.Mutex // Protects the fields below.
+	pending  map[uint64]time.Duration
+	inFlight map[uint64]time.Duration
+	stopped  bool
+}
+
+func newAsyncVisits(s *Storage) *asyncVisits {
+	limit := s.AsyncVisitedLimit
+	if limit <= 0 {
+		limit = defaultAsyncVisitedLimit
+	}
+	a := &asyncVisits{
+		s:       s,
+		limit:   limit,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]time.Duration),
+	}
+	go a.run()
+	return a
+}
+
+// add queues a visit and reports whether it was queued. Visits are not
+// queued once the limit is reached, so a slow server slows Visited down
+// instead of growing the queue.
+func (a *asyncVisits) add(requestID uint64, ttl time.Duration) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped || len(a.pending)+len(a.inFlight) >= a.limit {
+		return false
+	}
+	a.pending[requestID] = ttl
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// contains reports whether the visit of requestID is not written yet
+func (a *asyncVisits) contains(requestID uint64) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[requestID]
+	if !ok {
+		_, ok = a.inFlight[requestID]
+	}
+	return ok
+}
+
+// remove drops the queued visit of requestID
+func (a *asyncVisits) remove(requestID uint64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, requestID)
+}
+
+func (a *asyncVisits) run() {
+	defer close(a.done)
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-a.wake:
+			// Errors are recorded; the visits are lost.
+			_ = a.write(context.Background())
+		}
+	}
+}
+
+// write sends the queued visits to redis in one pipeline
+func (a *asyncVisits) write(ctx context.Context) error {
+	a.mu.Lock()
+	visits := a.pending
+	if len(visits) == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	a.pending = make(map[uint64]time.Duration)
+	if a.inFlight == nil {
+		a.inFlight = visits
+	} else {
+		for id, ttl := range visits {
+			a.inFlight[id] = ttl
+		}
+	}
+	a.mu.Unlock()
+	s := a.s
+	batch := make([]batchedVisit, 0, len(visits))
+	for id, ttl := range visits {
+		batch = append(batch, batchedVisit{id, ttl})
+	}
+	err := s.writeVisits(ctx, batch)
+	a.mu.Lock()
+	for id := range visits {
+		delete(a.inFlight, id)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		s.errs.record(err)
+		s.logf("AsyncVisited write of %d visits error %s", len(visits), err)
+	}
+	return err
+}
+
+// flush writes the queued visits and waits for the ones being written
+func (a *asyncVisits) flush(ctx context.Context) error {
+	if err := a.write(ctx); err != nil {
+		return err
+	}
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		a.mu.Lock()
+		n := len(a.inFlight)
+		a.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// close writes the queued visits and stops the background writer
+func (a *asyncVisits) close(ctx context.Context) error {
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		return nil
+	}
+	a.stopped = true
+	a.mu.Unlock()
+	close(a.stop)
+	<-a.done
+	return a.write(ctx)
+}
@@ -0,0 +1,151 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RetryPolicy retries redis commands failing with transient errors, e.g.
+// during a failover. Retried writes which reached the server before the
+// error, e.g. on a read timeout, are applied twice, so queues can receive
+// a request twice.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a command is sent, including
+	// the first time. Default is 3.
+	MaxAttempts int
+	// MinBackoff is the wait before the first retry, which doubles with
+	// each further retry up to MaxBackoff. Defaults are 10ms and 1s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction by which a wait is randomly shortened, so
+	// workers failing together do not retry in lockstep. Default is 0,
+	// which waits exactly.
+	Jitter float64
+	// Retriable reports whether a command failing with err is retried.
+	// Default is IsRetriable.
+	Retriable func(err error) bool
+}
+
+// IsRetriable reports whether err is transient: network errors and the
+// replies of a server which is loading, failing over or resharding.
+// Missing keys and canceled contexts are not retried.
+func IsRetriable(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// Replies wrapped by the storage, e.g. by Init, are matched too.
+	msg := err.Error()
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		msg = redisErr.Error()
+	}
+	for _, prefix := range []string{"LOADING ", "READONLY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN "} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return 3
+}
+
+func (p *RetryPolicy) retriable(err error) bool {
+	if p.Retriable != nil {
+		return p.Retriable(err)
+	}
+	return IsRetriable(err)
+}
+
+// backoff returns the wait before retry n, starting at 0
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d, limit := p.MinBackoff, p.MaxBackoff
+	if d <= 0 {
+		d = 10 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = time.Second
+	}
+	for i := 0; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// wait sleeps before retry n or returns the error of ctx
+func (p *RetryPolicy) wait(ctx context.Context, n int) error {
+	t := time.NewTimer(p.backoff(n))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryHook retries the commands of the client according to a policy
+type retryHook struct {
+	p *RetryPolicy
+}
+
+func (h retryHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h retryHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		for n := 0; n+1 < h.p.attempts() && h.p.retriable(err); n++ {
+			if h.p.wait(ctx, n) != nil {
+				return err
+			}
+			err = next(ctx, cmd)
+		}
+		return err
+	}
+}
+
+func (h retryHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for n := 0; n+1 < h.p.attempts() && h.retriable(cmds); n++ {
+			if h.p.wait(ctx, n) != nil {
+				return err
+			}
+			err = next(ctx, cmds)
+		}
+		return err
+	}
+}
+
+// retriable reports whether one of cmds failed with a retriable error
+func (h retryHook) retriable(cmds []redis.Cmder) bool {
+	for _, cmd := range cmds {
+		if h.p.retriable(cmd.Err()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package redisstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultBatchSize is the default of Batching.Size
+const defaultBatchSize = 100
+
+// Batching coalesces the concurrent calls of an operation into one
+// pipeline. Each call still waits for its batch to be written and gets
+// its error; a failing batch fails all of its calls.
+type Batching struct {
+	// Window is how long a call waits for other calls to join its
+	// batch, e.g. 2ms. Default is 0, which disables batching.
+	Window time.Duration
+	// Size is the maximum number of calls per batch. A full batch is
+	// written at once. Default is 100.
+	Size int
+}
+
+// batcher collects items and sends them in batches
+type batcher[T any] struct {
+	window time.Duration
+	size   int
+	send   func(ctx context.Context, items []T) error
+
+	mu      sync.Mutex // Protects the fields below.
+	items   []T
+	waiters []chan error
+	timer   *time.Timer
+}
+
+func newBatcher[T any](b Batching, send func(ctx context.Context, items []T) error) *batcher[T] {
+	size := b.Size
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	return &batcher[T]{window: b.Window, size: size, send: send}
+}
+
+// do adds item to the current batch and waits until the batch is sent
+func (b *batcher[T]) do(ctx context.Context, item T) error {
+	ch := make(chan error, 1)
+	b.mu.Lock()
+	b.items = append(b.items, item)
+	b.waiters = append(b.waiters, ch)
+	if len(b.items) >= b.size {
+		items, waiters := b.take()
+		b.mu.Unlock()
+		b.run(items, waiters)
+	} else {
+		if len(b.items) == 1 {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.mu.Unlock()
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes the current batch; b.mu must be held
+func (b *batcher[T]) take() ([]T, []chan error) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	items, waiters := b.items, b.waiters
+	b.items, b.waiters = nil, nil
+	return items, waiters
+}
+
+// flush sends the current batch
+func (b *batcher[T]) flush() {
+	b.mu.Lock()
+	items, waiters := b.take()
+	b.mu.Unlock()
+	if len(items) > 0 {
+		b.run(items, waiters)
+	}
+}
+
+// run sends items and passes the result to their callers. The batch is
+// not bound to the context of any single call.
+func (b *batcher[T]) run(items []T, waiters []chan error) {
+	err := b.send(context.Background(), items)
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+type batchedVisit struct {
+	id  uint64
+	ttl time.Duration
+}
+
+// batchers creates the batchers of VisitedBatching and
+// AddRequestBatching on first use
+func (s *Storage) batchers() (*batcher[batchedVisit], *batcher[[]byte]) {
+	s.batchOnce.Do(func() {
+		if s.VisitedBatching.Window > 0 {
+			s.visitBatcher = newBatcher(s.VisitedBatching, s.writeVisits)
+		}
+		if s.AddRequestBatching.Window > 0 {
+			s.requestBatcher = newBatcher(s.AddRequestBatching, s.writeRequests)
+		}
+	})
+	return s.visitBatcher, s.requestBatcher
+}
+
+// flushBatches sends the batches waiting for their window to pass
+func (s *Storage) flushBatches() {
+	visits, requests := s.batchers()
+	if visits != nil {
+		visits.flush()
+	}
+	if requests != nil {
+		requests.flush()
+	}
+}
+
+// writeVisits marks visits in one pipeline, buffering them while the
+// CircuitBreaker is open
+func (s *Storage) writeVisits(ctx context.Context, visits []batchedVisit) error {
+	return s.guard(ctx, func() error {
+		var wait *redis.Cmd
+		_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, v := range visits {
+				s.visit(ctx, pipe, v.id, v.ttl)
+			}
+			wait = s.wait(ctx, pipe)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return s.replicated(wait)
+	}, func(b *CircuitBreaker) error {
+		for _, v := range visits {
+			if err := b.bufferVisit(v.id, v.ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeRequests adds rs to the queue like AddRequests, buffering them
+// while the CircuitBreaker is open
+func (s *Storage) writeRequests(ctx context.Context, rs [][]byte) error {
+	return s.guard(ctx, func() error {
+		if err := s.addRequests(ctx, rs); err != nil {
+			return err
+		}
+		if err := s.expireQueue(ctx, rs...); err != nil {
+			return err
+		}
+		return s.waitReplicas(ctx)
+	}, func(b *CircuitBreaker) error {
+		for _, r := range rs {
+			if err := b.bufferRequest(s, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedVisitedMode is returned by visit operations which are
+// not available with VisitedBloom
+var ErrUnsupportedVisitedMode = errors.New("redisstorage: operation not supported by the visited mode")
+
+// VisitedMode selects how visited requests are stored
+type VisitedMode int
+
+const (
+	// VisitedKeys stores a key per visited request, which expires
+	// after VisitedTTL
+	VisitedKeys VisitedMode = iota
+	// VisitedBloom adds visited requests to a Bloom filter of the
+	// RedisBloom module, which needs a fraction of the memory of
+	// VisitedKeys on large crawls. IsVisited may report unvisited
+	// requests as visited with a probability of BloomErrorRate, and
+	// visits never expire. If the server lacks the module, Init logs
+	// it and falls back to VisitedKeys.
+	VisitedBloom
+)
+
+const (
+	defaultBloomErrorRate = 0.001
+	defaultBloomCapacity  = 1000000
+)
+
+// visitedLua defines a Lua function reporting whether a request was
+// visited. key is the Bloom filter if bloom is "1", else the key of the
+// request.
+const visitedLua = `
+local function visited(key, id, bloom)
+	if bloom == "1" then
+		return redis.call("BF.EXISTS", key, id) == 1
+	end
+	return redis.call("EXISTS", key) == 1
+end
+`
+
+// reserveBloom creates the Bloom filter of VisitedBloom. It reports
+// false if the server does not support Bloom filters.
+func (s *Storage) reserveBloom(ctx context.Context) (bool, error) {
+	rate := s.BloomErrorRate
+	if rate <= 0 {
+		rate = defaultBloomErrorRate
+	}
+	capacity := s.BloomCapacity
+	if capacity <= 0 {
+		capacity = defaultBloomCapacity
+	}
+	err := s.Client.BFReserve(ctx, s.getBloomID(), rate, capacity).Err()
+	switch {
+	case err == nil, strings.Contains(err.Error(), "item exists"):
+		return true, nil
+	case isUnknownCommand(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// isVisitedBloom looks up the requests not known to be visited yet
+func (s *Storage) isVisitedBloom(ctx context.Context, requestIDs []uint64, visited []bool) ([]bool, error) {
+	var ids []interface{}
+	var idx []int
+	for i, id := range requestIDs {
+		if !visited[i] {
+			ids = append(ids, idMember(id))
+			idx = append(idx, i)
+		}
+	}
+	found, err := s.reader().BFMExists(ctx, s.getBloomID(), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for j, ok := range found {
+		if !ok {
+			continue
+		}
+		visited[idx[j]] = true
+		if s.cache != nil {
+			s.cache.add(requestIDs[idx[j]], 0)
+		}
+	}
+	return visited, nil
+}
+
+// visitedKey returns the key checked by visitedLua for requestID and
+// whether it is a Bloom filter
+func (s *Storage) visitedKey(requestID uint64) (string, string) {
+	if s.bloom {
+		return s.getBloomID(), "1"
+	}
+	return s.getIDStr(requestID), "0"
+}
+
+// idMember returns the member representing requestID in the Bloom
+// filter and the visit counter
+func idMember(requestID uint64) string {
+	return strconv.FormatUint(requestID, 10)
+}
+
+// bloomCard returns the number of visits added to the filter
+func (s *Storage) bloomCard(ctx context.Context) (int, error) {
+	n, err := s.Client.BFCard(ctx, s.getBloomID()).Result()
+	return int(n), err
+}
+
+func (s *Storage) getBloomID() string {
+	return s.key("visited", "bloom")
+}
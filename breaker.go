@@ -0,0 +1,226 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrCircuitOpen is returned while the CircuitBreaker is open by the
+// operations which can not be buffered, by IsVisited for IDs which are
+// not buffered, and by Visited and AddRequest once the buffer is full
+var ErrCircuitOpen = errors.New("redisstorage: circuit breaker is open")
+
+// CircuitBreaker stops sending commands to redis after repeated
+// transient failures, see IsRetriable. While it is open, Visited and
+// AddRequest are buffered in memory and IsVisited reports buffered IDs
+// as visited; IsVisited of other IDs and all other operations fail with
+// ErrCircuitOpen. After Cooldown the next operation tries redis again
+// and, if it succeeds, the buffer is written to redis. Buffered data is
+// lost if the process exits before.
+//
+// A CircuitBreaker must not be shared by unrelated storages; the ones
+// returned by Queue share the breaker of their parent.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures opening the
+	// breaker. Default is 5.
+	Failures int
+	// Cooldown is how long the breaker stays open. Default is 5s.
+	Cooldown time.Duration
+	// BufferSize is the maximum number of buffered visits and requests.
+	// Default is 10000.
+	BufferSize int
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	visits    map[uint64]time.Duration
+	requests  []bufferedRequest
+}
+
+type bufferedRequest struct {
+	s *Storage // Storages returned by Queue have their own queue.
+	r []byte
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return b.Cooldown
+	}
+	return 5 * time.Second
+}
+
+func (b *CircuitBreaker) bufferSize() int {
+	if b.BufferSize > 0 {
+		return b.BufferSize
+	}
+	return 10000
+}
+
+// allow reports whether redis should be tried
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// record counts the result of an operation and reports whether the
+// breaker is open now. Non-transient errors do not count.
+func (b *CircuitBreaker) record(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	if !IsRetriable(err) {
+		return false
+	}
+	b.failures++
+	limit := b.Failures
+	if limit <= 0 {
+		limit = 5
+	}
+	if b.failures >= limit {
+		b.openUntil = time.Now().Add(b.cooldown())
+		return true
+	}
+	return false
+}
+
+func (b *CircuitBreaker) bufferVisit(requestID uint64, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.visits[requestID]; !ok && b.buffered() >= b.bufferSize() {
+		return ErrCircuitOpen
+	}
+	if b.visits == nil {
+		b.visits = make(map[uint64]time.Duration)
+	}
+	b.visits[requestID] = ttl
+	return nil
+}
+
+func (b *CircuitBreaker) bufferRequest(s *Storage, r []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buffered() >= b.bufferSize() {
+		return ErrCircuitOpen
+	}
+	b.requests = append(b.requests, bufferedRequest{s, r})
+	return nil
+}
+
+func (b *CircuitBreaker) isBuffered(requestID uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.visits[requestID]
+	return ok
+}
+
+// size returns the number of buffered entries
+func (b *CircuitBreaker) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffered()
+}
+
+func (b *CircuitBreaker) buffered() int {
+	return len(b.visits) + len(b.requests)
+}
+
+// take removes and returns the buffer
+func (b *CircuitBreaker) take() (map[uint64]time.Duration, []bufferedRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	visits, requests := b.visits, b.requests
+	b.visits, b.requests = nil, nil
+	return visits, requests
+}
+
+// restore returns unwritten entries to the buffer, keeping the ones
+// added meanwhile
+func (b *CircuitBreaker) restore(visits map[uint64]time.Duration, requests []bufferedRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, ttl := range visits {
+		if b.visits == nil {
+			b.visits = make(map[uint64]time.Duration)
+		}
+		if _, ok := b.visits[id]; !ok {
+			b.visits[id] = ttl
+		}
+	}
+	b.requests = append(requests, b.requests...)
+}
+
+// guard runs op unless the breaker is open. If the breaker is or becomes
+// open, the operation is buffered instead. A successful op writes the
+// buffer to redis.
+func (s *Storage) guard(ctx context.Context, op func() error, buffer func(b *CircuitBreaker) error) error {
+	b := s.CircuitBreaker
+	if b == nil {
+		return op()
+	}
+	if !b.allow() {
+		return buffer(b)
+	}
+	err := op()
+	if b.record(err) {
+		return buffer(b)
+	}
+	if err == nil {
+		// Unwritten entries stay buffered for the next operation.
+		_ = s.replay(ctx)
+	}
+	return err
+}
+
+// replay writes the buffered visits and requests to redis. Entries which
+// could not be written because redis is unreachable are kept for the
+// next attempt; entries redis rejects, e.g. requests exceeding
+// MaxQueueSize, are dropped. Requests never wait for room in the queue,
+// as the replay runs within another operation.
+func (s *Storage) replay(ctx context.Context) error {
+	b := s.CircuitBreaker
+	visits, requests := b.take()
+	if len(visits) == 0 && len(requests) == 0 {
+		return nil
+	}
+	if len(visits) > 0 {
+		_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for id, ttl := range visits {
+				s.visit(ctx, pipe, id, ttl)
+			}
+			return nil
+		})
+		if err != nil {
+			s.errs.record(err)
+			if IsRetriable(err) {
+				b.record(err)
+				b.restore(visits, requests)
+				s.logf("circuit breaker replay error %s", err)
+				return err
+			}
+			s.logf("circuit breaker replay dropped %d visits: %s", len(visits), err)
+		}
+	}
+	for i, req := range requests {
+		chk := dedupCheck(req.r, req.s.Deduplicate)
+		chk.noWait = true
+		if _, err := req.s.addRequest(ctx, req.r, chk); err != nil {
+			s.errs.record(err)
+			if IsRetriable(err) {
+				b.record(err)
+				b.restore(nil, requests[i:])
+				s.logf("circuit breaker replay error %s", err)
+				return err
+			}
+			s.logf("circuit breaker replay dropped request: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package redisstorage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// visitedCache is a size-bounded LRU set of visited request IDs. Only
+// positive answers are cached: a request which was not visited may be
+// visited by another worker at any time.
+type visitedCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[uint64]*list.Element
+}
+
+type cacheEntry struct {
+	id      uint64
+	expires time.Time
+}
+
+// newVisitedCache returns a cache of up to size IDs which are forgotten
+// after ttl. A ttl of 0 keeps them until they are evicted.
+func newVisitedCache(size int, ttl time.Duration) *visitedCache {
+	return &visitedCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[uint64]*list.Element),
+	}
+}
+
+// add remembers id for the TTL of the cache, or for ttl if it is
+// shorter. A ttl of 0 does not shorten it.
+func (c *visitedCache) add(id uint64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl > 0 && (ttl <= 0 || c.ttl < ttl) {
+		ttl = c.ttl
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if e, ok := c.items[id]; ok {
+		e.Value.(*cacheEntry).expires = expires
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[id] = c.ll.PushFront(&cacheEntry{id: id, expires: expires})
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *visitedCache) contains(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return false
+	}
+	if exp := e.Value.(*cacheEntry).expires; !exp.IsZero() && time.Now().After(exp) {
+		c.removeElement(e)
+		return false
+	}
+	c.ll.MoveToFront(e)
+	return true
+}
+
+func (c *visitedCache) remove(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *visitedCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[uint64]*list.Element)
+}
+
+func (c *visitedCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*cacheEntry).id)
+}
+
+// cookieCache holds cookies prefetched by PrefetchCookies until they
+// expire
+type cookieCache struct {
+	mu    sync.Mutex
+	items map[string]cookieEntry
+}
+
+type cookieEntry struct {
+	cookies string
+	expires time.Time
+}
+
+func newCookieCache() *cookieCache {
+	return &cookieCache{items: make(map[string]cookieEntry)}
+}
+
+// set remembers cookies for each host for ttl and drops expired hosts
+func (c *cookieCache) set(cookies map[string]string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for host, e := range c.items {
+		if now.After(e.expires) {
+			delete(c.items, host)
+		}
+	}
+	for host, v := range cookies {
+		c.items[host] = cookieEntry{cookies: v, expires: now.Add(ttl)}
+	}
+}
+
+func (c *cookieCache) get(host string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[host]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.cookies, true
+}
+
+func (c *cookieCache) remove(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, host)
+}
+
+func (c *cookieCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]cookieEntry)
+}
+
+// clientSideCacheConfig returns the client-side cache of
+// ClientSideCacheSize
+func (s *Storage) clientSideCacheConfig() *redis.ClientSideCacheConfig {
+	return &redis.ClientSideCacheConfig{MaxEntries: s.ClientSideCacheSize}
+}
+
+// ClientSideCacheStats returns the hits and misses of the cache of
+// ClientSideCacheSize. Missing keys are cached too, until they are set.
+// It is zero while the cache is disabled or the server does not support
+// tracking.
+func (s *Storage) ClientSideCacheStats() redis.CSCStats {
+	c, ok := s.Client.(*redis.Client)
+	if !ok {
+		return redis.CSCStats{}
+	}
+	return c.CSCStats()
+}
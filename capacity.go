@@ -0,0 +1,116 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrQueueFull is returned by the AddRequest methods if the queue holds
+// MaxQueueSize requests
+var ErrQueueFull = errors.New("redisstorage: queue is full")
+
+// queueFullPoll is the interval in which a blocked AddRequest checks
+// whether the queue has room again
+const queueFullPoll = 100 * time.Millisecond
+
+// addCheckedScript adds a request only if the queue holds less than
+// ARGV[4] requests, the request was not visited if a visited key is
+// given and its ID is not pending if one is given. It returns 1 if the
+// request was added, 0 for duplicates and -1 if the queue is full.
+// KEYS: queue, pending IDs, optional visited key, see visitedKey
+// ARGV: kind, request, score, capacity or 0, visited ID, bloom,
+// pending ID or ""
+var addCheckedScript = newScript(pushLua + sizeLua + visitedLua + `
+if KEYS[3] and visited(KEYS[3], ARGV[5], ARGV[6]) then
+	return 0
+end
+if ARGV[7] ~= "" and redis.call("SISMEMBER", KEYS[2], ARGV[7]) == 1 then
+	return 0
+end
+local cap = tonumber(ARGV[4])
+if cap > 0 and size(KEYS[1], ARGV[1]) >= cap then
+	return -1
+end
+if ARGV[7] ~= "" then
+	redis.call("SADD", KEYS[2], ARGV[7])
+end
+push(KEYS[1], ARGV[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// addChecked atomically adds the encoded request p if the queue has room
+// and it passes chk. It reports whether p was added. The score is only
+// used by QueuePriority.
+func (s *Storage) addChecked(ctx context.Context, p []byte, score float64, chk addCheck) (bool, error) {
+	for {
+		n, err := s.evalAddChecked(ctx, s.Client, p, score, s.MaxQueueSize, chk, false).Int()
+		if err != nil {
+			return false, err
+		}
+		if n >= 0 {
+			return n == 1, nil
+		}
+		if chk.noWait {
+			return false, ErrQueueFull
+		}
+		if err := s.waitForRoom(ctx); err != nil {
+			return false, err
+		}
+	}
+}
+
+// evalAddChecked runs addCheckedScript
+func (s *Storage) evalAddChecked(ctx context.Context, c redis.Cmdable, p []byte, score float64, capacity int, chk addCheck, pipelined bool) *redis.Cmd {
+	visited, bloom := s.visitedKey(chk.visitedID)
+	keys := []string{s.getQueueID(), s.getPendingID()}
+	if chk.visited {
+		keys = append(keys, visited)
+	}
+	args := []interface{}{s.queueKind(), p, score, capacity, chk.visitedID, bloom, chk.pendingID}
+	if pipelined {
+		return s.evalScript(ctx, c, addCheckedScript, keys, args...)
+	}
+	return s.runScript(ctx, c, addCheckedScript, keys, args...)
+}
+
+// checkCapacity returns nil if n more requests fit into the queue. It is
+// used where the capacity can not be checked atomically, i.e. for
+// batches, QueueHost and QueueStrategy, so the queue can exceed
+// MaxQueueSize slightly under concurrent use. More than MaxQueueSize
+// requests never fit, so they are rejected without waiting; unless wait
+// is set, no requests wait.
+func (s *Storage) checkCapacity(ctx context.Context, n int, wait bool) error {
+	if n > s.MaxQueueSize {
+		return ErrQueueFull
+	}
+	for {
+		size, err := s.storedSize(ctx)
+		if err != nil {
+			return err
+		}
+		if size+n <= s.MaxQueueSize {
+			return nil
+		}
+		if !wait {
+			return ErrQueueFull
+		}
+		if err := s.waitForRoom(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Storage) waitForRoom(ctx context.Context) error {
+	if !s.BlockWhenFull {
+		return ErrQueueFull
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(queueFullPoll):
+		return nil
+	}
+}
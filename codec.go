@@ -0,0 +1,99 @@
+package redisstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec serializes the values queued with Enqueue, e.g. structured
+// request envelopes. JSON and Raw are provided by this package, a
+// msgpack codec by the msgpack sub-package.
+type Codec interface {
+	// Encode returns the payload of v
+	Encode(v interface{}) ([]byte, error)
+	// Decode stores the value of the payload p in v, which is a pointer
+	Decode(p []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes values with encoding/json
+	JSON Codec = jsonCodec{}
+	// Raw queues byte slices and strings unchanged, e.g. payloads
+	// serialized by the application
+	Raw Codec = rawCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(p []byte, v interface{}) error {
+	return json.Unmarshal(p, v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Encode(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("redisstorage: Raw can not encode %T", v)
+}
+
+func (rawCodec) Decode(p []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = p
+	case *string:
+		*v = string(p)
+	default:
+		return fmt.Errorf("redisstorage: Raw can not decode into %T", v)
+	}
+	return nil
+}
+
+// Enqueue adds v, serialized with Codec, to the queue like AddRequest.
+// Values and the requests of Colly can share a queue only if the
+// consumers tell them apart.
+func (s *Storage) Enqueue(v interface{}) error {
+	return s.EnqueueCtx(context.Background(), v)
+}
+
+// EnqueueCtx is the context-aware variant of Enqueue
+func (s *Storage) EnqueueCtx(ctx context.Context, v interface{}) error {
+	p, err := s.codec().Encode(v)
+	if err != nil {
+		return err
+	}
+	return s.AddRequestCtx(ctx, p)
+}
+
+// Dequeue removes the next value from the queue like GetRequest and
+// stores it in v, which is a pointer. It returns ErrQueueEmpty if the
+// queue is empty.
+func (s *Storage) Dequeue(v interface{}) error {
+	return s.DequeueCtx(context.Background(), v)
+}
+
+// DequeueCtx is the context-aware variant of Dequeue
+func (s *Storage) DequeueCtx(ctx context.Context, v interface{}) error {
+	p, err := s.GetRequestCtx(ctx)
+	if err != nil {
+		return err
+	}
+	return s.codec().Decode(p, v)
+}
+
+// codec returns the Codec of Enqueue and Dequeue
+func (s *Storage) codec() Codec {
+	if s.Codec == nil {
+		return JSON
+	}
+	return s.Codec
+}
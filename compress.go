@@ -0,0 +1,73 @@
+package redisstorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compressedMagic is the header of compressed payloads, followed by a
+// gzip stream. 0xc1 is neither valid UTF-8 nor msgpack, so serialized
+// Colly requests and encoded values do not start with it.
+var compressedMagic = []byte{0xc1, 0x1f}
+
+// escapedMagic is the header of raw payloads which start with one of
+// the headers of encode themselves, so every stored payload decodes to
+// the request it was encoded from
+var escapedMagic = []byte{0xc1, 0x00}
+
+// encode compresses a queued request if it is larger than
+// CompressThreshold. The output is deterministic, so requests passed to
+// Ack or Nack can be matched against the stored payloads.
+func (s *Storage) encode(r []byte) []byte {
+	if s.CompressThreshold <= 0 || len(r) <= s.CompressThreshold {
+		if bytes.HasPrefix(r, compressedMagic) || bytes.HasPrefix(r, escapedMagic) {
+			return append(append([]byte(nil), escapedMagic...), r...)
+		}
+		return r
+	}
+	var b bytes.Buffer
+	b.Write(compressedMagic)
+	w := gzip.NewWriter(&b)
+	w.Write(r)
+	w.Close()
+	return b.Bytes()
+}
+
+// decode reverses encode. Payloads are decompressed regardless of the
+// CompressThreshold of s, so the setting can be changed on a live queue.
+func (s *Storage) decode(p []byte) ([]byte, error) {
+	if bytes.HasPrefix(p, escapedMagic) {
+		return p[len(escapedMagic):], nil
+	}
+	if !bytes.HasPrefix(p, compressedMagic) {
+		return p, nil
+	}
+	rd, err := gzip.NewReader(bytes.NewReader(p[len(compressedMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// decodeAll decodes a list of payloads read from redis
+func (s *Storage) decodeAll(vs []string) ([][]byte, error) {
+	rs := make([][]byte, len(vs))
+	for i, v := range vs {
+		r, err := s.decode([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+		rs[i] = r
+	}
+	return rs, nil
+}
+
+func (s *Storage) encodeArgs(rs [][]byte) []interface{} {
+	args := make([]interface{}, len(rs))
+	for i, r := range rs {
+		args[i] = s.encode(r)
+	}
+	return args
+}
@@ -0,0 +1,95 @@
+package redisstorage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SetConfig stores a configuration parameter of the crawl, e.g. the
+// politeness delay, for all storages of the prefix and notifies the
+// ones watching it with WatchConfig. Parameters are removed by Clear.
+func (s *Storage) SetConfig(name, value string) error {
+	return s.SetConfigCtx(context.Background(), name, value)
+}
+
+// SetConfigCtx is the context-aware variant of SetConfig
+func (s *Storage) SetConfigCtx(ctx context.Context, name, value string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.getConfigID(), name, value)
+		pipe.Publish(ctx, s.getConfigID(), name)
+		return nil
+	})
+	return err
+}
+
+// GetConfig returns the value of a configuration parameter, or
+// ErrNoValue if it is not set
+func (s *Storage) GetConfig(name string) (string, error) {
+	return s.GetConfigCtx(context.Background(), name)
+}
+
+// GetConfigCtx is the context-aware variant of GetConfig
+func (s *Storage) GetConfigCtx(ctx context.Context, name string) (string, error) {
+	if err := s.check(); err != nil {
+		return "", err
+	}
+	v, err := s.Client.HGet(ctx, s.getConfigID(), name).Result()
+	if err == redis.Nil {
+		return "", ErrNoValue
+	}
+	return v, err
+}
+
+// WatchConfig calls fn with the configuration parameters of the crawl,
+// in the order of their names, and then with every parameter changed by
+// SetConfig, until ctx is done, so workers pick up changes without a
+// restart. It returns the error of ctx or of the connection. Changes
+// made while the connection of the subscription is broken are missed.
+func (s *Storage) WatchConfig(ctx context.Context, fn func(name, value string)) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	// Subscribing first makes sure no change is missed in between.
+	sub := s.Client.Subscribe(ctx, s.getConfigID())
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	config, err := s.Client.HGetAll(ctx, s.getConfigID()).Result()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, config[name])
+	}
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-ch:
+			if !ok {
+				return redis.ErrClosed
+			}
+			v, err := s.Client.HGet(ctx, s.getConfigID(), m.Payload).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			fn(m.Payload, v)
+		}
+	}
+}
+
+func (s *Storage) getConfigID() string {
+	return s.key("config")
+}
@@ -0,0 +1,160 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrStopped is returned by GetRequest after a SignalStop, see Control
+var ErrStopped = errors.New("redisstorage: crawl is stopped")
+
+// ErrUnknownSignal is returned by Publish for an unknown signal
+var ErrUnknownSignal = errors.New("redisstorage: unknown control signal")
+
+// Signal controls the storages of a prefix, see Publish
+type Signal string
+
+const (
+	// SignalPause makes GetRequest, GetRequests and GetRequestBlocking
+	// wait until SignalResume
+	SignalPause Signal = "pause"
+	// SignalResume resumes a paused or stopped crawl
+	SignalResume Signal = "resume"
+	// SignalStop makes them return ErrStopped and QueueSize 0, so the
+	// queues of Colly finish
+	SignalStop Signal = "stop"
+)
+
+// Publish sends sig to the storages of the prefix with Control set. The
+// signal is also stored, so storages initialized later follow it, until
+// SignalResume or Clear.
+func (s *Storage) Publish(sig Signal) error {
+	return s.PublishCtx(context.Background(), sig)
+}
+
+// PublishCtx is the context-aware variant of Publish
+func (s *Storage) PublishCtx(ctx context.Context, sig Signal) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		switch sig {
+		case SignalPause, SignalStop:
+			pipe.Set(ctx, s.getControlID(), string(sig), 0)
+		case SignalResume:
+			pipe.Del(ctx, s.getControlID())
+		default:
+			return ErrUnknownSignal
+		}
+		pipe.Publish(ctx, s.getControlID(), string(sig))
+		return nil
+	})
+	return err
+}
+
+// ControlState returns the signal the storage follows, SignalPause or
+// SignalStop, or "" if the crawl runs. It requires Control.
+func (s *Storage) ControlState() Signal {
+	if s.control == nil {
+		return ""
+	}
+	s.control.mu.Lock()
+	defer s.control.mu.Unlock()
+	return s.control.state
+}
+
+// control follows the signals published for the prefix
+type control struct {
+	sub *redis.PubSub
+
+	mu      sync.Mutex
+	state   Signal
+	changed chan struct{} // Closed when state changes.
+}
+
+// newControl subscribes to the control channel and reads the stored
+// signal. Subscribing first makes sure no signal is missed in between.
+func newControl(ctx context.Context, s *Storage) (*control, error) {
+	c := &control{sub: s.Client.Subscribe(ctx, s.getControlID()), changed: make(chan struct{})}
+	if _, err := c.sub.Receive(ctx); err != nil {
+		c.sub.Close()
+		return nil, err
+	}
+	v, err := s.Client.Get(ctx, s.getControlID()).Result()
+	if err != nil && err != redis.Nil {
+		c.sub.Close()
+		return nil, err
+	}
+	c.set(Signal(v))
+	go c.run()
+	return c, nil
+}
+
+func (c *control) run() {
+	for m := range c.sub.Channel() {
+		c.set(Signal(m.Payload))
+	}
+}
+
+func (c *control) set(sig Signal) {
+	if sig == SignalResume {
+		sig = ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sig == c.state {
+		return
+	}
+	c.state = sig
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait returns once the crawl runs, ErrStopped if it is stopped, or the
+// error of ctx if it is done while the crawl is paused
+func (c *control) wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		state, changed := c.state, c.changed
+		c.mu.Unlock()
+		switch state {
+		case SignalStop:
+			return ErrStopped
+		case SignalPause:
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// stopped reports whether the crawl is stopped
+func (c *control) stopped() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == SignalStop
+}
+
+func (c *control) close() error {
+	if c == nil {
+		return nil
+	}
+	return c.sub.Close()
+}
+
+func (s *Storage) getControlID() string {
+	return s.key("ctl")
+}
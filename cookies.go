@@ -0,0 +1,348 @@
+package redisstorage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mergeCookies merges the cookies serialized by Colly in set into the
+// ones in stored. Cookies of set replace the stored ones of the same
+// name, so they can also remove them by expiring.
+func mergeCookies(stored, set string) string {
+	var lines []string
+	index := map[string]int{}
+	for _, c := range append(strings.Split(stored, "\n"), strings.Split(set, "\n")...) {
+		if c == "" {
+			continue
+		}
+		name := cookieName(c)
+		if i, ok := index[name]; ok {
+			lines[i] = c
+			continue
+		}
+		index[name] = len(lines)
+		lines = append(lines, c)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// defaultCookiePrefetchTTL is the default of CookiePrefetchTTL
+const defaultCookiePrefetchTTL = time.Second
+
+// PrefetchCookies fetches the cookies of hosts in one round trip and
+// keeps them in process for CookiePrefetchTTL, so Cookies does not ask
+// redis for each request to one of them. Cookies set by this storage
+// replace the prefetched ones.
+func (s *Storage) PrefetchCookies(hosts []string) error {
+	return s.PrefetchCookiesCtx(context.Background(), hosts)
+}
+
+// PrefetchCookiesCtx is the context-aware variant of PrefetchCookies
+func (s *Storage) PrefetchCookiesCtx(ctx context.Context, hosts []string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	// A pipeline of GETs instead of MGET works on clusters, where the
+	// hosts are spread over slots.
+	cmds := make([]redis.Cmder, len(hosts))
+	_, err := s.reader().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, host := range hosts {
+			if s.HashCookies {
+				cmds[i] = pipe.HGetAll(ctx, s.getCookieID(host))
+			} else {
+				cmds[i] = pipe.Get(ctx, s.getCookieID(host))
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	fetched := make(map[string]string, len(hosts))
+	for i, host := range hosts {
+		var cookies string
+		switch cmd := cmds[i].(type) {
+		case *redis.MapStringStringCmd:
+			if cookies, err = s.joinHashCookies(host, cmd.Val()); err != nil {
+				return err
+			}
+		case *redis.StringCmd:
+			v, err := cmd.Result()
+			if err == redis.Nil {
+				break
+			} else if err != nil {
+				return err
+			}
+			if cookies, err = s.openCookies(host, v); err != nil {
+				return err
+			}
+		}
+		fetched[host] = cookies
+	}
+	ttl := s.CookiePrefetchTTL
+	if ttl <= 0 {
+		ttl = defaultCookiePrefetchTTL
+	}
+	s.cookies.set(fetched, ttl)
+	return nil
+}
+
+// SetHTTPCookies stores cookies for the host of u like SetCookiesE. They
+// are serialized the way Colly does, so Cookies returns them to Colly.
+func (s *Storage) SetHTTPCookies(u *url.URL, cookies []*http.Cookie) error {
+	return s.SetHTTPCookiesCtx(context.Background(), u, cookies)
+}
+
+// SetHTTPCookiesCtx is the context-aware variant of SetHTTPCookies
+func (s *Storage) SetHTTPCookiesCtx(ctx context.Context, u *url.URL, cookies []*http.Cookie) error {
+	return s.SetCookiesECtx(ctx, u, stringifyCookies(cookies))
+}
+
+// GetHTTPCookies returns the cookies stored for the host of u, including
+// the ones stored by Colly
+func (s *Storage) GetHTTPCookies(u *url.URL) ([]*http.Cookie, error) {
+	return s.GetHTTPCookiesCtx(context.Background(), u)
+}
+
+// GetHTTPCookiesCtx is the context-aware variant of GetHTTPCookies
+func (s *Storage) GetHTTPCookiesCtx(ctx context.Context, u *url.URL) ([]*http.Cookie, error) {
+	cookies, err := s.CookiesECtx(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return parseCookies(cookies), nil
+}
+
+// stringifyCookies serializes cookies like Colly, one Set-Cookie header
+// per line
+func stringifyCookies(cookies []*http.Cookie) string {
+	lines := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		if v := c.String(); v != "" {
+			lines = append(lines, v)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseCookies parses cookies serialized by stringifyCookies
+func parseCookies(cookies string) []*http.Cookie {
+	h := http.Header{}
+	for _, c := range strings.Split(cookies, "\n") {
+		if c != "" {
+			h.Add("Set-Cookie", c)
+		}
+	}
+	return (&http.Response{Header: h}).Cookies()
+}
+
+// withParentCookies adds the cookies of the parent domains of u which
+// are scoped to u to the cookies of its host
+func (s *Storage) withParentCookies(ctx context.Context, u *url.URL, cookies string) (string, error) {
+	host := jarHost(u)
+	seen := map[string]bool{}
+	var lines []string
+	for _, c := range strings.Split(cookies, "\n") {
+		if c != "" {
+			seen[cookieName(c)] = true
+			lines = append(lines, c)
+		}
+	}
+	for _, parent := range parentDomains(host) {
+		if port := u.Port(); port != "" {
+			parent = net.JoinHostPort(parent, port)
+		}
+		stored, err := s.hostCookies(ctx, s.reader(), parent)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range strings.Split(stored, "\n") {
+			parsed := parseCookies(c)
+			if len(parsed) == 0 || seen[parsed[0].Name] {
+				continue
+			}
+			// Host-only cookies are not sent to subdomains.
+			if parsed[0].Domain == "" {
+				continue
+			}
+			if _, _, ok := cookieDomain(host, parsed[0].Domain); !ok {
+				continue
+			}
+			seen[parsed[0].Name] = true
+			lines = append(lines, c)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// parentDomains returns the parent domains of host, nearest first. Top
+// level domains are left out, as cookies can not be set for them.
+func parentDomains(host string) []string {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	var parents []string
+	for {
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return parents
+		}
+		parents = append(parents, parent)
+		host = parent
+	}
+}
+
+// cookieName returns the name of the cookie of the Set-Cookie line c
+func cookieName(c string) string {
+	name, _, _ := strings.Cut(c, "=")
+	return strings.TrimSpace(name)
+}
+
+// splitCookies returns the Set-Cookie lines of cookies by cookie name
+func splitCookies(cookies string) map[string]string {
+	lines := map[string]string{}
+	for _, c := range strings.Split(cookies, "\n") {
+		if c != "" {
+			lines[cookieName(c)] = c
+		}
+	}
+	return lines
+}
+
+// setHashCookies stores cookies for HashCookies. With MergeCookies only
+// the fields of the cookies in set are written and the fields of stored
+// cookies dropped by the merge, e.g. expired ones, are deleted; stored
+// are the cookies read before. Otherwise the hash is replaced.
+func (s *Storage) setHashCookies(ctx context.Context, host, stored, set string) error {
+	cookies := set
+	if s.MergeCookies {
+		cookies = mergeCookies(stored, set)
+	}
+	cookies, ttl := s.expireCookies(cookies, time.Now())
+	kept := splitCookies(cookies)
+	key := s.getCookieID(host)
+	if len(kept) == 0 {
+		return s.Client.Del(ctx, key).Err()
+	}
+	write := kept
+	if s.MergeCookies {
+		write = map[string]string{}
+		for name := range splitCookies(set) {
+			write[name] = kept[name]
+		}
+		for name := range splitCookies(stored) {
+			if _, ok := kept[name]; !ok {
+				write[name] = ""
+			}
+		}
+	}
+	var del []string
+	fields := map[string]interface{}{}
+	for name, c := range write {
+		if c == "" {
+			del = append(del, name)
+			continue
+		}
+		v, err := s.sealCookies(host, c)
+		if err != nil {
+			return err
+		}
+		fields[name] = v
+	}
+	_, err := s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if !s.MergeCookies {
+			pipe.Del(ctx, key)
+		}
+		if len(del) > 0 {
+			pipe.HDel(ctx, key, del...)
+		}
+		if len(fields) > 0 {
+			pipe.HSet(ctx, key, fields)
+		}
+		if ttl > 0 {
+			pipe.PExpire(ctx, key, ttl)
+		} else {
+			pipe.Persist(ctx, key)
+		}
+		return nil
+	})
+	return err
+}
+
+// hashCookies returns the cookies stored for HashCookies, ordered by
+// name, reading them from c
+func (s *Storage) hashCookies(ctx context.Context, c redis.Cmdable, host string) (string, error) {
+	fields, err := c.HGetAll(ctx, s.getCookieID(host)).Result()
+	if err != nil {
+		return "", err
+	}
+	return s.joinHashCookies(host, fields)
+}
+
+// joinHashCookies returns the cookies of the fields of the hash stored
+// for host for HashCookies
+func (s *Storage) joinHashCookies(host string, fields map[string]string) (string, error) {
+	var err error
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		if lines[i], err = s.openCookies(host, fields[name]); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// expireCookies prepares cookies serialized by Colly, one Set-Cookie
+// header per line, for storage. Expired cookies are dropped and Max-Age
+// is replaced by Expires, as it would otherwise restart on every read.
+// It returns the cookies and their TTL, the time until the last one
+// expires, which is limited by CookieTTL. It is 0 if a session cookie
+// is kept.
+func (s *Storage) expireCookies(cookies string, now time.Time) (string, time.Duration) {
+	var last time.Time
+	session := false
+	var kept []string
+	for _, c := range parseCookies(cookies) {
+		switch {
+		case c.MaxAge < 0:
+			continue
+		case c.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		case c.Expires.IsZero():
+			session = true
+		}
+		if !c.Expires.IsZero() {
+			if !c.Expires.After(now) {
+				continue
+			}
+			if c.Expires.After(last) {
+				last = c.Expires
+			}
+		}
+		kept = append(kept, c.String())
+	}
+	ttl := s.CookieTTL
+	if !session && len(kept) > 0 {
+		// Expires has a resolution of seconds.
+		if d := last.Sub(now) + time.Second; ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	return strings.Join(kept, "\n"), ttl
+}
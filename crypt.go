@@ -0,0 +1,47 @@
+package redisstorage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// newCookieCipher returns the AEAD encrypting cookies with key
+func newCookieCipher(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// sealCookies encrypts the cookies of host if CookieKey is set. The
+// host is authenticated as additional data, so the ciphertext can not be
+// moved to another host. The nonce is prepended to the ciphertext.
+func (s *Storage) sealCookies(host, cookies string) (string, error) {
+	if s.aead == nil {
+		return cookies, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return string(s.aead.Seal(nonce, nonce, []byte(cookies), []byte(host))), nil
+}
+
+// openCookies decrypts the cookies of host sealed by sealCookies
+func (s *Storage) openCookies(host, v string) (string, error) {
+	if s.aead == nil {
+		return v, nil
+	}
+	n := s.aead.NonceSize()
+	if len(v) < n {
+		return "", errors.New("redisstorage: invalid encrypted cookies")
+	}
+	p, err := s.aead.Open(nil, []byte(v[:n]), []byte(v[n:]), []byte(host))
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
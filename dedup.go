@@ -0,0 +1,140 @@
+package redisstorage
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// markPendingScript records a request ID as pending unless the request
+// was visited, if a visited key is given, or the ID is already pending.
+// It returns 1 if the request is new.
+// KEYS: pending IDs, optional visited key, see visitedKey
+// ARGV: visited ID, bloom, pending ID or ""
+var markPendingScript = newScript(visitedLua + `
+if KEYS[2] and visited(KEYS[2], ARGV[1], ARGV[2]) then
+	return 0
+end
+if ARGV[3] == "" then
+	return 1
+end
+return redis.call("SADD", KEYS[1], ARGV[3])
+`)
+
+// addCheck selects the duplicate checks of an added request
+type addCheck struct {
+	// visited drops the request if the request visitedID was visited
+	visited   bool
+	visitedID uint64
+	// pendingID, unless empty, drops the request if it is pending and
+	// records it as pending otherwise
+	pendingID string
+	// noWait fails with ErrQueueFull instead of waiting for room if
+	// BlockWhenFull is set
+	noWait bool
+}
+
+// active reports whether chk checks anything
+func (chk addCheck) active() bool {
+	return chk.visited || chk.pendingID != ""
+}
+
+// dedupCheck returns the checks of Deduplicate for r, or none if dedup
+// is not set
+func dedupCheck(r []byte, dedup bool) addCheck {
+	if !dedup {
+		return addCheck{}
+	}
+	id := RequestID(r)
+	return addCheck{visited: true, visitedID: id, pendingID: strconv.FormatUint(id, 10)}
+}
+
+// RequestID returns the ID Colly passes to Visited for a queued request.
+// The payload can be a request serialized by Colly or a plain URL.
+func RequestID(r []byte) uint64 {
+	var req struct {
+		URL  string
+		Body []byte
+	}
+	if json.Unmarshal(r, &req) != nil || req.URL == "" {
+		req.URL, req.Body = string(r), nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(req.URL))
+	h.Write(req.Body)
+	return h.Sum64()
+}
+
+// addRequestsDedup adds each of rs if it is new. Queues which can be
+// written by Lua scripts are checked in a single round trip.
+func (s *Storage) addRequestsDedup(ctx context.Context, rs [][]byte) error {
+	if s.queueKind() == "" {
+		for _, r := range rs {
+			if _, err := s.addRequest(ctx, r, dedupCheck(r, true)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// The capacity was checked for the whole batch.
+	cmds := make([]*redis.Cmd, len(rs))
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, r := range rs {
+			cmds[i] = s.evalAddChecked(ctx, pipe, s.encode(r), 0, 0, dedupCheck(r, true), true)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var added [][]byte
+	for i, cmd := range cmds {
+		if n, _ := cmd.Int(); n == 1 {
+			added = append(added, rs[i])
+		}
+	}
+	s.onAdded(ctx, added...)
+	return nil
+}
+
+// markPending records the pending ID of chk and reports whether the
+// request passes chk, for queues which can not be written by Lua scripts
+func (s *Storage) markPending(ctx context.Context, chk addCheck) (bool, error) {
+	visited, bloom := s.visitedKey(chk.visitedID)
+	keys := []string{s.getPendingID()}
+	if chk.visited {
+		keys = append(keys, visited)
+	}
+	n, err := s.runScript(ctx, s.Client, markPendingScript, keys, chk.visitedID, bloom, chk.pendingID).Int()
+	return n == 1, err
+}
+
+// unmarkPending forgets the popped requests rs, so they can be queued
+// again once their visit expired
+func (s *Storage) unmarkPending(ctx context.Context, rs ...[]byte) error {
+	if !s.Deduplicate || len(rs) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(rs))
+	for i, r := range rs {
+		ids[i] = strconv.FormatUint(RequestID(r), 10)
+	}
+	return s.Client.SRem(ctx, s.getPendingID(), ids...).Err()
+}
+
+// decodePopped decodes the popped request p and forgets it
+func (s *Storage) decodePopped(ctx context.Context, p []byte) ([]byte, error) {
+	r, err := s.decode(p)
+	if err != nil {
+		return nil, err
+	}
+	s.onPopped(ctx, r)
+	return r, s.unmarkPending(ctx, r)
+}
+
+func (s *Storage) getPendingID() string {
+	return s.queueKey("pending")
+}
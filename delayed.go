@@ -0,0 +1,91 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// promoteBatch is the maximum number of due requests moved into the
+// queue by one GetRequest call
+const promoteBatch = 100
+
+// promoteScript moves due requests from the delayed set into the queue.
+// ARGV[3] selects the command matching the QueueMode.
+var promoteScript = newScript(pushLua + `
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, r in ipairs(due) do
+	redis.call("ZREM", KEYS[1], r)
+	push(KEYS[2], ARGV[3], r)
+end
+return #due
+`)
+
+// AddRequestAfter adds a request which is not returned by GetRequest
+// before delay has passed. It requires DelayedRequests to be enabled.
+// Identical payloads waiting in the delayed set are stored only once.
+func (s *Storage) AddRequestAfter(r []byte, delay time.Duration) error {
+	return s.AddRequestAfterCtx(context.Background(), r, delay)
+}
+
+// AddRequestAfterCtx is the context-aware variant of AddRequestAfter
+func (s *Storage) AddRequestAfterCtx(ctx context.Context, r []byte, delay time.Duration) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if !s.DelayedRequests {
+		return errors.New("redisstorage: DelayedRequests is not enabled")
+	}
+	return s.intercept(ctx, &Op{Name: "AddRequestAfter", Request: r, TTL: delay}, func(ctx context.Context, op *Op) error {
+		ready := time.Now().Add(op.TTL).UnixMilli()
+		return s.Client.ZAdd(ctx, s.getDelayedID(), redis.Z{Score: float64(ready), Member: s.encode(op.Request)}).Err()
+	})
+}
+
+// DelayedSize returns the number of requests which are not due yet
+func (s *Storage) DelayedSize() (int, error) {
+	return s.DelayedSizeCtx(context.Background())
+}
+
+// DelayedSizeCtx is the context-aware variant of DelayedSize
+func (s *Storage) DelayedSizeCtx(ctx context.Context) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	i, err := s.Client.ZCard(ctx, s.getDelayedID()).Result()
+	return int(i), err
+}
+
+// promoteDelayed moves the due requests of the delayed set into the queue
+func (s *Storage) promoteDelayed(ctx context.Context) error {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if s.queueKind() == "" {
+		due, err := s.Client.ZRangeByScore(ctx, s.getDelayedID(), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   now,
+			Count: promoteBatch,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, p := range due {
+			// Only the worker removing the request moves it.
+			if n, err := s.Client.ZRem(ctx, s.getDelayedID(), p).Result(); err != nil || n == 0 {
+				continue
+			}
+			if err := s.pushEncoded(ctx, []byte(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	keys := []string{s.getDelayedID(), s.getQueueID()}
+	return s.runScript(ctx, s.Client, promoteScript, keys, now, promoteBatch, s.queueKind()).Err()
+}
+
+func (s *Storage) getDelayedID() string {
+	return s.queueKey("delayed")
+}
@@ -0,0 +1,167 @@
+package redisstorage
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// requeueScript moves up to ARGV[1] of the oldest dead-lettered
+// requests back into the queue
+var requeueScript = newScript(pushLua + `
+local n = 0
+for i = 1, tonumber(ARGV[1]) do
+	local r = redis.call("RPOP", KEYS[1])
+	if not r then
+		break
+	end
+	push(KEYS[2], ARGV[2], r)
+	n = n + 1
+end
+return n
+`)
+
+// MoveToDLQ parks a request which failed permanently in the dead-letter
+// queue. With QueueReliable and QueueStream the request is also removed
+// from the in-flight requests of the consumer. With Deduplicate it is no
+// longer pending, so it can be added again.
+func (s *Storage) MoveToDLQ(r []byte) error {
+	return s.MoveToDLQCtx(context.Background(), r)
+}
+
+// MoveToDLQCtx is the context-aware variant of MoveToDLQ
+func (s *Storage) MoveToDLQCtx(ctx context.Context, r []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.intercept(ctx, &Op{Name: "MoveToDLQ", Request: r}, func(ctx context.Context, op *Op) error {
+		return s.moveToDLQ(ctx, op.Request)
+	})
+}
+
+func (s *Storage) moveToDLQ(ctx context.Context, r []byte) error {
+	p := s.encode(r)
+	var streamID string
+	if s.QueueMode == QueueStream {
+		id, ok, err := s.untrackStream(ctx, p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			streamID = id
+		}
+	}
+	_, err := s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		switch s.QueueMode {
+		case QueueReliable:
+			pipe.LRem(ctx, s.getProcessingID(), 1, p)
+			pipe.ZRem(ctx, s.getClaimsID(), s.claimMember(p))
+		case QueueStream:
+			if streamID != "" {
+				pipe.XAck(ctx, s.getQueueID(), s.ConsumerGroup, streamID)
+				pipe.XDel(ctx, s.getQueueID(), streamID)
+			}
+		}
+		if s.Deduplicate {
+			pipe.SRem(ctx, s.getPendingID(), strconv.FormatUint(RequestID(r), 10))
+		}
+		if s.TrackQueueStats {
+			pipe.ZRem(ctx, s.getEnqueuedID(), enqueuedMember(r))
+		}
+		pipe.LPush(ctx, s.getDLQID(), p)
+		return nil
+	})
+	return err
+}
+
+// ListDLQ returns up to n requests of the dead-letter queue without
+// removing them, most recently dead-lettered first
+func (s *Storage) ListDLQ(n int) ([][]byte, error) {
+	return s.ListDLQCtx(context.Background(), n)
+}
+
+// ListDLQCtx is the context-aware variant of ListDLQ
+func (s *Storage) ListDLQCtx(ctx context.Context, n int) ([][]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	op := &Op{Name: "ListDLQ", Count: n}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		vs, err := s.Client.LRange(ctx, s.getDLQID(), 0, int64(op.Count-1)).Result()
+		if err != nil {
+			return err
+		}
+		op.Requests, err = s.decodeAll(vs)
+		return err
+	})
+	return op.Requests, err
+}
+
+// DLQSize returns the number of requests in the dead-letter queue
+func (s *Storage) DLQSize() (int, error) {
+	return s.DLQSizeCtx(context.Background())
+}
+
+// DLQSizeCtx is the context-aware variant of DLQSize
+func (s *Storage) DLQSizeCtx(ctx context.Context) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	op := &Op{Name: "DLQSize"}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		i, err := s.Client.LLen(ctx, s.getDLQID()).Result()
+		op.Size = int(i)
+		return err
+	})
+	return op.Size, err
+}
+
+// RequeueFromDLQ moves up to n of the oldest dead-lettered requests back
+// into the queue and returns the number of moved requests
+func (s *Storage) RequeueFromDLQ(n int) (int, error) {
+	return s.RequeueFromDLQCtx(context.Background(), n)
+}
+
+// RequeueFromDLQCtx is the context-aware variant of RequeueFromDLQ
+func (s *Storage) RequeueFromDLQCtx(ctx context.Context, n int) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	op := &Op{Name: "RequeueFromDLQ", Count: n}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Size, err = s.requeueFromDLQ(ctx, op.Count)
+		return err
+	})
+	return op.Size, err
+}
+
+func (s *Storage) requeueFromDLQ(ctx context.Context, n int) (int, error) {
+	if s.queueKind() == "" {
+		for i := 0; i < n; i++ {
+			p, err := s.Client.RPop(ctx, s.getDLQID()).Bytes()
+			if err == redis.Nil {
+				return i, nil
+			} else if err != nil {
+				return i, err
+			}
+			if err := s.pushEncoded(ctx, p); err != nil {
+				return i, err
+			}
+		}
+		return n, nil
+	}
+	keys := []string{s.getDLQID(), s.getQueueID()}
+	return s.runScript(ctx, s.Client, requeueScript, keys, n, s.queueKind()).Int()
+}
+
+func (s *Storage) getDLQID() string {
+	return s.queueKey("dlq")
+}
@@ -0,0 +1,76 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrVisitLimitReached is returned by VisitDomain if the host was
+// already visited DomainVisitLimit times in the current window
+var ErrVisitLimitReached = errors.New("redisstorage: domain visit limit reached")
+
+// visitDomainScript counts a visit of a host unless the limit is
+// reached. The window starts with the first visit. It returns the new
+// count or -1 if the limit is reached.
+// KEYS: counter
+// ARGV: limit or 0, window in milliseconds or 0
+var visitDomainScript = newScript(`
+local limit = tonumber(ARGV[1])
+if limit > 0 and tonumber(redis.call("GET", KEYS[1]) or "0") >= limit then
+	return -1
+end
+local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return n
+`)
+
+// VisitDomain counts a visit of host, shared by all storages using the
+// prefix. If DomainVisitLimit is set and host was visited that often
+// within VisitedTTL, the visit is not counted and ErrVisitLimitReached is
+// returned. Call it before fetching a page, e.g. in an OnRequest
+// callback aborting the request on error.
+func (s *Storage) VisitDomain(host string) error {
+	return s.VisitDomainCtx(context.Background(), host)
+}
+
+// VisitDomainCtx is the context-aware variant of VisitDomain
+func (s *Storage) VisitDomainCtx(ctx context.Context, host string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	keys := []string{s.getDomainID(host)}
+	n, err := s.runScript(ctx, s.Client, visitDomainScript, keys, s.DomainVisitLimit, s.visitedTTL().Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return ErrVisitLimitReached
+	}
+	return nil
+}
+
+// DomainVisits returns the number of visits of host counted by
+// VisitDomain in the current window
+func (s *Storage) DomainVisits(host string) (int, error) {
+	return s.DomainVisitsCtx(context.Background(), host)
+}
+
+// DomainVisitsCtx is the context-aware variant of DomainVisits
+func (s *Storage) DomainVisitsCtx(ctx context.Context, host string) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	n, err := s.Client.Get(ctx, s.getDomainID(host)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *Storage) getDomainID(host string) string {
+	return s.key("domain", host)
+}
@@ -0,0 +1,78 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultWaitTimeout is the default of WaitTimeout
+const defaultWaitTimeout = time.Second
+
+// ErrNotReplicated is returned with WaitReplicas if fewer replicas
+// acknowledged a write in time. The write succeeded on the primary but
+// can be lost if it fails.
+var ErrNotReplicated = errors.New("redisstorage: write not acknowledged by enough replicas")
+
+// ErrWaitCluster is returned by Init for WaitReplicas on a cluster or
+// ring, whose writes are spread over several primaries
+var ErrWaitCluster = errors.New("redisstorage: WaitReplicas is not supported by redis cluster or ring")
+
+func (s *Storage) waitTimeout() time.Duration {
+	if s.WaitTimeout > 0 {
+		return s.WaitTimeout
+	}
+	return defaultWaitTimeout
+}
+
+// wait adds a WAIT for the writes queued in pipe to pipe. It returns nil
+// unless WaitReplicas is set.
+func (s *Storage) wait(ctx context.Context, pipe redis.Pipeliner) *redis.Cmd {
+	if s.WaitReplicas <= 0 {
+		return nil
+	}
+	// Pipeliner lacks Wait.
+	return pipe.Do(ctx, "wait", s.WaitReplicas, s.waitTimeout().Milliseconds())
+}
+
+// replicated returns the error of a WAIT added by wait
+func (s *Storage) replicated(cmd *redis.Cmd) error {
+	if cmd == nil {
+		return nil
+	}
+	n, err := cmd.Int64()
+	if err != nil {
+		return err
+	}
+	if n < int64(s.WaitReplicas) {
+		return fmt.Errorf("%w: %d of %d", ErrNotReplicated, n, s.WaitReplicas)
+	}
+	return nil
+}
+
+// waitReplicas waits until WaitReplicas replicas received the writes
+// which completed before. WAIT only covers the writes of its connection,
+// so a write on the same connection precedes it; it follows the earlier
+// writes in the replication stream.
+func (s *Storage) waitReplicas(ctx context.Context) error {
+	if s.WaitReplicas <= 0 {
+		return nil
+	}
+	var wait *redis.Cmd
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.getWaitID(), "1", s.waitTimeout())
+		wait = s.wait(ctx, pipe)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.replicated(wait)
+}
+
+func (s *Storage) getWaitID() string {
+	return s.key("wait")
+}
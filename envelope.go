@@ -0,0 +1,130 @@
+package redisstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// itemMagic is the header of the envelope of queued items. Serialized
+// Colly requests and the headers of compressed payloads never start
+// with it.
+var itemMagic = []byte{0xc1, 0x1e}
+
+// itemHeader is the size of the envelope before the payload: magic,
+// priority, enqueue time, attempts and not-before time
+const itemHeader = 2 + 8 + 8 + 4 + 8
+
+// ErrInvalidItem is returned by GetItem for a truncated envelope
+var ErrInvalidItem = errors.New("redisstorage: invalid queue item envelope")
+
+// Item is a queued payload with the metadata of its envelope, see AddItem
+type Item struct {
+	// Payload is the queued request
+	Payload []byte
+	// Priority is the score of a QueuePriority queue
+	Priority float64
+	// Enqueued is the time the item was added. AddItem sets it if it is
+	// zero.
+	Enqueued time.Time
+	// Attempts is the number of times the item was processed, kept by
+	// the application when it adds the item again
+	Attempts int
+	// NotBefore is the time before which the item should not be
+	// processed, or zero
+	NotBefore time.Time
+}
+
+// Wait returns how long the item waited in the queue until now
+func (it *Item) Wait(now time.Time) time.Duration {
+	if it.Enqueued.IsZero() {
+		return 0
+	}
+	return now.Sub(it.Enqueued)
+}
+
+// AddItem adds a payload wrapped in an envelope carrying its metadata,
+// which GetItem returns. Items with a NotBefore in the future are
+// delayed like AddRequestAfter if DelayedRequests is set, and items of a
+// QueuePriority queue are scored with their Priority. GetRequest
+// returns items with their envelope. As the envelope holds the enqueue
+// time, identical payloads are not deduplicated.
+func (s *Storage) AddItem(it Item) error {
+	return s.AddItemCtx(context.Background(), it)
+}
+
+// AddItemCtx is the context-aware variant of AddItem
+func (s *Storage) AddItemCtx(ctx context.Context, it Item) error {
+	if it.Enqueued.IsZero() {
+		it.Enqueued = time.Now()
+	}
+	p := encodeItem(it)
+	switch {
+	case s.DelayedRequests && time.Until(it.NotBefore) > 0:
+		return s.AddRequestAfterCtx(ctx, p, time.Until(it.NotBefore))
+	case s.QueueMode == QueuePriority && s.QueueStrategy == nil:
+		return s.AddRequestWithPriorityCtx(ctx, p, it.Priority)
+	}
+	return s.AddRequestCtx(ctx, p)
+}
+
+// GetItem removes and returns the next item like GetRequest. Payloads
+// added without an envelope, e.g. by AddRequest, are returned as items
+// with only their Payload set.
+func (s *Storage) GetItem() (*Item, error) {
+	return s.GetItemCtx(context.Background())
+}
+
+// GetItemCtx is the context-aware variant of GetItem
+func (s *Storage) GetItemCtx(ctx context.Context) (*Item, error) {
+	p, err := s.GetRequestCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItem(p)
+}
+
+func encodeItem(it Item) []byte {
+	b := make([]byte, itemHeader, itemHeader+len(it.Payload))
+	copy(b, itemMagic)
+	binary.BigEndian.PutUint64(b[2:], math.Float64bits(it.Priority))
+	binary.BigEndian.PutUint64(b[10:], uint64(unixNano(it.Enqueued)))
+	binary.BigEndian.PutUint32(b[18:], uint32(it.Attempts))
+	binary.BigEndian.PutUint64(b[22:], uint64(unixNano(it.NotBefore)))
+	return append(b, it.Payload...)
+}
+
+func decodeItem(p []byte) (*Item, error) {
+	if !bytes.HasPrefix(p, itemMagic) {
+		return &Item{Payload: p}, nil
+	}
+	if len(p) < itemHeader {
+		return nil, ErrInvalidItem
+	}
+	return &Item{
+		Payload:   p[itemHeader:],
+		Priority:  math.Float64frombits(binary.BigEndian.Uint64(p[2:])),
+		Enqueued:  fromUnixNano(int64(binary.BigEndian.Uint64(p[10:]))),
+		Attempts:  int(binary.BigEndian.Uint32(p[18:])),
+		NotBefore: fromUnixNano(int64(binary.BigEndian.Uint64(p[22:]))),
+	}, nil
+}
+
+// unixNano returns the Unix time of t in nanoseconds, or 0 for the zero
+// time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,81 @@
+package redisstorage
+
+import (
+	"context"
+	"time"
+)
+
+// defaultCloseTimeout is the default of CloseTimeout
+const defaultCloseTimeout = 5 * time.Second
+
+// Flush writes the pending batches, the visits of AsyncVisited and the
+// visits and requests buffered by the CircuitBreaker to redis and waits
+// until the writes queued for Mirror are sent. Call it before the
+// process exits, e.g. on SIGTERM; Close flushes as well.
+func (s *Storage) Flush() error {
+	return s.FlushCtx(context.Background())
+}
+
+// FlushCtx is the context-aware variant of Flush
+func (s *Storage) FlushCtx(ctx context.Context) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.flushBatches()
+	if s.async != nil {
+		if err := s.async.flush(ctx); err != nil {
+			return err
+		}
+	}
+	err := s.flushBreaker(ctx)
+	if s.mirror != nil {
+		s.mirror.flush(ctx)
+		if err == nil && s.mirror.pending.Load() > 0 {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// flushBreaker replays the buffer of the CircuitBreaker. It returns
+// ErrCircuitOpen if the breaker is open and entries are buffered.
+func (s *Storage) flushBreaker(ctx context.Context) error {
+	b := s.CircuitBreaker
+	if b == nil || b.size() == 0 {
+		return nil
+	}
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	return s.replay(ctx)
+}
+
+// drain flushes the storage for Close within CloseTimeout
+func (s *Storage) drain() error {
+	timeout := s.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.flushBatches()
+	var err error
+	if s.async != nil {
+		// The visits are logged if they are lost.
+		err = s.async.close(ctx)
+	}
+	if berr := s.flushBreaker(ctx); berr != nil {
+		s.logf("%d buffered visits and requests lost on Close: %s", s.CircuitBreaker.size(), berr)
+		if err == nil {
+			err = berr
+		}
+	}
+	if s.mirror != nil {
+		s.mirror.close(ctx)
+		if n := s.mirror.pending.Load(); n > 0 && err == nil {
+			s.logf("%d mirror writes lost on Close", n)
+			err = ctx.Err()
+		}
+	}
+	return err
+}
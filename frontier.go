@@ -0,0 +1,154 @@
+package redisstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrHostHashTag is returned by Init for QueueHost on a cluster or ring
+// without HashTag, as the host queues would be spread over slots
+var ErrHostHashTag = errors.New("redisstorage: QueueHost requires HashTag on redis cluster or ring")
+
+// The host queues are reached by popHostScript through their key
+// prefix, so they must be in the slot of the other keys of the storage,
+// which on a cluster requires HashTag. A host stays in the hosts set
+// until its politeness delay elapsed, also after its queue emptied, so
+// the hosts set holds the next fetch time of every recently served host.
+
+// addHostScript appends a request to the queue of its host and schedules
+// the host unless it is waiting for its next fetch time.
+// KEYS: hosts, host queue, size
+// ARGV: host, now, request
+var addHostScript = newScript(`
+redis.call("LPUSH", KEYS[2], ARGV[3])
+redis.call("INCR", KEYS[3])
+redis.call("ZADD", KEYS[1], "NX", ARGV[2], ARGV[1])
+return 1
+`)
+
+// popHostScript pops the oldest request of the first host whose
+// politeness delay has elapsed and reschedules the host. Hosts whose
+// queue is empty when they are due are removed.
+// KEYS: hosts, size
+// ARGV: now, delay, host queue key prefix
+var popHostScript = newScript(`
+while true do
+	local h = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 1)
+	if #h == 0 then
+		return false
+	end
+	local r = redis.call("RPOP", ARGV[3] .. h[1])
+	if r then
+		redis.call("ZADD", KEYS[1], tonumber(ARGV[1]) + tonumber(ARGV[2]), h[1])
+		redis.call("DECR", KEYS[2])
+		return r
+	end
+	redis.call("ZREM", KEYS[1], h[1])
+	if redis.call("ZCARD", KEYS[1]) == 0 then
+		-- Host queues expired by QueueItemTTL are still counted.
+		redis.call("DEL", KEYS[2])
+	end
+end
+`)
+
+// RequestHost returns the host of a queued request. The payload can be
+// a request serialized by Colly or a plain URL. It is the default
+// HostFunc of QueueHost.
+func RequestHost(r []byte) string {
+	raw := string(r)
+	var req struct {
+		URL string
+	}
+	if json.Unmarshal(r, &req) == nil && req.URL != "" {
+		raw = req.URL
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (s *Storage) requestHost(r []byte) string {
+	if s.HostFunc != nil {
+		return s.HostFunc(r)
+	}
+	return RequestHost(r)
+}
+
+func (s *Storage) addHost(ctx context.Context, r []byte) error {
+	return s.evalAddHost(ctx, s.Client, s.requestHost(r), s.encode(r), false).Err()
+}
+
+// evalAddHost runs addHostScript for the encoded request p of host h
+func (s *Storage) evalAddHost(ctx context.Context, c redis.Cmdable, h string, p []byte, pipelined bool) *redis.Cmd {
+	keys := []string{s.getHostsID(), s.getHostQueueID(h), s.getHostSizeID()}
+	if pipelined {
+		return s.evalScript(ctx, c, addHostScript, keys, h, time.Now().UnixMilli(), p)
+	}
+	return s.runScript(ctx, c, addHostScript, keys, h, time.Now().UnixMilli(), p)
+}
+
+// addEncodedHost adds a request read from another key of the storage
+func (s *Storage) addEncodedHost(ctx context.Context, p []byte) error {
+	r, err := s.decode(p)
+	if err != nil {
+		return err
+	}
+	return s.evalAddHost(ctx, s.Client, s.requestHost(r), p, false).Err()
+}
+
+func (s *Storage) popHost(ctx context.Context) ([]byte, error) {
+	keys := []string{s.getHostsID(), s.getHostSizeID()}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	delay := s.PolitenessDelay.Milliseconds()
+	r, err := s.runScript(ctx, s.Client, popHostScript, keys, now, delay, s.getHostQueueID("")).Text()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r), nil
+}
+
+// popHostN pops up to n requests in one pipeline. Every pop is
+// scheduled separately, so a host can appear in the result only once per
+// PolitenessDelay.
+func (s *Storage) popHostN(ctx context.Context, n int) ([]string, error) {
+	keys := []string{s.getHostsID(), s.getHostSizeID()}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	delay := s.PolitenessDelay.Milliseconds()
+	cmds, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < n; i++ {
+			s.evalScript(ctx, pipe, popHostScript, keys, now, delay, s.getHostQueueID(""))
+		}
+		return nil
+	})
+	return pipelinedStrings(cmds, err)
+}
+
+// hostQueueSize returns the number of requests in the host queues,
+// which the scripts count as they push and pop them
+func (s *Storage) hostQueueSize(ctx context.Context) (int64, error) {
+	n, err := s.Client.Get(ctx, s.getHostSizeID()).Int64()
+	if err == redis.Nil || n < 0 {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *Storage) getHostsID() string {
+	return s.queueKey("hosts")
+}
+
+func (s *Storage) getHostSizeID() string {
+	return s.queueKey("hostsize")
+}
+
+func (s *Storage) getHostQueueID(host string) string {
+	return s.queueKey("host", host)
+}
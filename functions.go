@@ -0,0 +1,88 @@
+package redisstorage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	libraryOnce sync.Once
+	libraryName string
+	libraryCode string
+)
+
+// library returns the name and code of the function library holding the
+// scripts of the package. The name contains a digest of the scripts, so
+// storages of different versions can share a server.
+func library() (string, string) {
+	libraryOnce.Do(func() {
+		shas := make([]string, 0, len(scripts))
+		for sha := range scripts {
+			shas = append(shas, sha)
+		}
+		sort.Strings(shas)
+		h := sha1.New()
+		for _, sha := range shas {
+			h.Write([]byte(sha))
+		}
+		libraryName = "redisstorage_" + hex.EncodeToString(h.Sum(nil))[:12]
+		var b strings.Builder
+		b.WriteString("#!lua name=" + libraryName + "\n")
+		for _, sha := range shas {
+			// The parameters take the place of the globals of EVAL.
+			b.WriteString("redis.register_function('" + libraryName + "_" + sha + "', function(KEYS, ARGV)\n")
+			b.WriteString(scripts[sha])
+			b.WriteString("\nend)\n")
+		}
+		libraryCode = b.String()
+	})
+	return libraryName, libraryCode
+}
+
+// functionName returns the name of script in the library
+func functionName(script *redis.Script) string {
+	name, _ := library()
+	return name + "_" + script.Hash()
+}
+
+// functionScript returns the source of the script of the library
+// function name
+func functionScript(name string) string {
+	lib, _ := library()
+	return scripts[strings.TrimPrefix(name, lib+"_")]
+}
+
+// loadFunctions loads the function library. Servers before redis 7 fail
+// with an unknown command error. On a cluster or ring every shard loads
+// it.
+func (s *Storage) loadFunctions(ctx context.Context) error {
+	_, code := library()
+	return forEachNode(ctx, s.Client, func(ctx context.Context, n redis.Cmdable) error {
+		return n.FunctionLoadReplace(ctx, code).Err()
+	})
+}
+
+// isUnknownCommand reports whether err means that the server does not
+// support a command, e.g. of a module or a newer version
+func isUnknownCommand(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
+
+func isNoFunction(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Function not found")
+}
+
+// runScript runs script with FCALL once Init loaded the function library,
+// and with Script.Run otherwise
+func (s *Storage) runScript(ctx context.Context, c redis.Cmdable, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	if s.functions {
+		return c.FCall(ctx, functionName(script), keys, args...)
+	}
+	return script.Run(ctx, c, keys, args...)
+}
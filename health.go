@@ -0,0 +1,32 @@
+package redisstorage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// healthTTL is the expiration of the key written by Healthy
+const healthTTL = 10 * time.Second
+
+// Healthy pings redis and checks that the prefix is writable, e.g. that
+// the master was not demoted to a read-only replica. It returns the
+// round-trip time of the ping, so it can be used for readiness probes.
+func (s *Storage) Healthy(ctx context.Context) (time.Duration, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := s.Client.Ping(ctx).Err(); err != nil {
+		return 0, fmt.Errorf("redisstorage: ping failed: %w", err)
+	}
+	latency := time.Since(start)
+	if err := s.Client.Set(ctx, s.getHealthID(), time.Now().UnixMilli(), healthTTL).Err(); err != nil {
+		return latency, fmt.Errorf("redisstorage: prefix is not writable: %w", err)
+	}
+	return latency, nil
+}
+
+func (s *Storage) getHealthID() string {
+	return s.key("health", s.ConsumerID)
+}
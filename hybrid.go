@@ -0,0 +1,425 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HybridStorage is a storage which keeps working while redis is
+// unreachable, e.g. during maintenance. Visits, cookies and requests are
+// then kept in process and written to redis once it is reachable again;
+// requests queued in redis are not returned meanwhile. Visits of other
+// workers are not known to the local store, so pages can be visited
+// twice during an outage.
+//
+// Parts of the local store redis rejects, e.g. requests exceeding
+// MaxQueueSize, stay in process while redis is used again. They are
+// still looked up and returned once the queue in redis is empty, and
+// Flush tries to write them again.
+type HybridStorage struct {
+	// RetryInterval is how often redis is tried again while it is
+	// unreachable. Default is 5s.
+	RetryInterval time.Duration
+
+	s *Storage
+
+	mu          sync.Mutex // Protects the fields below.
+	initialized bool
+	offline     bool
+	merging     bool // Whether the local store is being written to redis.
+	retryAt     time.Time
+	localStore
+}
+
+// localStore holds what is written while redis is unreachable
+type localStore struct {
+	visited map[uint64]bool
+	cookies map[string]localCookies
+	queue   [][]byte
+}
+
+func newLocalStore() localStore {
+	return localStore{visited: make(map[uint64]bool), cookies: make(map[string]localCookies)}
+}
+
+func (l *localStore) empty() bool {
+	return len(l.visited) == 0 && len(l.cookies) == 0 && len(l.queue) == 0
+}
+
+// restore puts back the parts of rest which were not written to redis.
+// Cookies set since rest was taken are newer and kept; requests of rest
+// are older and returned first.
+func (l *localStore) restore(rest localStore) {
+	for id := range rest.visited {
+		l.visited[id] = true
+	}
+	for host, c := range rest.cookies {
+		if _, ok := l.cookies[host]; !ok {
+			l.cookies[host] = c
+		}
+	}
+	l.queue = append(rest.queue, l.queue...)
+}
+
+type localCookies struct {
+	u       *url.URL
+	cookies string
+}
+
+// Hybrid returns a storage falling back to memory when s is unreachable.
+// It implements the storage and queue interfaces of Colly in place of s.
+func (s *Storage) Hybrid() *HybridStorage {
+	return &HybridStorage{s: s}
+}
+
+// Init initializes the redis storage. If redis is unreachable, the
+// local store is used until it is reachable.
+func (h *HybridStorage) Init() error {
+	return h.InitCtx(context.Background())
+}
+
+// InitCtx is the context-aware variant of Init
+func (h *HybridStorage) InitCtx(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.s.InitCtx(ctx)
+	if err == nil {
+		h.initialized = true
+		return nil
+	}
+	if !errors.Is(err, ErrConnection) || !IsRetriable(err) {
+		return err
+	}
+	h.setOffline()
+	return nil
+}
+
+// Offline reports whether the local store is in use
+func (h *HybridStorage) Offline() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.offline
+}
+
+// Flush writes the local store to redis if it is reachable again and
+// flushes the redis storage, see Storage.Flush. Call it before the
+// process exits; the local store is lost otherwise.
+func (h *HybridStorage) Flush() error {
+	return h.FlushCtx(context.Background())
+}
+
+// FlushCtx is the context-aware variant of Flush
+func (h *HybridStorage) FlushCtx(ctx context.Context) error {
+	h.mu.Lock()
+	merge := !h.merging && (h.offline || !h.localStore.empty())
+	if merge {
+		h.merging = true
+	}
+	h.mu.Unlock()
+	if merge {
+		if err := h.merge(ctx); err != nil {
+			return err
+		}
+	}
+	return h.s.FlushCtx(ctx)
+}
+
+// Visited implements colly/storage.Visited()
+func (h *HybridStorage) Visited(requestID uint64) error {
+	return h.VisitedCtx(context.Background(), requestID)
+}
+
+// VisitedCtx is the context-aware variant of Visited
+func (h *HybridStorage) VisitedCtx(ctx context.Context, requestID uint64) error {
+	if h.online(ctx) {
+		if err := h.s.VisitedCtx(ctx, requestID); !h.fail(err) {
+			return err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.visited[requestID] = true
+	return nil
+}
+
+// IsVisited implements colly/storage.IsVisited()
+func (h *HybridStorage) IsVisited(requestID uint64) (bool, error) {
+	return h.IsVisitedCtx(context.Background(), requestID)
+}
+
+// IsVisitedCtx is the context-aware variant of IsVisited
+func (h *HybridStorage) IsVisitedCtx(ctx context.Context, requestID uint64) (bool, error) {
+	if h.online(ctx) {
+		ok, err := h.s.IsVisitedCtx(ctx, requestID)
+		if !h.fail(err) {
+			if ok || err != nil {
+				return ok, err
+			}
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return h.visited[requestID], nil
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.visited[requestID], nil
+}
+
+// SetCookies implements colly/storage.SetCookies()
+func (h *HybridStorage) SetCookies(u *url.URL, cookies string) {
+	h.SetCookiesCtx(context.Background(), u, cookies)
+}
+
+// SetCookiesCtx is the context-aware variant of SetCookies
+func (h *HybridStorage) SetCookiesCtx(ctx context.Context, u *url.URL, cookies string) {
+	if h.online(ctx) {
+		err := h.s.SetCookiesECtx(ctx, u, cookies)
+		if !h.fail(err) {
+			if err != nil {
+				h.s.errs.record(err)
+				h.s.logf("SetCookies() .Set error %s", err)
+			}
+			return
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cookies[u.Host] = localCookies{u, cookies}
+}
+
+// Cookies implements colly/storage.Cookies()
+func (h *HybridStorage) Cookies(u *url.URL) string {
+	return h.CookiesCtx(context.Background(), u)
+}
+
+// CookiesCtx is the context-aware variant of Cookies
+func (h *HybridStorage) CookiesCtx(ctx context.Context, u *url.URL) string {
+	if h.online(ctx) {
+		cookies, err := h.s.CookiesECtx(ctx, u)
+		if !h.fail(err) {
+			if err != nil {
+				h.s.errs.record(err)
+				h.s.logf("Cookies() .Get error %s", err)
+			}
+			if cookies != "" || err != nil {
+				return cookies
+			}
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return h.cookies[u.Host].cookies
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cookies[u.Host].cookies
+}
+
+// AddRequest implements queue.Storage.AddRequest() function
+func (h *HybridStorage) AddRequest(r []byte) error {
+	return h.AddRequestCtx(context.Background(), r)
+}
+
+// AddRequestCtx is the context-aware variant of AddRequest
+func (h *HybridStorage) AddRequestCtx(ctx context.Context, r []byte) error {
+	if h.online(ctx) {
+		if err := h.s.AddRequestCtx(ctx, r); !h.fail(err) {
+			return err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queue = append(h.queue, r)
+	return nil
+}
+
+// GetRequest implements queue.Storage.GetRequest() function
+func (h *HybridStorage) GetRequest() ([]byte, error) {
+	return h.GetRequestCtx(context.Background())
+}
+
+// GetRequestCtx is the context-aware variant of GetRequest
+func (h *HybridStorage) GetRequestCtx(ctx context.Context) ([]byte, error) {
+	if h.online(ctx) {
+		r, err := h.s.GetRequestCtx(ctx)
+		if !h.fail(err) && err != ErrQueueEmpty {
+			return r, err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.queue) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	r := h.queue[0]
+	h.queue = h.queue[1:]
+	return r, nil
+}
+
+// QueueSize implements queue.Storage.QueueSize() function
+func (h *HybridStorage) QueueSize() (int, error) {
+	return h.QueueSizeCtx(context.Background())
+}
+
+// QueueSizeCtx is the context-aware variant of QueueSize
+func (h *HybridStorage) QueueSizeCtx(ctx context.Context) (int, error) {
+	if h.online(ctx) {
+		n, err := h.s.QueueSizeCtx(ctx)
+		if !h.fail(err) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return n + len(h.queue), err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.queue), nil
+}
+
+// online reports whether redis is to be used. Once the retry interval
+// passed, it writes the local store to redis if it is reachable again.
+// Meanwhile the other callers keep using the local store.
+func (h *HybridStorage) online(ctx context.Context) bool {
+	h.mu.Lock()
+	if !h.offline {
+		h.mu.Unlock()
+		return true
+	}
+	if h.merging || time.Now().Before(h.retryAt) {
+		h.mu.Unlock()
+		return false
+	}
+	h.merging = true
+	h.mu.Unlock()
+	err := h.merge(ctx)
+	if IsRetriable(err) {
+		return false
+	}
+	if err != nil {
+		h.s.errs.record(err)
+		h.s.logf("merging the local store failed: %s", err)
+	}
+	return true
+}
+
+// fail switches to the local store and reports true if err means that
+// redis is unreachable
+func (h *HybridStorage) fail(err error) bool {
+	if !IsRetriable(err) {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setOffline()
+	return true
+}
+
+func (h *HybridStorage) setOffline() {
+	if !h.offline {
+		h.s.logf("redis is unreachable, using the local store")
+	}
+	h.offline = true
+	interval := h.RetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	h.retryAt = time.Now().Add(interval)
+	if h.visited == nil {
+		h.localStore = newLocalStore()
+	}
+}
+
+// merge writes the local store to redis until it is empty and then
+// switches to redis, unless redis is unreachable. The caller sets
+// merging. The I/O is done without holding mu, so writes arriving
+// meanwhile go to the local store and are written in the next round.
+// Parts redis rejects for other reasons stay in the local store, and
+// redis is used again.
+func (h *HybridStorage) merge(ctx context.Context) error {
+	for {
+		err := h.reconcile(ctx)
+		h.mu.Lock()
+		if IsRetriable(err) {
+			h.merging = false
+			h.setOffline()
+			h.mu.Unlock()
+			return err
+		}
+		if err == nil && !h.localStore.empty() {
+			h.mu.Unlock()
+			continue
+		}
+		if h.offline && err == nil {
+			h.s.logf("redis is reachable again, local store merged")
+		}
+		h.offline = false
+		h.merging = false
+		h.mu.Unlock()
+		return err
+	}
+}
+
+// reconcile writes the current local store to redis. The parts not
+// written are put back into the local store, so a failure only repeats
+// the rest.
+func (h *HybridStorage) reconcile(ctx context.Context) error {
+	if err := h.connect(ctx); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	l := h.localStore
+	h.localStore = newLocalStore()
+	h.mu.Unlock()
+	err := h.write(ctx, &l)
+	h.mu.Lock()
+	h.localStore.restore(l)
+	h.mu.Unlock()
+	return err
+}
+
+// connect initializes the redis storage if Init could not, or checks
+// that redis is reachable
+func (h *HybridStorage) connect(ctx context.Context) error {
+	h.mu.Lock()
+	initialized := h.initialized
+	h.mu.Unlock()
+	if initialized {
+		return h.s.Client.Ping(ctx).Err()
+	}
+	if err := h.s.InitCtx(ctx); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.initialized = true
+	h.mu.Unlock()
+	return nil
+}
+
+// write writes l to redis, removing the parts written from l
+func (h *HybridStorage) write(ctx context.Context, l *localStore) error {
+	if len(l.visited) > 0 {
+		ids := make([]uint64, 0, len(l.visited))
+		for id := range l.visited {
+			ids = append(ids, id)
+		}
+		if err := h.s.SeedVisitedCtx(ctx, ids); err != nil {
+			return err
+		}
+		l.visited = nil
+	}
+	for host, c := range l.cookies {
+		if err := h.s.SetCookiesECtx(ctx, c.u, c.cookies); err != nil {
+			return err
+		}
+		delete(l.cookies, host)
+	}
+	if len(l.queue) > 0 {
+		if err := h.s.AddRequestsCtx(ctx, l.queue); err != nil {
+			return err
+		}
+		l.queue = nil
+	}
+	return nil
+}
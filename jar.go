@@ -0,0 +1,251 @@
+package redisstorage
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CookieJar implements http.CookieJar, storing the cookies in redis so
+// several HTTP clients share them. It follows the domain, path, secure
+// and expiry rules of RFC 6265, but does not know the public suffix
+// list: it only rejects cookies for top-level domains.
+type CookieJar struct {
+	s *Storage
+}
+
+// jarEntry is a cookie stored by CookieJar
+type jarEntry struct {
+	Name     string
+	Value    string
+	Path     string
+	HostOnly bool      `json:",omitempty"`
+	Secure   bool      `json:",omitempty"`
+	HttpOnly bool      `json:",omitempty"`
+	SameSite int       `json:",omitempty"`
+	Expires  time.Time `json:",omitempty"`
+	Created  time.Time
+}
+
+// CookieJar returns a CookieJar storing the cookies in s
+func (s *Storage) CookieJar() *CookieJar {
+	return &CookieJar{s: s}
+}
+
+// SetCookies implements http.CookieJar.SetCookies(). Errors are logged.
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if err := j.SetCookiesCtx(context.Background(), u, cookies); err != nil {
+		j.s.errs.record(err)
+		j.s.logf("CookieJar.SetCookies() error %s", err)
+	}
+}
+
+// SetCookiesCtx is the context-aware variant of SetCookies which returns
+// errors
+func (j *CookieJar) SetCookiesCtx(ctx context.Context, u *url.URL, cookies []*http.Cookie) error {
+	if err := j.s.check(); err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	host := jarHost(u)
+	if host == "" {
+		return nil
+	}
+	now := time.Now()
+	_, err := j.s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, c := range cookies {
+			domain, hostOnly, ok := cookieDomain(host, c.Domain)
+			if !ok {
+				continue
+			}
+			e := jarEntry{
+				Name:     c.Name,
+				Value:    c.Value,
+				Path:     c.Path,
+				HostOnly: hostOnly,
+				Secure:   c.Secure,
+				HttpOnly: c.HttpOnly,
+				SameSite: int(c.SameSite),
+				Created:  now,
+			}
+			if e.Path == "" || e.Path[0] != '/' {
+				e.Path = defaultPath(u.Path)
+			}
+			field := e.Path + ";" + e.Name
+			switch {
+			case c.MaxAge < 0:
+				pipe.HDel(ctx, j.s.getJarID(domain), field)
+				continue
+			case c.MaxAge > 0:
+				e.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			case !c.Expires.IsZero():
+				if !c.Expires.After(now) {
+					pipe.HDel(ctx, j.s.getJarID(domain), field)
+					continue
+				}
+				e.Expires = c.Expires
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			v, err := j.s.sealCookies(domain, string(b))
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, j.s.getJarID(domain), field, v)
+		}
+		return nil
+	})
+	return err
+}
+
+// Cookies implements http.CookieJar.Cookies(). Errors are logged.
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	cookies, err := j.CookiesCtx(context.Background(), u)
+	if err != nil {
+		j.s.errs.record(err)
+		j.s.logf("CookieJar.Cookies() error %s", err)
+	}
+	return cookies
+}
+
+// CookiesCtx is the context-aware variant of Cookies which returns
+// errors
+func (j *CookieJar) CookiesCtx(ctx context.Context, u *url.URL) ([]*http.Cookie, error) {
+	if err := j.s.check(); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil
+	}
+	host := jarHost(u)
+	if host == "" {
+		return nil, nil
+	}
+	domains := []string{host}
+	if net.ParseIP(host) == nil {
+		// Cookies of the parent domains, but none of top-level domains.
+		for d := host; ; {
+			i := strings.IndexByte(d, '.')
+			if i < 0 {
+				break
+			}
+			d = d[i+1:]
+			if !strings.Contains(d, ".") {
+				break
+			}
+			domains = append(domains, d)
+		}
+	}
+	cmds := make([]*redis.MapStringStringCmd, len(domains))
+	_, err := j.s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, d := range domains {
+			cmds[i] = pipe.HGetAll(ctx, j.s.getJarID(d))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+	var entries []jarEntry
+	for i, c := range cmds {
+		for field, v := range c.Val() {
+			b, err := j.s.openCookies(domains[i], v)
+			if err != nil {
+				return nil, err
+			}
+			var e jarEntry
+			if json.Unmarshal([]byte(b), &e) != nil {
+				continue
+			}
+			if !e.Expires.IsZero() && !e.Expires.After(now) {
+				// Expired cookies are removed lazily.
+				j.s.Client.HDel(ctx, j.s.getJarID(domains[i]), field)
+				continue
+			}
+			if (e.HostOnly && i > 0) || (e.Secure && u.Scheme != "https") || !pathMatch(path, e.Path) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	// Longer paths first, then older cookies first, see RFC 6265 5.4.
+	// Names make the order of cookies set together deterministic.
+	sort.Slice(entries, func(a, b int) bool {
+		if len(entries[a].Path) != len(entries[b].Path) {
+			return len(entries[a].Path) > len(entries[b].Path)
+		}
+		if !entries[a].Created.Equal(entries[b].Created) {
+			return entries[a].Created.Before(entries[b].Created)
+		}
+		return entries[a].Name < entries[b].Name
+	})
+	cookies := make([]*http.Cookie, len(entries))
+	for i, e := range entries {
+		cookies[i] = &http.Cookie{Name: e.Name, Value: e.Value}
+	}
+	return cookies, nil
+}
+
+// jarHost returns the canonical host of u
+func jarHost(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// cookieDomain returns the domain a cookie set by host is stored for and
+// whether it is a host-only cookie. It reports false if host may not set
+// cookies for domain.
+func cookieDomain(host, domain string) (string, bool, bool) {
+	domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+	if domain == "" || domain == host {
+		return host, domain == "", true
+	}
+	if net.ParseIP(host) != nil || !strings.Contains(domain, ".") {
+		return "", false, false
+	}
+	if !strings.HasSuffix(host, "."+domain) {
+		return "", false, false
+	}
+	return domain, false, true
+}
+
+// defaultPath returns the default path of cookies set for a request to
+// path, see RFC 6265 5.1.4
+func defaultPath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// pathMatch reports whether a cookie of cookiePath is sent to path, see
+// RFC 6265 5.1.4
+func pathMatch(path, cookiePath string) bool {
+	if path == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return cookiePath[len(cookiePath)-1] == '/' || path[len(cookiePath)] == '/'
+}
+
+func (s *Storage) getJarID(domain string) string {
+	return s.key("jar", domain)
+}
@@ -0,0 +1,193 @@
+package redisstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"hash/fnv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyScheme lays out the redis keys of a storage. A key is made of the
+// Prefix, a class like "request" or "cookie" and the parts of its name,
+// e.g. a request ID. Parts must be appended, so that
+// Key(prefix, class, parts..., "") + p equals Key(prefix, class, parts..., p):
+// Clear finds the keys of a class by the start of their names.
+type KeyScheme interface {
+	Key(prefix, class string, parts ...string) string
+}
+
+// KeyLayout is the default KeyScheme. It joins the prefix, class and
+// parts of a key with a separator, e.g. colly:request:1.
+type KeyLayout struct {
+	// Separator joins the segments of the keys. Default is ":".
+	Separator string
+	// ClassFirst puts the class before the prefix, e.g. request:colly:1,
+	// so tools grouping keys by their first segment group them by class.
+	ClassFirst bool
+}
+
+// Key implements KeyScheme
+func (l KeyLayout) Key(prefix, class string, parts ...string) string {
+	sep := l.separator()
+	var b strings.Builder
+	if l.ClassFirst {
+		b.WriteString(class + sep + prefix)
+	} else {
+		b.WriteString(prefix + sep + class)
+	}
+	for _, p := range parts {
+		b.WriteString(sep + p)
+	}
+	return b.String()
+}
+
+func (l KeyLayout) separator() string {
+	if l.Separator == "" {
+		return ":"
+	}
+	return l.Separator
+}
+
+// HashedKeys is a compact KeyScheme for crawls storing millions of
+// keys. The prefix and class of a key are replaced by the 11 characters
+// of their base64 encoded 64 bit FNV-1a hash, followed by the parts
+// joined with a separator, e.g. a visit key is the hash and the request
+// ID. The hash has no characters special in SCAN patterns, so scanning
+// works with any prefix. A hash tag the prefix starts with, e.g. the one
+// of HashTag, is kept in front of the hash.
+type HashedKeys struct {
+	// Separator joins the parts of the keys. Default is ":".
+	Separator string
+}
+
+// Key implements KeyScheme
+func (h HashedKeys) Key(prefix, class string, parts ...string) string {
+	f := fnv.New64a()
+	f.Write([]byte(prefix))
+	f.Write([]byte{0})
+	f.Write([]byte(class))
+	sep := h.Separator
+	if sep == "" {
+		sep = ":"
+	}
+	return hashTag(prefix) + base64.RawURLEncoding.EncodeToString(f.Sum(nil)) + strings.Join(parts, sep)
+}
+
+// hashTag returns the hash tag prefix starts with, or ""
+func hashTag(prefix string) string {
+	if !strings.HasPrefix(prefix, "{") {
+		return ""
+	}
+	if i := strings.IndexByte(prefix, '}'); i > 1 {
+		return prefix[:i+1]
+	}
+	return ""
+}
+
+// keyClasses are the classes of the keys of a storage. The keys of the
+// named queues have the class "queues" and the queue name as first part.
+// nestedClass must not be one of them.
+var keyClasses = []string{
+	"cookie", "request", "visited", "domain", "ratelimit", "jar",
+	"health", "lock", "wait", "queue", "queues", "kv", "ctl", "kill",
+	"config",
+}
+
+// key returns the key of class named by parts
+func (s *Storage) key(class string, parts ...string) string {
+	prefix := s.Prefix
+	if s.HashTag {
+		prefix = "{" + prefix + "}"
+	}
+	if s.Keys == nil {
+		return KeyLayout{}.Key(prefix, class, parts...)
+	}
+	return s.Keys.Key(prefix, class, parts...)
+}
+
+// keyPattern returns the SCAN pattern matching the keys of class whose
+// names start with parts
+func (s *Storage) keyPattern(class string, parts ...string) string {
+	return globEscape(s.key(class, append(parts, "")...)) + "*"
+}
+
+// queueKey returns the key of the queue named by parts, e.g. the
+// processing list of a consumer
+func (s *Storage) queueKey(parts ...string) string {
+	if s.queueName != "" {
+		return s.key("queues", append([]string{s.queueName}, parts...)...)
+	}
+	return s.key("queue", parts...)
+}
+
+// KeyClass returns the class of a key of the storage, like "request" or
+// "queue", or "" if the key is not one of the storage
+func (s *Storage) KeyClass(key string) string {
+	for _, c := range keyClasses {
+		if key == s.key(c) || strings.HasPrefix(key, s.key(c, "")) {
+			return c
+		}
+	}
+	return ""
+}
+
+// scanKeys calls fn with batches of the keys of the prefix on c
+func (s *Storage) scanKeys(ctx context.Context, c redis.UniversalClient, fn func(keys []string) error) error {
+	// Keys without a name, like the queue, are not matched by the
+	// patterns of most schemes.
+	var keys []string
+	for _, class := range keyClasses {
+		if key := s.key(class); !strings.HasPrefix(key, s.key(class, "")) {
+			keys = append(keys, key)
+		}
+	}
+	absent, err := absentKeys(ctx, c, keys)
+	if err != nil {
+		return err
+	}
+	present := without(keys, absent)
+	if len(present) > 0 {
+		if err := fn(present); err != nil {
+			return err
+		}
+	}
+	for _, class := range keyClasses {
+		if err := s.scanClient(ctx, c, s.keyPattern(class), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// without returns the keys which are not in absent, which is a
+// subsequence of keys
+func without(keys, absent []string) []string {
+	var rest []string
+	for _, k := range keys {
+		if len(absent) > 0 && absent[0] == k {
+			absent = absent[1:]
+			continue
+		}
+		rest = append(rest, k)
+	}
+	return rest
+}
+
+// globEscape escapes the characters of s which are special in SCAN
+// patterns
+func globEscape(s string) string {
+	if !strings.ContainsAny(s, `*?[]\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range []byte(s) {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// killSwitchTTL is how long a storage caches the state of the kill
+// switch
+const killSwitchTTL = time.Second
+
+// ErrKilled is returned by GetRequest while the kill switch is set, see
+// KillSwitch
+var ErrKilled = errors.New("redisstorage: crawl is killed")
+
+// killSwitch caches the state of the kill switch
+type killSwitch struct {
+	mu      sync.Mutex
+	killed  bool
+	checked time.Time
+}
+
+// SetKillSwitch sets or clears the kill switch of the prefix. While it
+// is set, storages with KillSwitch stop returning requests, also after
+// they restart, until it is cleared or the storage is cleared.
+func (s *Storage) SetKillSwitch(on bool) error {
+	return s.SetKillSwitchCtx(context.Background(), on)
+}
+
+// SetKillSwitchCtx is the context-aware variant of SetKillSwitch
+func (s *Storage) SetKillSwitchCtx(ctx context.Context, on bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	var err error
+	if on {
+		err = s.Client.Set(ctx, s.getKillID(), "1", 0).Err()
+	} else {
+		err = s.Client.Del(ctx, s.getKillID()).Err()
+	}
+	if err != nil {
+		return err
+	}
+	if k := s.kill; k != nil {
+		k.mu.Lock()
+		k.killed, k.checked = on, time.Now()
+		k.mu.Unlock()
+	}
+	return nil
+}
+
+// IsKilled reports whether the kill switch of the prefix is set. With
+// KillSwitch the state is cached for a second.
+func (s *Storage) IsKilled() (bool, error) {
+	return s.IsKilledCtx(context.Background())
+}
+
+// IsKilledCtx is the context-aware variant of IsKilled
+func (s *Storage) IsKilledCtx(ctx context.Context) (bool, error) {
+	if err := s.check(); err != nil {
+		return false, err
+	}
+	if s.kill == nil {
+		n, err := s.Client.Exists(ctx, s.getKillID()).Result()
+		return n > 0, err
+	}
+	return s.killed(ctx)
+}
+
+// killed returns the cached state of the kill switch, or false without
+// KillSwitch
+func (s *Storage) killed(ctx context.Context) (bool, error) {
+	k := s.kill
+	if k == nil {
+		return false, nil
+	}
+	k.mu.Lock()
+	if time.Since(k.checked) < killSwitchTTL {
+		defer k.mu.Unlock()
+		return k.killed, nil
+	}
+	k.mu.Unlock()
+	n, err := s.Client.Exists(ctx, s.getKillID()).Result()
+	if err != nil {
+		return false, err
+	}
+	k.mu.Lock()
+	k.killed, k.checked = n > 0, time.Now()
+	k.mu.Unlock()
+	return n > 0, nil
+}
+
+// waitRunning returns once requests can be taken from the queue, or the
+// error of the kill switch or the control signal stopping the crawl
+func (s *Storage) waitRunning(ctx context.Context) error {
+	killed, err := s.killed(ctx)
+	if err != nil {
+		return err
+	}
+	if killed {
+		return ErrKilled
+	}
+	return s.control.wait(ctx)
+}
+
+func (s *Storage) getKillID() string {
+	return s.key("kill")
+}
@@ -0,0 +1,104 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoValue is returned by Get if no value is stored for the key
+var ErrNoValue = errors.New("redisstorage: no value stored for the key")
+
+// Get returns the value an application stored for key with Set. The
+// keys of Get, Set, Delete and Incr are in the namespace of the storage,
+// so they do not collide with the ones of other storages or crawls, and
+// are removed by Clear.
+func (s *Storage) Get(key string) ([]byte, error) {
+	return s.GetCtx(context.Background(), key)
+}
+
+// GetCtx is the context-aware variant of Get
+func (s *Storage) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	op := &Op{Name: "Get", Key: key}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Value, err = s.Client.Get(ctx, s.getKVID(op.Key)).Bytes()
+		if err == redis.Nil {
+			return ErrNoValue
+		}
+		return err
+	})
+	return op.Value, err
+}
+
+// Set stores the value of key, e.g. a checkpoint of the crawl. The value
+// expires after ttl, or never if ttl is 0.
+func (s *Storage) Set(key string, value []byte, ttl time.Duration) error {
+	return s.SetCtx(context.Background(), key, value, ttl)
+}
+
+// SetCtx is the context-aware variant of Set
+func (s *Storage) SetCtx(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return ErrNegativeExpiration
+	}
+	return s.intercept(ctx, &Op{Name: "Set", Key: key, Value: value, TTL: ttl}, func(ctx context.Context, op *Op) error {
+		return s.Client.Set(ctx, s.getKVID(op.Key), op.Value, op.TTL).Err()
+	})
+}
+
+// Delete removes the values of keys and returns the number of values
+// removed
+func (s *Storage) Delete(keys ...string) (int, error) {
+	return s.DeleteCtx(context.Background(), keys...)
+}
+
+// DeleteCtx is the context-aware variant of Delete
+func (s *Storage) DeleteCtx(ctx context.Context, keys ...string) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	op := &Op{Name: "Delete", Keys: keys}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		ids := make([]string, len(op.Keys))
+		for i, k := range op.Keys {
+			ids[i] = s.getKVID(k)
+		}
+		var err error
+		op.Size, err = s.del(ctx, ids)
+		return err
+	})
+	return op.Size, err
+}
+
+// Incr adds n to the counter stored for key, which starts at 0, and
+// returns the new value
+func (s *Storage) Incr(key string, n int64) (int64, error) {
+	return s.IncrCtx(context.Background(), key, n)
+}
+
+// IncrCtx is the context-aware variant of Incr
+func (s *Storage) IncrCtx(ctx context.Context, key string, n int64) (int64, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	op := &Op{Name: "Incr", Key: key, Counter: n}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Counter, err = s.Client.IncrBy(ctx, s.getKVID(op.Key), op.Counter).Result()
+		return err
+	})
+	return op.Counter, err
+}
+
+func (s *Storage) getKVID(key string) string {
+	return s.key("kv", key)
+}
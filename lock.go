@@ -0,0 +1,176 @@
+package redisstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	// cookieLockTTL is the time after which the cookie lock of a
+	// crashed holder is released
+	cookieLockTTL = 5 * time.Second
+	// lockPoll is the interval in which a waiting lock retries
+	lockPoll = 10 * time.Millisecond
+)
+
+// unlockScript releases a lock only if it is still held with the token
+// of the caller.
+// KEYS: lock
+// ARGV: token
+var unlockScript = newScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// extendScript renews the expiration of a lock only if it is still held
+// with the token of the caller.
+// KEYS: lock
+// ARGV: token, ttl in milliseconds
+var extendScript = newScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// ErrLockNotHeld is returned by Unlock and Extend if the lock expired
+// and may be held by another caller
+var ErrLockNotHeld = errors.New("redisstorage: lock is not held")
+
+// ErrLockTTL is returned by Lock and Extend for a ttl shorter than a
+// millisecond, the resolution of the expiration of a lock
+var ErrLockTTL = errors.New("redisstorage: lock ttl must be at least a millisecond")
+
+// lock acquires the lock key shared by all storages, waiting until it is
+// free or ctx is done. The lock is released by the returned function or
+// after ttl.
+func (s *Storage) lock(ctx context.Context, key string, ttl time.Duration) (func(), error) {
+	token, err := s.acquire(ctx, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// Release the lock even if ctx is done by now.
+		err := s.runScript(context.Background(), s.Client, unlockScript, []string{key}, token).Err()
+		if err != nil {
+			s.errs.record(err)
+			s.logf("unlock %s error %s", key, err)
+		}
+	}, nil
+}
+
+// acquire sets key to a random token once it is free, waiting until ctx
+// is done, and returns the token
+func (s *Storage) acquire(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	for {
+		ok, err := s.Client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return token, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// Lock is a lock held by one of the storages sharing a prefix, see
+// Storage.Lock
+type Lock struct {
+	s     *Storage
+	key   string
+	token string
+}
+
+// Lock acquires the named lock, waiting until no other storage of the
+// prefix holds it, so a fleet of crawlers can run exclusive tasks like
+// refreshing a sitemap. The lock expires after ttl if it is not
+// released with Unlock, e.g. when its holder crashes; a task running
+// longer must Extend it. The lock lives on one server, so it is only as
+// safe as that server: it can be lost in a failover.
+func (s *Storage) Lock(name string, ttl time.Duration) (*Lock, error) {
+	return s.LockCtx(context.Background(), name, ttl)
+}
+
+// LockCtx is the context-aware variant of Lock. It waits until ctx is
+// done.
+func (s *Storage) LockCtx(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if ttl < time.Millisecond {
+		return nil, ErrLockTTL
+	}
+	op := &Op{Name: "Lock", Key: name, TTL: ttl}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		key := s.getLockID(op.Key)
+		token, err := s.acquire(ctx, key, op.TTL)
+		if err != nil {
+			return err
+		}
+		op.Lock = &Lock{s: s, key: key, token: token}
+		return nil
+	})
+	return op.Lock, err
+}
+
+// Unlock releases the lock. It returns an error if the lock expired
+// before.
+func (l *Lock) Unlock() error {
+	return l.UnlockCtx(context.Background())
+}
+
+// UnlockCtx is the context-aware variant of Unlock
+func (l *Lock) UnlockCtx(ctx context.Context) error {
+	n, err := l.s.runScript(ctx, l.s.Client, unlockScript, []string{l.key}, l.token).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Extend renews the lock to expire after ttl. It returns an error if
+// the lock expired before.
+func (l *Lock) Extend(ttl time.Duration) error {
+	return l.ExtendCtx(context.Background(), ttl)
+}
+
+// ExtendCtx is the context-aware variant of Extend
+func (l *Lock) ExtendCtx(ctx context.Context, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return ErrLockTTL
+	}
+	n, err := l.s.runScript(ctx, l.s.Client, extendScript, []string{l.key}, l.token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+func (s *Storage) getCookieLockID(host string) string {
+	return s.key("lock", "cookie", host)
+}
+
+func (s *Storage) getLockID(name string) string {
+	return s.key("lock", "task", name)
+}
@@ -0,0 +1,134 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// setInfoScript sets fields of visit metadata. New metadata expires
+// like the visit.
+// KEYS: metadata
+// ARGV: ttl in milliseconds or 0, field, value, ...
+var setInfoScript = newScript(`
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+if tonumber(ARGV[1]) > 0 and redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// ErrNoMetadata is returned by the VisitInfo methods if RecordMetadata
+// is not set
+var ErrNoMetadata = errors.New("redisstorage: RecordMetadata is not enabled")
+
+// visitTimeScript records the time of a visit and forgets the ones
+// older than the retention.
+// KEYS: visit times
+// ARGV: now, retention in milliseconds, member
+var visitTimeScript = newScript(`
+local now = tonumber(ARGV[1])
+redis.call("ZADD", KEYS[1], now, ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - tonumber(ARGV[2]))
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// VisitInfo is the metadata of a visit recorded with RecordMetadata
+type VisitInfo struct {
+	// Time is the time of the last Visited call
+	Time time.Time
+	// Status is the HTTP status code set by SetVisitInfo
+	Status int
+	// Size is the content length set by SetVisitInfo
+	Size int64
+}
+
+// SetVisitInfo records the HTTP status and content length of a visited
+// request, e.g. in an OnResponse callback. It requires RecordMetadata.
+func (s *Storage) SetVisitInfo(requestID uint64, status int, size int64) error {
+	return s.SetVisitInfoCtx(context.Background(), requestID, status, size)
+}
+
+// SetVisitInfoCtx is the context-aware variant of SetVisitInfo
+func (s *Storage) SetVisitInfoCtx(ctx context.Context, requestID uint64, status int, size int64) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if !s.RecordMetadata {
+		return ErrNoMetadata
+	}
+	keys := []string{s.getVisitInfoID(requestID)}
+	return s.runScript(ctx, s.Client, setInfoScript, keys, s.visitedTTL().Milliseconds(), "status", status, "size", size).Err()
+}
+
+// GetVisitInfo returns the metadata of a visit, or nil if none was
+// recorded. It requires RecordMetadata.
+func (s *Storage) GetVisitInfo(requestID uint64) (*VisitInfo, error) {
+	return s.GetVisitInfoCtx(context.Background(), requestID)
+}
+
+// GetVisitInfoCtx is the context-aware variant of GetVisitInfo
+func (s *Storage) GetVisitInfoCtx(ctx context.Context, requestID uint64) (*VisitInfo, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if !s.RecordMetadata {
+		return nil, ErrNoMetadata
+	}
+	m, err := s.Client.HGetAll(ctx, s.getVisitInfoID(requestID)).Result()
+	if err != nil || len(m) == 0 {
+		return nil, err
+	}
+	info := &VisitInfo{}
+	if ms, err := strconv.ParseInt(m["t"], 10, 64); err == nil {
+		info.Time = time.UnixMilli(ms)
+	}
+	info.Status, _ = strconv.Atoi(m["status"])
+	info.Size, _ = strconv.ParseInt(m["size"], 10, 64)
+	return info, nil
+}
+
+// VisitsInWindow returns how often Visited was called for a request
+// within the last window. It requires VisitWindow, and counts no visits
+// older than it.
+func (s *Storage) VisitsInWindow(requestID uint64, window time.Duration) (int, error) {
+	return s.VisitsInWindowCtx(context.Background(), requestID, window)
+}
+
+// VisitsInWindowCtx is the context-aware variant of VisitsInWindow
+func (s *Storage) VisitsInWindowCtx(ctx context.Context, requestID uint64, window time.Duration) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	if s.VisitWindow <= 0 {
+		return 0, errors.New("redisstorage: VisitWindow is not set")
+	}
+	since := strconv.FormatInt(time.Now().Add(-window).UnixMilli(), 10)
+	n, err := s.Client.ZCount(ctx, s.getVisitTimesID(requestID), since, "+inf").Result()
+	return int(n), err
+}
+
+// visitTime queues recording the time of a visit for VisitsInWindow
+func (s *Storage) visitTime(ctx context.Context, pipe redis.Pipeliner, requestID uint64) {
+	now := time.Now().UnixMilli()
+	keys := []string{s.getVisitTimesID(requestID)}
+	s.evalScript(ctx, pipe, visitTimeScript, keys, now, s.VisitWindow.Milliseconds(), timeMember(now))
+}
+
+// visitInfo queues recording the time of a visit
+func (s *Storage) visitInfo(ctx context.Context, pipe redis.Pipeliner, requestID uint64, ttl time.Duration) {
+	keys := []string{s.getVisitInfoID(requestID)}
+	s.evalScript(ctx, pipe, setInfoScript, keys, ttl.Milliseconds(), "t", time.Now().UnixMilli())
+}
+
+func (s *Storage) getVisitTimesID(requestID uint64) string {
+	return s.key("visited", "times", strconv.FormatUint(requestID, 10))
+}
+
+func (s *Storage) getVisitInfoID(requestID uint64) string {
+	return s.key("visited", "info", strconv.FormatUint(requestID, 10))
+}
@@ -0,0 +1,231 @@
+package redisstorage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the buckets of
+// Metrics.Latency
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Metrics is a snapshot of the operations counted by a storage with
+// CollectMetrics set. The counters only increase; they are shared by
+// the storages returned by Queue.
+type Metrics struct {
+	// VisitedMarks is the number of visits stored by Visited
+	VisitedMarks uint64
+	// VisitedHits and VisitedMisses are the numbers of IsVisited
+	// answers for visited and new requests
+	VisitedHits   uint64
+	VisitedMisses uint64
+	// QueueAdds is the number of requests added to the queue
+	QueueAdds uint64
+	// QueuePops is the number of requests taken from the queue
+	QueuePops uint64
+	// Errors is the number of failed redis commands
+	Errors uint64
+	// Latency is the distribution of redis round trips
+	Latency Histogram
+}
+
+// Histogram is a distribution of durations
+type Histogram struct {
+	// Buckets are the upper bounds in seconds, see LatencyBuckets
+	Buckets []float64
+	// Counts are the cumulative numbers of observations per bucket
+	Counts []uint64
+	// Count is the number of observations
+	Count uint64
+	// Sum is the sum of the observations in seconds
+	Sum float64
+}
+
+// MetricsSink receives the metrics of a storage as they occur, e.g. to
+// forward them to statsd; see the sink package for implementations. It
+// must be safe for concurrent use. The counters are
+//
+//	visited.marks   visits stored by Visited
+//	visited.hits    IsVisited answers for visited requests
+//	visited.misses  IsVisited answers for new requests
+//	queue.adds      requests added to the queue
+//	queue.pops      requests taken from the queue
+//	errors          failed redis commands
+//
+// and the timer redis.latency measures redis round trips.
+type MetricsSink interface {
+	// Count adds n to the counter name
+	Count(name string, n int64)
+	// Timing records a duration of the timer name
+	Timing(name string, d time.Duration)
+}
+
+// metrics holds the counters of CollectMetrics and forwards them to the
+// MetricsSink. Its methods do nothing on a nil receiver, so callers need
+// not check whether metrics are enabled.
+type metrics struct {
+	sink MetricsSink
+
+	visitedMarks  atomic.Uint64
+	visitedHits   atomic.Uint64
+	visitedMisses atomic.Uint64
+	queueAdds     atomic.Uint64
+	queuePops     atomic.Uint64
+	errors        atomic.Uint64
+
+	latency      []atomic.Uint64 // Not cumulative, indexed like LatencyBuckets.
+	latencyNs    atomic.Uint64
+	observations atomic.Uint64
+}
+
+func newMetrics(sink MetricsSink) *metrics {
+	return &metrics{sink: sink, latency: make([]atomic.Uint64, len(LatencyBuckets))}
+}
+
+// Metrics returns the counters of the storage. It returns zero counters
+// unless CollectMetrics is set.
+func (s *Storage) Metrics() Metrics {
+	m := s.metrics
+	if m == nil {
+		return Metrics{}
+	}
+	h := Histogram{
+		Buckets: LatencyBuckets,
+		Counts:  make([]uint64, len(LatencyBuckets)),
+		Count:   m.observations.Load(),
+		Sum:     time.Duration(m.latencyNs.Load()).Seconds(),
+	}
+	var n uint64
+	for i := range m.latency {
+		n += m.latency[i].Load()
+		h.Counts[i] = n
+	}
+	return Metrics{
+		VisitedMarks:  m.visitedMarks.Load(),
+		VisitedHits:   m.visitedHits.Load(),
+		VisitedMisses: m.visitedMisses.Load(),
+		QueueAdds:     m.queueAdds.Load(),
+		QueuePops:     m.queuePops.Load(),
+		Errors:        m.errors.Load(),
+		Latency:       h,
+	}
+}
+
+func (m *metrics) markVisited() {
+	if m != nil {
+		m.count(&m.visitedMarks, "visited.marks", 1)
+	}
+}
+
+// lookups counts the answers of IsVisited
+func (m *metrics) lookups(hits, misses int) {
+	if m != nil {
+		m.count(&m.visitedHits, "visited.hits", hits)
+		m.count(&m.visitedMisses, "visited.misses", misses)
+	}
+}
+
+func (m *metrics) added(n int) {
+	if m != nil {
+		m.count(&m.queueAdds, "queue.adds", n)
+	}
+}
+
+func (m *metrics) popped(n int) {
+	if m != nil {
+		m.count(&m.queuePops, "queue.pops", n)
+	}
+}
+
+// count adds n to c and the counter name of the sink
+func (m *metrics) count(c *atomic.Uint64, name string, n int) {
+	if n == 0 {
+		return
+	}
+	c.Add(uint64(n))
+	if m.sink != nil {
+		m.sink.Count(name, int64(n))
+	}
+}
+
+// observe records a round trip of d in which failed commands failed
+func (m *metrics) observe(d time.Duration, failed int) {
+	if m == nil {
+		return
+	}
+	m.count(&m.errors, "errors", failed)
+	if m.sink != nil {
+		m.sink.Timing("redis.latency", d)
+	}
+	m.observations.Add(1)
+	m.latencyNs.Add(uint64(d))
+	for i, b := range LatencyBuckets {
+		if d.Seconds() <= b {
+			m.latency[i].Add(1)
+			return
+		}
+	}
+}
+
+// observeFailed records failed commands of a round trip whose latency is
+// not observed
+func (m *metrics) observeFailed(failed int) {
+	if m == nil {
+		return
+	}
+	m.count(&m.errors, "errors", failed)
+}
+
+// metricsHook measures the commands of the client. The time blocking
+// commands wait for data is not latency and not observed.
+type metricsHook struct {
+	m    *metrics
+	errs *errorLog
+}
+
+func (h metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		if isBlocking(cmd) {
+			h.m.observeFailed(h.failed(cmd))
+		} else {
+			h.m.observe(time.Since(start), h.failed(cmd))
+		}
+		return err
+	}
+}
+
+func (h metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		n := 0
+		for _, cmd := range cmds {
+			n += h.failed(cmd)
+		}
+		if anyBlocking(cmds) {
+			h.m.observeFailed(n)
+		} else {
+			h.m.observe(time.Since(start), n)
+		}
+		return err
+	}
+}
+
+// failed returns 1 and records the error if cmd failed. A missing key
+// is not a failure.
+func (h metricsHook) failed(cmd redis.Cmder) int {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		h.errs.record(err)
+		return 1
+	}
+	return 0
+}
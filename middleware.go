@@ -0,0 +1,92 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Op is an operation of the storage passed through its Middleware. The
+// fields not used by the operation are zero.
+type Op struct {
+	// Name is the name of the method, e.g. "Visited" or "AddRequest".
+	// The variants of a method, like VisitedCtx, have its name.
+	Name string
+	// RequestID is the request of Visited, VisitedWithTTL, IsVisited and
+	// AddRequestIfNew
+	RequestID uint64
+	// TTL is the expiration of VisitedWithTTL, Set and Lock, the delay
+	// of AddRequestAfter and the timeout of GetRequestBlocking
+	TTL time.Duration
+	// URL is the URL of SetCookies and Cookies
+	URL *url.URL
+	// Cookies are the cookies passed to SetCookies, or the ones returned
+	// by Cookies once the operation ran
+	Cookies string
+	// Request is the request passed to the methods adding, acknowledging
+	// or dead-lettering a single request, or the one returned by
+	// GetRequest and GetRequestBlocking once the operation ran
+	Request []byte
+	// Requests are the requests passed to AddRequests, or the ones
+	// returned by GetRequests, PeekRequests and ListDLQ once the
+	// operation ran
+	Requests [][]byte
+	// Score is the score of AddRequestWithPriority
+	Score float64
+	// Count is the maximum number of requests of GetRequests,
+	// PeekRequests, ListDLQ and RequeueFromDLQ
+	Count int
+	// Key is the key of Get, Set and Incr, or the name of Lock
+	Key string
+	// Keys are the keys of Delete
+	Keys []string
+	// Value is the value passed to Set, or the one returned by Get once
+	// the operation ran
+	Value []byte
+	// Counter is the n passed to Incr, or the new value of the counter
+	// once the operation ran
+	Counter int64
+	// Lock is the lock acquired by Lock
+	Lock *Lock
+	// Visited is the result of IsVisited, Added the one of
+	// AddRequestIfNew, and Size the one of QueueSize, DLQSize, Delete
+	// and RequeueFromDLQ
+	Visited bool
+	Added   bool
+	Size    int
+}
+
+// OpFunc runs an operation of the storage
+type OpFunc func(ctx context.Context, op *Op) error
+
+// Middleware wraps the operations of the storage, see Storage.Middleware.
+// It can change the fields of op before calling next, and the results
+// after, or return an error without calling next.
+type Middleware func(next OpFunc) OpFunc
+
+// intercept runs fn, which reads its arguments from op and stores its
+// results in op, through the Middleware and calls the callbacks of the
+// operation. OnEnqueue and OnDequeue are called by onAdded and onPopped
+// instead, as only they know which requests were queued.
+func (s *Storage) intercept(ctx context.Context, op *Op, fn OpFunc) error {
+	// The callbacks get the arguments of the caller, not the ones
+	// changed by the middleware.
+	in := *op
+	for i := len(s.Middleware) - 1; i >= 0; i-- {
+		fn = s.Middleware[i](fn)
+	}
+	err := fn(ctx, op)
+	switch {
+	case errors.Is(err, ErrQueueEmpty), errors.Is(err, ErrNoValue):
+	case err != nil:
+		if s.OnError != nil {
+			s.OnError(op.Name, err)
+		}
+	case op.Name == "Visited" || op.Name == "VisitedWithTTL":
+		if s.OnVisited != nil {
+			s.OnVisited(in.RequestID)
+		}
+	}
+	return err
+}
@@ -0,0 +1,393 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultMirrorQueueSize is the default of MirrorQueueSize
+	defaultMirrorQueueSize = 10000
+	// mirrorBatch is the maximum number of writes sent to the mirror
+	// in one pipeline
+	mirrorBatch = 100
+)
+
+// readCommands are the commands of the storage which are not mirrored
+var readCommands = map[string]bool{
+	"get": true, "mget": true, "exists": true, "pttl": true, "ttl": true,
+	"type": true, "scan": true, "smembers": true, "sismember": true,
+	"scard": true, "srandmember": true, "llen": true, "lrange": true,
+	"lindex": true, "zcard": true, "zcount": true, "zrange": true,
+	"zrangebyscore": true, "zscore": true, "hget": true, "hmget": true,
+	"hgetall": true, "hlen": true, "xlen": true, "xrange": true,
+	"xpending": true, "xinfo": true, "pfcount": true, "bf.exists": true,
+	"bf.mexists": true, "bf.card": true, "bf.info": true, "ping": true,
+	"hello": true, "client": true, "cluster": true, "command": true,
+	"info": true, "script": true, "eval_ro": true, "evalsha_ro": true,
+	"multi": true, "exec": true, "auth": true, "select": true,
+	"wait": true,
+}
+
+// mirror replays the writes of a storage on a second server
+type mirror struct {
+	c       redis.UniversalClient
+	writes  chan []interface{}
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	pending atomic.Int64 // Writes queued or being sent.
+	s       *Storage
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc // Aborts the writes being sent.
+
+	mu     sync.RWMutex // Protects closed and sending on writes.
+	closed bool
+}
+
+func newMirror(s *Storage) *mirror {
+	size := s.MirrorQueueSize
+	if size <= 0 {
+		size = defaultMirrorQueueSize
+	}
+	m := &mirror{c: s.Mirror, writes: make(chan []interface{}, size), s: s}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// add queues the write cmd if it succeeded. Writes are dropped if the
+// mirror falls too far behind.
+func (m *mirror) add(cmd redis.Cmder) {
+	if err := cmd.Err(); err != nil && !(err == redis.Nil && isScriptCommand(cmd.Name())) {
+		return
+	}
+	if readCommands[cmd.Name()] {
+		return
+	}
+	args := mirrorArgs(cmd)
+	if args == nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	m.pending.Add(1)
+	select {
+	case m.writes <- args:
+	default:
+		m.pending.Add(-1)
+		m.dropped.Add(1)
+	}
+}
+
+// isScriptCommand reports whether the command named name runs a script,
+// which fails with redis.Nil after writing if the script returns nil
+func isScriptCommand(name string) bool {
+	switch name {
+	case "eval", "evalsha", "fcall":
+		return true
+	}
+	return false
+}
+
+// mirrorArgs returns the command replaying the effect of cmd, or nil if
+// it had none. Random and blocking pops and generated stream IDs are
+// replaced by their results, so the mirror removes and adds the same
+// entries without waiting for them.
+func mirrorArgs(cmd redis.Cmder) []interface{} {
+	args := cmd.Args()
+	switch cmd.Name() {
+	case "blpop", "brpop":
+		c, ok := cmd.(*redis.StringSliceCmd)
+		if !ok || len(c.Val()) != 2 {
+			return nil
+		}
+		count := 1
+		if cmd.Name() == "brpop" {
+			count = -1
+		}
+		return []interface{}{"lrem", c.Val()[0], count, c.Val()[1]}
+	case "bzpopmin", "bzpopmax":
+		c, ok := cmd.(*redis.ZWithKeyCmd)
+		if !ok || c.Val() == nil {
+			return nil
+		}
+		return []interface{}{"zrem", c.Val().Key, c.Val().Member}
+	case "blmove":
+		// blmove source destination wherefrom whereto timeout
+		if len(args) != 6 {
+			return nil
+		}
+		return append([]interface{}{"lmove"}, args[1:5]...)
+	case "xreadgroup":
+		replayed := make([]interface{}, 0, len(args))
+		for i := 0; i < len(args); i++ {
+			if a, ok := args[i].(string); ok && a == "block" {
+				i++
+				continue
+			}
+			replayed = append(replayed, args[i])
+		}
+		return replayed
+	case "spop":
+		var members []string
+		if cmd.Err() != nil {
+			return nil
+		}
+		switch c := cmd.(type) {
+		case *redis.StringCmd:
+			members = []string{c.Val()}
+		case *redis.StringSliceCmd:
+			members = c.Val()
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		srem := []interface{}{"srem", args[1]}
+		for _, m := range members {
+			srem = append(srem, m)
+		}
+		return srem
+	case "xadd":
+		c, ok := cmd.(*redis.StringCmd)
+		if !ok {
+			return args
+		}
+		replayed := append([]interface{}(nil), args...)
+		for i, a := range replayed {
+			if a == "*" {
+				replayed[i] = c.Val()
+				break
+			}
+		}
+		return replayed
+	}
+	return args
+}
+
+func (m *mirror) run() {
+	defer m.wg.Done()
+	for args := range m.writes {
+		batch := [][]interface{}{args}
+	drain:
+		for len(batch) < mirrorBatch {
+			select {
+			case args, ok := <-m.writes:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, args)
+			default:
+				break drain
+			}
+		}
+		m.send(m.ctx, batch)
+		m.pending.Add(-int64(len(batch)))
+	}
+}
+
+// flush waits until the queued writes are sent or ctx is done
+func (m *mirror) flush(ctx context.Context) {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for m.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// send writes batch to the mirror. Scripts unknown to the mirror are
+// sent with their source.
+func (m *mirror) send(ctx context.Context, batch [][]interface{}) {
+	cmds, _ := m.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, args := range batch {
+			pipe.Do(ctx, args...)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		err := cmd.Err()
+		if err == nil || err == redis.Nil {
+			continue
+		}
+		args := batch[i]
+		if src := mirrorScript(args, err); src != "" {
+			eval := append([]interface{}{"eval", src}, args[2:]...)
+			if err = m.c.Do(ctx, eval...).Err(); err == nil || err == redis.Nil {
+				continue
+			}
+		}
+		m.failed.Add(1)
+		m.s.errs.record(err)
+	}
+}
+
+// mirrorScript returns the source of the script of the EVALSHA or FCALL
+// args which failed with err because the mirror does not know it
+func mirrorScript(args []interface{}, err error) string {
+	if len(args) < 2 {
+		return ""
+	}
+	name, _ := args[1].(string)
+	switch args[0] {
+	case "evalsha":
+		if isNoScript(err) {
+			return scripts[name]
+		}
+	case "fcall":
+		if isNoFunction(err) {
+			return functionScript(name)
+		}
+	}
+	return ""
+}
+
+// close sends the queued writes and stops the mirror. Writes not sent
+// when ctx is done are counted as failed.
+func (m *mirror) close(ctx context.Context) {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.writes)
+	}
+	m.mu.Unlock()
+	m.flush(ctx)
+	m.cancel()
+	m.wg.Wait()
+}
+
+// mirrorHook passes the commands of the client to the mirror
+type mirrorHook struct {
+	m *mirror
+}
+
+func (h mirrorHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h mirrorHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		h.m.add(cmd)
+		return err
+	}
+}
+
+func (h mirrorHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			h.m.add(cmd)
+		}
+		return err
+	}
+}
+
+// MirrorReport compares the keys of the storage with the ones of the
+// mirror, see MirrorConsistency
+type MirrorReport struct {
+	// Keys and MirrorKeys are the numbers of keys of the storage
+	Keys       int
+	MirrorKeys int
+	// Missing and Extra are up to 100 keys only stored by the storage
+	// or the mirror, and MissingCount and ExtraCount their numbers
+	Missing      []string
+	MissingCount int
+	Extra        []string
+	ExtraCount   int
+	// Dropped is the number of writes dropped because the mirror fell
+	// more than MirrorQueueSize writes behind, Failed the number of
+	// writes the mirror rejected
+	Dropped uint64
+	Failed  uint64
+}
+
+// ErrMirrorDisabled is returned by MirrorConsistency without Mirror
+var ErrMirrorDisabled = errors.New("redisstorage: Mirror is not set")
+
+// mirrorReportKeys is the maximum number of keys listed by MirrorReport
+const mirrorReportKeys = 100
+
+// MirrorConsistency compares which keys of the storage exist on the
+// storage and the Mirror. Keys can differ briefly while writes are on
+// their way to the mirror. It scans both servers, which takes a while
+// for large crawls.
+func (s *Storage) MirrorConsistency() (MirrorReport, error) {
+	return s.MirrorConsistencyCtx(context.Background())
+}
+
+// MirrorConsistencyCtx is the context-aware variant of MirrorConsistency
+func (s *Storage) MirrorConsistencyCtx(ctx context.Context) (MirrorReport, error) {
+	var r MirrorReport
+	if err := s.check(); err != nil {
+		return r, err
+	}
+	if s.mirror == nil {
+		return r, ErrMirrorDisabled
+	}
+	r.Dropped, r.Failed = s.mirror.dropped.Load(), s.mirror.failed.Load()
+	// Writes still on their way would show up as missing.
+	s.mirror.flush(ctx)
+	// The callbacks are called serially, also on a cluster or ring.
+	err := s.scanKeys(ctx, s.Client, func(keys []string) error {
+		r.Keys += len(keys)
+		missing, err := absentKeys(ctx, s.Mirror, keys)
+		r.MissingCount += len(missing)
+		r.Missing = appendKeys(r.Missing, missing)
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+	err = s.scanKeys(ctx, s.Mirror, func(keys []string) error {
+		r.MirrorKeys += len(keys)
+		extra, err := absentKeys(ctx, s.Client, keys)
+		r.ExtraCount += len(extra)
+		r.Extra = appendKeys(r.Extra, extra)
+		return err
+	})
+	return r, err
+}
+
+// absentKeys returns the keys which do not exist on c
+func absentKeys(ctx context.Context, c redis.UniversalClient, keys []string) ([]string, error) {
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.Exists(ctx, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var absent []string
+	for i, cmd := range cmds {
+		if cmd.Val() == 0 {
+			absent = append(absent, keys[i])
+		}
+	}
+	return absent, nil
+}
+
+func appendKeys(list, keys []string) []string {
+	for _, k := range keys {
+		if len(list) >= mirrorReportKeys {
+			break
+		}
+		list = append(list, k)
+	}
+	return list
+}
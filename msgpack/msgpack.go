@@ -0,0 +1,20 @@
+// Package msgpack implements redisstorage.Codec with MessagePack, a
+// binary format more compact than JSON.
+package msgpack
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// Codec encodes the values of redisstorage.Storage.Enqueue with
+// MessagePack. Struct fields are named by their msgpack tags, or their
+// names.
+type Codec struct{}
+
+// Encode implements redisstorage.Codec
+func (Codec) Encode(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Decode implements redisstorage.Codec
+func (Codec) Decode(p []byte, v interface{}) error {
+	return msgpack.Unmarshal(p, v)
+}
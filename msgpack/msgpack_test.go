@@ -0,0 +1,33 @@
+package msgpack
+
+import (
+	"testing"
+
+	"github.com/gocolly/redisstorage"
+)
+
+type envelope struct {
+	URL   string `msgpack:"u"`
+	Depth int    `msgpack:"d"`
+}
+
+func TestCodec(t *testing.T) {
+	s := &redisstorage.Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "msgpack_test",
+		Codec:   Codec{},
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	if err := s.Enqueue(envelope{"http://example.com", 2}); err != nil {
+		t.Error("failed to enqueue value: " + err.Error())
+	}
+	var e envelope
+	if err := s.Dequeue(&e); err != nil || e.URL != "http://example.com" || e.Depth != 2 {
+		t.Error("invalid value", e, err)
+	}
+}
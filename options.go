@@ -0,0 +1,95 @@
+package redisstorage
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Option configures a Storage created by NewStorage
+type Option func(*Storage)
+
+// WithPassword sets the password for the redis server
+func WithPassword(password string) Option {
+	return func(s *Storage) {
+		s.Password = password
+	}
+}
+
+// WithDB sets the redis database
+func WithDB(db int) Option {
+	return func(s *Storage) {
+		s.DB = db
+	}
+}
+
+// WithPrefix sets the prefix of the keys
+func WithPrefix(prefix string) Option {
+	return func(s *Storage) {
+		s.Prefix = prefix
+	}
+}
+
+// WithExpiration sets the expiration time of visited keys
+func WithExpiration(d time.Duration) Option {
+	return func(s *Storage) {
+		s.Expires = d
+	}
+}
+
+// WithClient makes the storage use an existing redis client.
+// The address passed to NewStorage is ignored in this case.
+func WithClient(c redis.UniversalClient) Option {
+	return func(s *Storage) {
+		s.Client = c
+	}
+}
+
+// WithTLS enables TLS encrypted connections
+func WithTLS(c *tls.Config) Option {
+	return func(s *Storage) {
+		s.TLSConfig = c
+	}
+}
+
+// WithLogger sets the logger used to report errors which can not
+// be returned
+func WithLogger(l *log.Logger) Option {
+	return func(s *Storage) {
+		s.Logger = l
+	}
+}
+
+// NewStorage creates a Storage connected to the redis server at addr.
+// The configuration is validated and the connection is checked, so the
+// returned Storage is ready to use without calling Init.
+func NewStorage(addr string, opts ...Option) (*Storage, error) {
+	s := &Storage{Address: addr}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Storage) validate() error {
+	if s.Client == nil && s.Address == "" && s.URL == "" &&
+		len(s.ClusterAddrs) == 0 && s.SentinelMasterName == "" {
+		return errors.New("redisstorage: no redis address configured")
+	}
+	if s.SentinelMasterName != "" && len(s.SentinelAddrs) == 0 {
+		return errors.New("redisstorage: no sentinel address configured")
+	}
+	if s.Expires < 0 || s.VisitedTTL < 0 || s.CookieTTL < 0 || s.QueueItemTTL < 0 {
+		return ErrNegativeExpiration
+	}
+	return nil
+}
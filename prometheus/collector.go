@@ -0,0 +1,85 @@
+// Package prometheus exports the metrics of a redisstorage.Storage as a
+// prometheus.Collector.
+package prometheus
+
+import (
+	"github.com/gocolly/redisstorage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects the Metrics of a storage with CollectMetrics set
+type Collector struct {
+	s *redisstorage.Storage
+
+	visitedMarks *prometheus.Desc
+	lookups      *prometheus.Desc
+	queueAdds    *prometheus.Desc
+	queuePops    *prometheus.Desc
+	errors       *prometheus.Desc
+	latency      *prometheus.Desc
+	poolConns    *prometheus.Desc
+	poolEvents   *prometheus.Desc
+}
+
+// NewCollector returns a collector of the metrics of s. The metric
+// names start with namespace, e.g. "colly", and are labeled with the
+// prefix of s, so the storages of several crawlers can be registered.
+func NewCollector(s *redisstorage.Storage, namespace string) *Collector {
+	labels := prometheus.Labels{"prefix": s.Prefix}
+	desc := func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "redisstorage", name), help, variable, labels)
+	}
+	return &Collector{
+		s:            s,
+		visitedMarks: desc("visited_marks_total", "Number of visits stored."),
+		lookups:      desc("visited_lookups_total", "Number of IsVisited answers by result.", "result"),
+		queueAdds:    desc("queue_adds_total", "Number of requests added to the queue."),
+		queuePops:    desc("queue_pops_total", "Number of requests taken from the queue."),
+		errors:       desc("errors_total", "Number of failed redis commands."),
+		latency:      desc("redis_latency_seconds", "Latency of redis round trips."),
+		poolConns:    desc("pool_connections", "Number of connections in the pool by state.", "state"),
+		poolEvents:   desc("pool_events_total", "Number of connection pool events by kind.", "event"),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.visitedMarks
+	ch <- c.lookups
+	ch <- c.queueAdds
+	ch <- c.queuePops
+	ch <- c.errors
+	ch <- c.latency
+	ch <- c.poolConns
+	ch <- c.poolEvents
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.s.Metrics()
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	counter(c.visitedMarks, m.VisitedMarks)
+	counter(c.lookups, m.VisitedHits, "hit")
+	counter(c.lookups, m.VisitedMisses, "miss")
+	counter(c.queueAdds, m.QueueAdds)
+	counter(c.queuePops, m.QueuePops)
+	counter(c.errors, m.Errors)
+	buckets := make(map[float64]uint64, len(m.Latency.Buckets))
+	for i, b := range m.Latency.Buckets {
+		buckets[b] = m.Latency.Counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(c.latency, m.Latency.Count, m.Latency.Sum, buckets)
+	if p := c.s.PoolStats(); p != nil {
+		gauge := func(v uint32, state string) {
+			ch <- prometheus.MustNewConstMetric(c.poolConns, prometheus.GaugeValue, float64(v), state)
+		}
+		gauge(p.TotalConns, "total")
+		gauge(p.IdleConns, "idle")
+		counter(c.poolEvents, uint64(p.Hits), "hit")
+		counter(c.poolEvents, uint64(p.Misses), "miss")
+		counter(c.poolEvents, uint64(p.Timeouts), "timeout")
+		counter(c.poolEvents, uint64(p.StaleConns), "stale")
+	}
+}
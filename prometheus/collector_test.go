@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/gocolly/redisstorage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	s := &redisstorage.Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "collector_test",
+		CollectMetrics: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.Visited(1)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(NewCollector(s, "colly")); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if m.GetCounter() != nil {
+				values[f.GetName()] += m.GetCounter().GetValue()
+			}
+			if m.GetHistogram() != nil {
+				values[f.GetName()] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	if values["colly_redisstorage_visited_marks_total"] != 1 {
+		t.Errorf("invalid visited marks %v", values)
+	}
+	if values["colly_redisstorage_redis_latency_seconds"] == 0 {
+		t.Errorf("no latency observed %v", values)
+	}
+}
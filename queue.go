@@ -0,0 +1,762 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUnsupportedQueueMode is returned by queue operations which are not
+// available with the configured QueueMode
+var ErrUnsupportedQueueMode = errors.New("redisstorage: operation not supported by the queue mode")
+
+// ErrQueueEmpty is returned by the GetRequest methods if there is no
+// request to return. It wraps redis.Nil, which was returned before, so
+// errors.Is(err, redis.Nil) keeps working.
+var ErrQueueEmpty = fmt.Errorf("redisstorage: queue is empty: %w", redis.Nil)
+
+// QueueMode selects the redis data structure backing the request queue.
+// Storages sharing a prefix must use the same QueueMode.
+type QueueMode int
+
+const (
+	// QueueSet stores requests in a set. Requests are returned in
+	// random order and duplicated payloads are only queued once.
+	QueueSet QueueMode = iota
+	// QueueList stores requests in a list. Requests are returned in
+	// insertion order (FIFO), which is needed for breadth-first crawls.
+	QueueList
+	// QueuePriority stores requests in a sorted set. Requests with the
+	// lowest score are returned first. AddRequest uses a score of 0.
+	QueuePriority
+	// QueueReliable stores requests in a list like QueueList, but
+	// GetRequest moves the returned request to a processing list of
+	// the consumer until it is acknowledged with Ack or returned to
+	// the queue with Nack.
+	QueueReliable
+	// QueueStream stores requests in a stream read through a consumer
+	// group, so several crawler instances can share one queue. Like
+	// QueueReliable, returned requests stay pending until they are
+	// acknowledged with Ack or returned to the queue with Nack.
+	QueueStream
+	// QueueHost keeps a separate FIFO queue per host. GetRequest
+	// returns the oldest request of a host whose PolitenessDelay has
+	// elapsed since its last request was returned, which gives every
+	// host a fair share and limits the request rate per host across
+	// all workers. On a cluster it requires HashTag, as the host queues
+	// are reached by a script.
+	QueueHost
+)
+
+// pushLua defines a Lua function adding a request to a queue of the
+// given kind, see queueKind. It is shared by the scripts moving requests
+// between the auxiliary keys and the queue. The optional score is only
+// used by sorted sets.
+const pushLua = `
+local function push(key, kind, r, score)
+	if kind == "list" then
+		redis.call("LPUSH", key, r)
+	elseif kind == "zset" then
+		redis.call("ZADD", key, score or 0, r)
+	elseif kind == "stream" then
+		redis.call("XADD", key, "*", "r", r)
+	else
+		redis.call("SADD", key, r)
+	end
+end
+`
+
+// sizeLua defines a Lua function returning the number of requests in a
+// queue of the given kind, see queueKind
+const sizeLua = `
+local function size(key, kind)
+	if kind == "list" then
+		return redis.call("LLEN", key)
+	elseif kind == "zset" then
+		return redis.call("ZCARD", key)
+	elseif kind == "stream" then
+		return redis.call("XLEN", key)
+	end
+	return redis.call("SCARD", key)
+end
+`
+
+// addBatch is the maximum number of requests queued by one command
+const addBatch = 1000
+
+// AddRequest implements queue.Storage.AddRequest() function
+func (s *Storage) AddRequest(r []byte) error {
+	return s.AddRequestCtx(context.Background(), r)
+}
+
+// AddRequestCtx is the context-aware variant of AddRequest
+func (s *Storage) AddRequestCtx(ctx context.Context, r []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.intercept(ctx, &Op{Name: "AddRequest", Request: r}, func(ctx context.Context, op *Op) error {
+		return s.addOne(ctx, op.Request)
+	})
+}
+
+func (s *Storage) addOne(ctx context.Context, r []byte) error {
+	if s.QueueStore != nil {
+		if err := s.QueueStore.AddRequestCtx(ctx, r); err != nil {
+			return err
+		}
+		if s.OnEnqueue != nil {
+			s.OnEnqueue(r)
+		}
+		return nil
+	}
+	if _, b := s.batchers(); b != nil && s.MaxQueueSize <= 0 {
+		return b.do(ctx, r)
+	}
+	return s.guard(ctx, func() error {
+		if _, err := s.addRequest(ctx, r, dedupCheck(r, s.Deduplicate)); err != nil {
+			return err
+		}
+		if err := s.expireQueue(ctx, r); err != nil {
+			return err
+		}
+		return s.waitReplicas(ctx)
+	}, func(b *CircuitBreaker) error {
+		return b.bufferRequest(s, r)
+	})
+}
+
+// AddRequestIfNew adds a request unless the request with the given ID
+// was visited, and reports whether it was added. The check and the
+// addition are atomic, so of several workers discovering the same page
+// only one queues it. With QueueHost and QueueStrategy they are only
+// atomic if Deduplicate is set.
+func (s *Storage) AddRequestIfNew(requestID uint64, r []byte) (bool, error) {
+	return s.AddRequestIfNewCtx(context.Background(), requestID, r)
+}
+
+// AddRequestIfNewCtx is the context-aware variant of AddRequestIfNew
+func (s *Storage) AddRequestIfNewCtx(ctx context.Context, requestID uint64, r []byte) (bool, error) {
+	if err := s.check(); err != nil {
+		return false, err
+	}
+	op := &Op{Name: "AddRequestIfNew", RequestID: requestID, Request: r}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Added, err = s.addRequestIfNew(ctx, op.RequestID, op.Request)
+		return err
+	})
+	return op.Added, err
+}
+
+func (s *Storage) addRequestIfNew(ctx context.Context, requestID uint64, r []byte) (bool, error) {
+	chk := dedupCheck(r, s.Deduplicate)
+	chk.visited, chk.visitedID = true, requestID
+	ok, err := s.addRequest(ctx, r, chk)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := s.expireQueue(ctx, r); err != nil {
+		return true, err
+	}
+	return true, s.waitReplicas(ctx)
+}
+
+// addRequest adds r to the queue unless it fails chk, and reports
+// whether it was added
+func (s *Storage) addRequest(ctx context.Context, r []byte, chk addCheck) (bool, error) {
+	if s.queueKind() == "" {
+		if chk.active() {
+			if ok, err := s.markPending(ctx, chk); err != nil || !ok {
+				return false, err
+			}
+		}
+		if s.MaxQueueSize > 0 {
+			if err := s.checkCapacity(ctx, 1, !chk.noWait); err != nil {
+				return false, err
+			}
+		}
+		if err := s.pushEncoded(ctx, s.encode(r)); err != nil {
+			return false, err
+		}
+		s.onAdded(ctx, r)
+		return true, nil
+	}
+	p := s.encode(r)
+	if chk.active() || s.MaxQueueSize > 0 {
+		ok, err := s.addChecked(ctx, p, 0, chk)
+		if err != nil || !ok {
+			return false, err
+		}
+		s.onAdded(ctx, r)
+		return true, nil
+	}
+	var err error
+	switch s.QueueMode {
+	case QueueList, QueueReliable:
+		err = s.Client.LPush(ctx, s.getQueueID(), p).Err()
+	case QueuePriority:
+		err = s.Client.ZAdd(ctx, s.getQueueID(), redis.Z{Member: p}).Err()
+	case QueueStream:
+		err = s.xadd(ctx, s.Client, p).Err()
+	default:
+		err = s.Client.SAdd(ctx, s.getQueueID(), p).Err()
+	}
+	if err != nil {
+		return false, err
+	}
+	s.onAdded(ctx, r)
+	return true, nil
+}
+
+// AddRequests adds several requests to the queue using a single round
+// trip, which is much faster than calling AddRequest for each of them
+// when seeding a crawl. With Deduplicate, each request is still checked
+// by its own script call.
+func (s *Storage) AddRequests(rs [][]byte) error {
+	return s.AddRequestsCtx(context.Background(), rs)
+}
+
+// AddRequestsCtx is the context-aware variant of AddRequests
+func (s *Storage) AddRequestsCtx(ctx context.Context, rs [][]byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if len(rs) == 0 {
+		return nil
+	}
+	return s.intercept(ctx, &Op{Name: "AddRequests", Requests: rs}, func(ctx context.Context, op *Op) error {
+		return s.addRequestsChecked(ctx, op.Requests)
+	})
+}
+
+// addRequestsChecked adds rs if the queue has room for them
+func (s *Storage) addRequestsChecked(ctx context.Context, rs [][]byte) error {
+	if s.MaxQueueSize > 0 {
+		if err := s.checkCapacity(ctx, len(rs), true); err != nil {
+			return err
+		}
+	}
+	if err := s.addRequests(ctx, rs); err != nil {
+		return err
+	}
+	if err := s.expireQueue(ctx, rs...); err != nil {
+		return err
+	}
+	return s.waitReplicas(ctx)
+}
+
+// addRequests adds rs to the queue, pipelining up to addBatch of them
+// per command
+func (s *Storage) addRequests(ctx context.Context, rs [][]byte) error {
+	if s.Deduplicate {
+		return s.addRequestsDedup(ctx, rs)
+	}
+	if s.QueueStrategy != nil {
+		ps := make([][]byte, len(rs))
+		for i, r := range rs {
+			ps[i] = s.encode(r)
+		}
+		if err := s.QueueStrategy.Push(ctx, s.Client, s.getQueueID(), ps...); err != nil {
+			return err
+		}
+		s.onAdded(ctx, rs...)
+		return nil
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for batch := rs; len(batch) > 0; {
+			n := len(batch)
+			if n > addBatch {
+				n = addBatch
+			}
+			s.addBatch(ctx, pipe, batch[:n])
+			batch = batch[n:]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.onAdded(ctx, rs...)
+	return nil
+}
+
+// AddRequestWithPriority adds a request with the given score to a
+// QueuePriority queue. Requests with lower scores are returned first.
+func (s *Storage) AddRequestWithPriority(r []byte, score float64) error {
+	return s.AddRequestWithPriorityCtx(context.Background(), r, score)
+}
+
+// AddRequestWithPriorityCtx is the context-aware variant of
+// AddRequestWithPriority
+func (s *Storage) AddRequestWithPriorityCtx(ctx context.Context, r []byte, score float64) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if s.QueueMode != QueuePriority {
+		return ErrUnsupportedQueueMode
+	}
+	op := &Op{Name: "AddRequestWithPriority", Request: r, Score: score}
+	return s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		return s.addWithPriority(ctx, op.Request, op.Score)
+	})
+}
+
+func (s *Storage) addWithPriority(ctx context.Context, r []byte, score float64) error {
+	added := true
+	var err error
+	if s.Deduplicate || s.MaxQueueSize > 0 {
+		added, err = s.addChecked(ctx, s.encode(r), score, dedupCheck(r, s.Deduplicate))
+	} else {
+		err = s.Client.ZAdd(ctx, s.getQueueID(), redis.Z{Score: score, Member: s.encode(r)}).Err()
+	}
+	if err != nil {
+		return err
+	}
+	if added {
+		s.onAdded(ctx, r)
+	}
+	return s.expireQueue(ctx, r)
+}
+
+// GetRequest implements queue.Storage.GetRequest() function
+func (s *Storage) GetRequest() ([]byte, error) {
+	return s.GetRequestCtx(context.Background())
+}
+
+// GetRequestCtx is the context-aware variant of GetRequest
+func (s *Storage) GetRequestCtx(ctx context.Context) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	op := &Op{Name: "GetRequest"}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Request, err = s.getOne(ctx)
+		return err
+	})
+	return op.Request, err
+}
+
+func (s *Storage) getOne(ctx context.Context) ([]byte, error) {
+	if err := s.waitRunning(ctx); err != nil {
+		return nil, err
+	}
+	if s.QueueStore != nil {
+		r, err := s.QueueStore.GetRequestCtx(ctx)
+		if err == nil && s.OnDequeue != nil {
+			s.OnDequeue(r)
+		}
+		return r, err
+	}
+	if s.DelayedRequests {
+		if err := s.promoteDelayed(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var r []byte
+	var err error
+	switch {
+	case s.QueueStrategy != nil:
+		r, err = s.QueueStrategy.Pop(ctx, s.Client, s.getQueueID())
+	case s.QueueMode == QueueList:
+		r, err = s.Client.RPop(ctx, s.getQueueID()).Bytes()
+	case s.QueueMode == QueuePriority:
+		r, err = s.popMin(ctx)
+	case s.QueueMode == QueueReliable:
+		r, err = s.claim(ctx)
+	case s.QueueMode == QueueStream:
+		r, err = s.readStream(ctx)
+	case s.QueueMode == QueueHost:
+		r, err = s.popHost(ctx)
+	default:
+		r, err = s.Client.SPop(ctx, s.getQueueID()).Bytes()
+	}
+	if err != nil {
+		return nil, queueErr(err)
+	}
+	return s.decodePopped(ctx, r)
+}
+
+// GetRequests removes and returns up to n requests using a single round
+// trip. Like GetRequest it returns ErrQueueEmpty if the queue is empty.
+func (s *Storage) GetRequests(n int) ([][]byte, error) {
+	return s.GetRequestsCtx(context.Background(), n)
+}
+
+// GetRequestsCtx is the context-aware variant of GetRequests
+func (s *Storage) GetRequestsCtx(ctx context.Context, n int) ([][]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	op := &Op{Name: "GetRequests", Count: n}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Requests, err = s.getN(ctx, op.Count)
+		return err
+	})
+	return op.Requests, err
+}
+
+func (s *Storage) getN(ctx context.Context, n int) ([][]byte, error) {
+	if err := s.waitRunning(ctx); err != nil {
+		return nil, err
+	}
+	if s.DelayedRequests {
+		if err := s.promoteDelayed(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var vs []string
+	var err error
+	switch {
+	case s.QueueStrategy != nil:
+		vs, err = s.popStrategyN(ctx, n)
+	case s.QueueMode == QueueList:
+		vs, err = s.Client.RPopCount(ctx, s.getQueueID(), n).Result()
+	case s.QueueMode == QueuePriority:
+		var zs []redis.Z
+		zs, err = s.Client.ZPopMin(ctx, s.getQueueID(), int64(n)).Result()
+		for _, z := range zs {
+			m, _ := z.Member.(string)
+			vs = append(vs, m)
+		}
+	case s.QueueMode == QueueReliable:
+		vs, err = s.claimN(ctx, n)
+	case s.QueueMode == QueueStream:
+		vs, err = s.readStreamN(ctx, n)
+	case s.QueueMode == QueueHost:
+		vs, err = s.popHostN(ctx, n)
+	default:
+		vs, err = s.Client.SPopN(ctx, s.getQueueID(), int64(n)).Result()
+	}
+	if err != nil {
+		return nil, queueErr(err)
+	}
+	if len(vs) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	rs, err := s.decodeAll(vs)
+	if err != nil {
+		return nil, err
+	}
+	s.onPopped(ctx, rs...)
+	return rs, s.unmarkPending(ctx, rs...)
+}
+
+// GetRequestBlocking is like GetRequest, but waits up to timeout for a
+// request if the queue is empty. A timeout of 0 waits forever. It
+// returns ErrQueueEmpty if no request arrived in time. QueueSet does not
+// support blocking.
+func (s *Storage) GetRequestBlocking(timeout time.Duration) ([]byte, error) {
+	return s.GetRequestBlockingCtx(context.Background(), timeout)
+}
+
+// GetRequestBlockingCtx is the context-aware variant of
+// GetRequestBlocking
+func (s *Storage) GetRequestBlockingCtx(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	op := &Op{Name: "GetRequestBlocking", TTL: timeout}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Request, err = s.getBlocking(ctx, op.TTL)
+		return err
+	})
+	return op.Request, err
+}
+
+func (s *Storage) getBlocking(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if err := s.waitRunning(ctx); err != nil {
+		return nil, err
+	}
+	if s.DelayedRequests {
+		if err := s.promoteDelayed(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if s.QueueStrategy != nil {
+		return nil, ErrUnsupportedQueueMode
+	}
+	var r []byte
+	switch s.QueueMode {
+	case QueueList:
+		v, err := s.Client.BRPop(ctx, timeout, s.getQueueID()).Result()
+		if err != nil {
+			return nil, queueErr(err)
+		}
+		r = []byte(v[1])
+	case QueuePriority:
+		z, err := s.Client.BZPopMin(ctx, timeout, s.getQueueID()).Result()
+		if err != nil {
+			return nil, queueErr(err)
+		}
+		m, _ := z.Member.(string)
+		r = []byte(m)
+	case QueueReliable:
+		v, err := s.claimBlocking(ctx, timeout)
+		if err != nil {
+			return nil, queueErr(err)
+		}
+		r = v
+	case QueueStream:
+		v, err := s.readStreamBlocking(ctx, timeout)
+		if err != nil {
+			return nil, queueErr(err)
+		}
+		r = v
+	default:
+		return nil, ErrUnsupportedQueueMode
+	}
+	return s.decodePopped(ctx, r)
+}
+
+// PeekRequests returns up to n queued requests without removing them.
+// For QueueList, QueueReliable, QueuePriority and QueueStream they are
+// returned in the order GetRequest would return them; for QueueSet the
+// selection is random.
+func (s *Storage) PeekRequests(n int) ([][]byte, error) {
+	return s.PeekRequestsCtx(context.Background(), n)
+}
+
+// PeekRequestsCtx is the context-aware variant of PeekRequests
+func (s *Storage) PeekRequestsCtx(ctx context.Context, n int) ([][]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	op := &Op{Name: "PeekRequests", Count: n}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Requests, err = s.peek(ctx, op.Count)
+		return err
+	})
+	return op.Requests, err
+}
+
+func (s *Storage) peek(ctx context.Context, n int) ([][]byte, error) {
+	if s.QueueStrategy != nil {
+		return nil, ErrUnsupportedQueueMode
+	}
+	var vs []string
+	var err error
+	switch s.QueueMode {
+	case QueueList, QueueReliable:
+		vs, err = s.Client.LRange(ctx, s.getQueueID(), -int64(n), -1).Result()
+		// Requests are popped from the right end of the list.
+		for i, j := 0, len(vs)-1; i < j; i, j = i+1, j-1 {
+			vs[i], vs[j] = vs[j], vs[i]
+		}
+	case QueuePriority:
+		vs, err = s.Client.ZRange(ctx, s.getQueueID(), 0, int64(n-1)).Result()
+	case QueueStream:
+		return s.peekStream(ctx, n)
+	case QueueHost:
+		return nil, ErrUnsupportedQueueMode
+	default:
+		vs, err = s.Client.SRandMemberN(ctx, s.getQueueID(), int64(n)).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeAll(vs)
+}
+
+// QueueSize implements queue.Storage.QueueSize() function
+func (s *Storage) QueueSize() (int, error) {
+	return s.QueueSizeCtx(context.Background())
+}
+
+// QueueSizeCtx is the context-aware variant of QueueSize
+func (s *Storage) QueueSizeCtx(ctx context.Context) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	op := &Op{Name: "QueueSize"}
+	err := s.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		op.Size, err = s.queueSize(ctx)
+		return err
+	})
+	return op.Size, err
+}
+
+func (s *Storage) queueSize(ctx context.Context) (int, error) {
+	if s.control.stopped() {
+		return 0, nil
+	}
+	if killed, err := s.killed(ctx); err != nil || killed {
+		return 0, err
+	}
+	return s.storedSize(ctx)
+}
+
+// storedSize returns the number of queued requests, also while the crawl
+// is stopped or killed
+func (s *Storage) storedSize(ctx context.Context) (int, error) {
+	if s.QueueStore != nil {
+		return s.QueueStore.QueueSizeCtx(ctx)
+	}
+	var i int64
+	var err error
+	switch {
+	case s.QueueStrategy != nil:
+		i, err = s.QueueStrategy.Size(ctx, s.Client, s.getQueueID())
+	case s.QueueMode == QueueList, s.QueueMode == QueueReliable:
+		i, err = s.Client.LLen(ctx, s.getQueueID()).Result()
+	case s.QueueMode == QueuePriority:
+		i, err = s.Client.ZCard(ctx, s.getQueueID()).Result()
+	case s.QueueMode == QueueStream:
+		i, err = s.streamSize(ctx)
+	case s.QueueMode == QueueHost:
+		i, err = s.hostQueueSize(ctx)
+	default:
+		i, err = s.Client.SCard(ctx, s.getQueueID()).Result()
+	}
+	return int(i), err
+}
+
+// expireQueue renews the expiration of the keys holding rs after they
+// were added, see QueueItemTTL. The pending IDs of Deduplicate and the
+// enqueue times of TrackQueueStats expire with the queue, so an expired
+// queue neither blocks the requests it held nor ages forever.
+func (s *Storage) expireQueue(ctx context.Context, rs ...[]byte) error {
+	if s.QueueItemTTL <= 0 {
+		return nil
+	}
+	keys := []string{s.getQueueID()}
+	if s.QueueStrategy == nil && s.QueueMode == QueueHost {
+		keys = []string{s.getHostsID(), s.getHostSizeID()}
+		seen := map[string]bool{}
+		for _, r := range rs {
+			if h := s.requestHost(r); !seen[h] {
+				seen[h] = true
+				keys = append(keys, s.getHostQueueID(h))
+			}
+		}
+	}
+	if s.Deduplicate {
+		keys = append(keys, s.getPendingID())
+	}
+	if s.TrackQueueStats {
+		keys = append(keys, s.getEnqueuedID())
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			pipe.PExpire(ctx, k, s.QueueItemTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// queueErr replaces the redis.Nil returned by commands finding the
+// queue empty with ErrQueueEmpty
+func queueErr(err error) error {
+	if err == redis.Nil {
+		return ErrQueueEmpty
+	}
+	return err
+}
+
+// pipelinedStrings collects the results of pipelined pops, skipping the
+// ones which found the queue empty
+func pipelinedStrings(cmds []redis.Cmder, err error) ([]string, error) {
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var vs []string
+	for _, c := range cmds {
+		var v string
+		switch c := c.(type) {
+		case *redis.StringCmd:
+			v, err = c.Result()
+		case *redis.Cmd:
+			v, err = c.Text()
+		}
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// popMin pops the request with the lowest score. Like SPOP and RPOP it
+// returns redis.Nil if the queue is empty.
+func (s *Storage) popMin(ctx context.Context) ([]byte, error) {
+	z, err := s.Client.ZPopMin(ctx, s.getQueueID()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(z) == 0 {
+		return nil, redis.Nil
+	}
+	m, _ := z[0].Member.(string)
+	return []byte(m), nil
+}
+
+// addBatch queues rs with a single variadic command
+func (s *Storage) addBatch(ctx context.Context, pipe redis.Pipeliner, rs [][]byte) {
+	switch s.QueueMode {
+	case QueueList, QueueReliable:
+		pipe.LPush(ctx, s.getQueueID(), s.encodeArgs(rs)...)
+	case QueuePriority:
+		zs := make([]redis.Z, len(rs))
+		for i, r := range rs {
+			zs[i] = redis.Z{Member: s.encode(r)}
+		}
+		pipe.ZAdd(ctx, s.getQueueID(), zs...)
+	case QueueStream:
+		for _, r := range rs {
+			s.xadd(ctx, pipe, s.encode(r))
+		}
+	case QueueHost:
+		for _, r := range rs {
+			s.evalAddHost(ctx, pipe, s.requestHost(r), s.encode(r), true)
+		}
+	default:
+		pipe.SAdd(ctx, s.getQueueID(), s.encodeArgs(rs)...)
+	}
+}
+
+// queueKind returns the redis type of the queue for use in Lua scripts.
+// It returns an empty string for queues which can only be written by Go
+// code: QueueHost needs the host of a request and a QueueStrategy is
+// opaque. These queues are written by pushEncoded.
+func (s *Storage) queueKind() string {
+	if s.QueueStrategy != nil {
+		return ""
+	}
+	switch s.QueueMode {
+	case QueueHost:
+		return ""
+	case QueueList, QueueReliable:
+		return "list"
+	case QueuePriority:
+		return "zset"
+	case QueueStream:
+		return "stream"
+	default:
+		return "set"
+	}
+}
+
+// pushEncoded adds the encoded request p to a queue which can not be
+// written by Lua scripts, see queueKind
+func (s *Storage) pushEncoded(ctx context.Context, p []byte) error {
+	if s.QueueStrategy != nil {
+		return s.QueueStrategy.Push(ctx, s.Client, s.getQueueID(), p)
+	}
+	return s.addEncodedHost(ctx, p)
+}
@@ -0,0 +1,988 @@
+package redisstorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestListQueue(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "list_queue_test",
+		QueueMode: QueueList,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	urls := []string{"http://example.com/", "http://go-colly.org/", "https://xx.yy/zz"}
+	for _, u := range urls {
+		if err := s.AddRequest([]byte(u)); err != nil {
+			t.Error("failed to add request: " + err.Error())
+			return
+		}
+	}
+	if size, err := s.QueueSize(); size != 3 || err != nil {
+		t.Error("invalid queue size")
+		return
+	}
+	for _, u := range urls {
+		r, err := s.GetRequest()
+		if err != nil {
+			t.Error("failed to get request: " + err.Error())
+			return
+		}
+		if string(r) != u {
+			t.Errorf("invalid request order: got %q, want %q", r, u)
+			return
+		}
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "priority_queue_test",
+		QueueMode: QueuePriority,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.AddRequestWithPriority([]byte("http://example.com/page/2"), 10); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := s.AddRequestWithPriority([]byte("http://example.com/product"), 1); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	for _, u := range []string{"http://example.com/product", "http://example.com/page/2"} {
+		r, err := s.GetRequest()
+		if err != nil {
+			t.Error("failed to get request: " + err.Error())
+			return
+		}
+		if string(r) != u {
+			t.Errorf("invalid request order: got %q, want %q", r, u)
+			return
+		}
+	}
+	if _, err := s.GetRequest(); !errors.Is(err, redis.Nil) {
+		t.Error("ErrQueueEmpty does not wrap redis.Nil")
+	}
+}
+
+func TestReliableQueue(t *testing.T) {
+	s := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "reliable_queue_test",
+		QueueMode:  QueueReliable,
+		ConsumerID: "worker1",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, u := range []string{"http://example.com/", "http://go-colly.org/"} {
+		if err := s.AddRequest([]byte(u)); err != nil {
+			t.Error("failed to add request: " + err.Error())
+			return
+		}
+	}
+	r1, err := s.GetRequest()
+	if err != nil {
+		t.Error("failed to get request: " + err.Error())
+		return
+	}
+	r2, err := s.GetRequest()
+	if err != nil {
+		t.Error("failed to get request: " + err.Error())
+		return
+	}
+	if n, err := s.InFlight(); n != 2 || err != nil {
+		t.Error("invalid in-flight count")
+		return
+	}
+	if err := s.Ack(r1); err != nil {
+		t.Error("failed to ack request: " + err.Error())
+		return
+	}
+	if err := s.Ack(r1); err != ErrNotInFlight {
+		t.Error("double ack did not return ErrNotInFlight")
+	}
+	if err := s.Nack(r2); err != nil {
+		t.Error("failed to nack request: " + err.Error())
+		return
+	}
+	if size, err := s.QueueSize(); size != 1 || err != nil {
+		t.Error("nacked request was not requeued")
+		return
+	}
+	if n, err := s.InFlight(); n != 0 || err != nil {
+		t.Error("invalid in-flight count")
+	}
+}
+
+func TestStreamQueue(t *testing.T) {
+	s := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "stream_queue_test",
+		QueueMode:  QueueStream,
+		ConsumerID: "worker1",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, u := range []string{"http://example.com/", "http://go-colly.org/"} {
+		if err := s.AddRequest([]byte(u)); err != nil {
+			t.Error("failed to add request: " + err.Error())
+			return
+		}
+	}
+	r, err := s.GetRequest()
+	if err != nil || string(r) != "http://example.com/" {
+		t.Error("failed to get request")
+		return
+	}
+	if size, err := s.QueueSize(); size != 1 || err != nil {
+		t.Error("invalid queue size")
+		return
+	}
+	p, err := s.PendingRequests(10)
+	if err != nil || len(p) != 1 || p[0].Consumer != "worker1" || p[0].Deliveries != 1 {
+		t.Error("invalid pending requests")
+		return
+	}
+
+	// A second consumer takes over the request of the first one.
+	s2 := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "stream_queue_test",
+		QueueMode:  QueueStream,
+		ConsumerID: "worker2",
+	}
+	if err := s2.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	rs, err := s2.ClaimStale(0, 10)
+	if err != nil || len(rs) != 1 || string(rs[0]) != "http://example.com/" {
+		t.Error("failed to claim stale request")
+		return
+	}
+	if err := s2.Ack(rs[0]); err != nil {
+		t.Error("failed to ack request: " + err.Error())
+		return
+	}
+	if err := s2.Ack(rs[0]); err != ErrNotInFlight {
+		t.Error("double ack did not return ErrNotInFlight")
+	}
+	if p, err := s.PendingRequests(10); err != nil || len(p) != 0 {
+		t.Error("acked request is still pending")
+	}
+
+	// Clear removes the stream, which is created again on use.
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+		return
+	}
+	if n, _ := s.Client.Exists(context.Background(), s.getQueueID()).Result(); n != 0 {
+		t.Error("stream left after Clear")
+	}
+	if size, err := s.QueueSize(); size != 0 || err != nil {
+		t.Error("invalid queue size after Clear", err)
+	}
+	if p, err := s.PendingRequests(10); err != nil || len(p) != 0 {
+		t.Error("invalid pending requests after Clear", err)
+	}
+	s.AddRequest([]byte("http://example.com/"))
+	if r, err := s.GetRequest(); err != nil || string(r) != "http://example.com/" {
+		t.Error("failed to get request after Clear", err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+		return
+	}
+	if rs, err := s.GetRequests(10); err != ErrQueueEmpty {
+		t.Error("invalid requests after Clear", rs, err)
+	}
+	s.Clear()
+	s.AddRequest([]byte("http://example.com/"))
+	if rs, err := s.GetRequests(10); err != nil || len(rs) != 1 || string(rs[0]) != "http://example.com/" {
+		t.Error("failed to get requests after Clear", rs, err)
+	}
+}
+
+func TestStreamTracking(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "stream_tracking_test",
+		QueueMode: QueueStream,
+	}
+	for i := 0; i <= streamTracked; i++ {
+		s.trackStream(redis.XMessage{ID: fmt.Sprintf("%d-0", i), Values: map[string]interface{}{"r": "r"}})
+	}
+	if n := len(s.streamIDs["r"]); n != streamTracked || len(s.streamOrder) != streamTracked {
+		t.Errorf("%d entries tracked", n)
+	}
+	s = &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "stream_tracking_test",
+		QueueMode: QueueStream,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.AddRequest([]byte("http://example.com/"))
+	r, err := s.GetRequest()
+	if err != nil {
+		t.Error("failed to get request: " + err.Error())
+		return
+	}
+	// Requests which are no longer tracked are found by XPENDING.
+	s.streamIDs, s.streamOrder = nil, nil
+	if err := s.Ack(r); err != nil {
+		t.Error("failed to ack untracked request: " + err.Error())
+	}
+	if p, err := s.PendingRequests(10); err != nil || len(p) != 0 {
+		t.Error("request still pending", p, err)
+	}
+	if err := s.Ack(r); err != ErrNotInFlight {
+		t.Error("request acked twice", err)
+	}
+}
+
+func TestDelayedRequests(t *testing.T) {
+	s := &Storage{
+		Address:         "127.0.0.1:6379",
+		Prefix:          "delayed_queue_test",
+		QueueMode:       QueueList,
+		DelayedRequests: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.AddRequestAfter([]byte("http://example.com/later"), time.Hour); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := s.AddRequestAfter([]byte("http://example.com/now"), -time.Second); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	r, err := s.GetRequest()
+	if err != nil || string(r) != "http://example.com/now" {
+		t.Error("failed to get due request")
+		return
+	}
+	if _, err := s.GetRequest(); err != ErrQueueEmpty {
+		t.Error("request returned before its delay passed")
+	}
+	if n, err := s.DelayedSize(); n != 1 || err != nil {
+		t.Error("invalid delayed size")
+	}
+}
+
+func TestDLQ(t *testing.T) {
+	s := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "dlq_test",
+		QueueMode:  QueueReliable,
+		ConsumerID: "worker1",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.AddRequest([]byte("http://example.com/broken")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	r, err := s.GetRequest()
+	if err != nil {
+		t.Error("failed to get request: " + err.Error())
+		return
+	}
+	if err := s.MoveToDLQ(r); err != nil {
+		t.Error("failed to move request to DLQ: " + err.Error())
+		return
+	}
+	if n, err := s.InFlight(); n != 0 || err != nil {
+		t.Error("dead-lettered request is still in flight")
+		return
+	}
+	rs, err := s.ListDLQ(10)
+	if err != nil || len(rs) != 1 || string(rs[0]) != "http://example.com/broken" {
+		t.Error("invalid DLQ content")
+		return
+	}
+	if n, err := s.RequeueFromDLQ(10); n != 1 || err != nil {
+		t.Error("failed to requeue from DLQ")
+		return
+	}
+	if size, err := s.QueueSize(); size != 1 || err != nil {
+		t.Error("invalid queue size")
+	}
+	if size, err := s.DLQSize(); size != 0 || err != nil {
+		t.Error("invalid DLQ size")
+	}
+}
+
+func TestPendingCleanup(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "pending_cleanup_test",
+		QueueMode:    QueueList,
+		Deduplicate:  true,
+		QueueItemTTL: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	r := []byte("http://example.com/broken")
+	s.AddRequest(r)
+	if ttl, _ := s.Client.PTTL(context.Background(), s.getPendingID()).Result(); ttl <= 0 {
+		t.Errorf("pending IDs do not expire with the queue: %s", ttl)
+	}
+	if err := s.MoveToDLQ(r); err != nil {
+		t.Error("failed to move request to DLQ: " + err.Error())
+		return
+	}
+	id := strconv.FormatUint(RequestID(r), 10)
+	if ok, _ := s.Client.SIsMember(context.Background(), s.getPendingID(), id).Result(); ok {
+		t.Error("dead-lettered request still pending")
+	}
+}
+
+func TestAddRequests(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "batch_queue_test",
+		QueueMode: QueueList,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	rs := make([][]byte, 2500)
+	for i := range rs {
+		rs[i] = []byte(fmt.Sprintf("http://example.com/%d", i))
+	}
+	if err := s.AddRequests(rs); err != nil {
+		t.Error("failed to add requests: " + err.Error())
+		return
+	}
+	if size, err := s.QueueSize(); size != len(rs) || err != nil {
+		t.Error("invalid queue size")
+		return
+	}
+	if r, err := s.GetRequest(); err != nil || string(r) != "http://example.com/0" {
+		t.Error("invalid request order")
+	}
+}
+
+func TestGetRequestBlocking(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "blocking_queue_test",
+		QueueMode: QueueList,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.AddRequest([]byte("http://example.com/"))
+	}()
+	r, err := s.GetRequestBlocking(5 * time.Second)
+	if err != nil || string(r) != "http://example.com/" {
+		t.Error("failed to get request")
+		return
+	}
+	if _, err := s.GetRequestBlocking(100 * time.Millisecond); err != ErrQueueEmpty {
+		t.Error("empty queue did not time out")
+	}
+}
+
+func TestPeekRequests(t *testing.T) {
+	for _, mode := range []QueueMode{QueueList, QueuePriority, QueueStream} {
+		s := &Storage{
+			Address:   "127.0.0.1:6379",
+			Prefix:    "peek_queue_test",
+			QueueMode: mode,
+		}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		urls := []string{"http://example.com/1", "http://example.com/2", "http://example.com/3"}
+		for _, u := range urls {
+			if err := s.AddRequest([]byte(u)); err != nil {
+				t.Error("failed to add request: " + err.Error())
+				return
+			}
+		}
+		if _, err := s.GetRequest(); err != nil {
+			t.Error("failed to get request: " + err.Error())
+			return
+		}
+		rs, err := s.PeekRequests(5)
+		if err != nil || len(rs) != 2 || string(rs[0]) != urls[1] || string(rs[1]) != urls[2] {
+			t.Errorf("invalid peeked requests in mode %d: %q", mode, rs)
+		}
+		if size, err := s.QueueSize(); size != 2 || err != nil {
+			t.Errorf("peek modified the queue in mode %d", mode)
+		}
+		s.Clear()
+	}
+}
+
+func TestNamedQueues(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "named_queue_test",
+		QueueMode: QueueList,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	images := s.Queue("images")
+	pages := s.Queue("pages")
+	pages.QueueMode = QueueStream
+	if err := images.AddRequest([]byte("http://example.com/a.png")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := pages.AddRequest([]byte("http://example.com/")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if size, err := s.QueueSize(); size != 0 || err != nil {
+		t.Error("named queue request added to the default queue")
+		return
+	}
+	if r, err := images.GetRequest(); err != nil || string(r) != "http://example.com/a.png" {
+		t.Error("failed to get request from images queue")
+		return
+	}
+	if r, err := pages.GetRequest(); err != nil || string(r) != "http://example.com/" {
+		t.Error("failed to get request from pages queue")
+		return
+	}
+	s.Clear()
+	if size, err := images.QueueSize(); size != 0 || err != nil {
+		t.Error("Clear did not remove named queue")
+	}
+}
+
+func TestHostQueue(t *testing.T) {
+	s := &Storage{
+		Address:         "127.0.0.1:6379",
+		Prefix:          "host_queue_test",
+		QueueMode:       QueueHost,
+		PolitenessDelay: time.Hour,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	urls := []string{"http://a.com/1", "http://a.com/2", `{"URL":"http://b.com/1","Method":"GET"}`}
+	if err := s.AddRequests([][]byte{[]byte(urls[0]), []byte(urls[1]), []byte(urls[2])}); err != nil {
+		t.Error("failed to add requests: " + err.Error())
+		return
+	}
+	if size, err := s.QueueSize(); size != 3 || err != nil {
+		t.Error("invalid queue size")
+		return
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		r, err := s.GetRequest()
+		if err != nil {
+			t.Error("failed to get request: " + err.Error())
+			return
+		}
+		got[string(r)] = true
+	}
+	if !got[urls[0]] || !got[urls[2]] {
+		t.Errorf("hosts were not served fairly: %v", got)
+		return
+	}
+	// Both hosts have to wait for the politeness delay now.
+	if _, err := s.GetRequest(); err != ErrQueueEmpty {
+		t.Error("politeness delay was not respected")
+	}
+	// Also b.com, whose queue emptied.
+	s.AddRequest([]byte("http://b.com/2"))
+	if _, err := s.GetRequest(); err != ErrQueueEmpty {
+		t.Error("politeness delay of an emptied host was not respected")
+	}
+	if size, err := s.QueueSize(); size != 2 || err != nil {
+		t.Error("invalid queue size", size, err)
+	}
+	// Without a delay, emptied hosts are removed by the next pop.
+	s.Clear()
+	s.PolitenessDelay = 0
+	s.AddRequest([]byte("http://a.com/1"))
+	s.GetRequest()
+	if _, err := s.GetRequest(); err != ErrQueueEmpty {
+		t.Error("request returned from an empty queue", err)
+	}
+	if n, _ := s.Client.ZCard(context.Background(), s.getHostsID()).Result(); n != 0 {
+		t.Error("emptied host not removed", n)
+	}
+	if size, err := s.QueueSize(); size != 0 || err != nil {
+		t.Error("invalid queue size", size, err)
+	}
+}
+
+func TestRequeueRequest(t *testing.T) {
+	s := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "requeue_test",
+		QueueMode:  QueueList,
+		MaxRetries: 2,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	r := []byte("http://example.com/flaky")
+	for i := 1; i <= 2; i++ {
+		if err := s.RequeueRequest(r); err != nil {
+			t.Error("failed to requeue request: " + err.Error())
+			return
+		}
+		if n, err := s.Attempts(r); n != i || err != nil {
+			t.Error("invalid attempt count")
+			return
+		}
+	}
+	if err := s.RequeueRequest(r); err != ErrMaxRetries {
+		t.Error("request was not dead-lettered after MaxRetries")
+		return
+	}
+	if size, err := s.DLQSize(); size != 1 || err != nil {
+		t.Error("invalid DLQ size")
+	}
+	if size, err := s.QueueSize(); size != 2 || err != nil {
+		t.Error("invalid queue size")
+	}
+}
+
+func TestRequeueRequestDedup(t *testing.T) {
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "requeue_dedup_test",
+		QueueMode:   QueueList,
+		Deduplicate: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	r := []byte("http://example.com/flaky")
+	s.AddRequest(r)
+	if _, err := s.GetRequest(); err != nil {
+		t.Error("failed to get request: " + err.Error())
+		return
+	}
+	s.Visited(RequestID(r))
+	// The visited request is requeued and pending again, so adding it
+	// concurrently does not queue it twice.
+	if err := s.RequeueRequest(r); err != nil {
+		t.Error("failed to requeue request: " + err.Error())
+		return
+	}
+	id := strconv.FormatUint(RequestID(r), 10)
+	if ok, _ := s.Client.SIsMember(context.Background(), s.getPendingID(), id).Result(); !ok {
+		t.Error("requeued request not pending")
+	}
+	s.AddRequest(r)
+	if size, err := s.QueueSize(); size != 1 || err != nil {
+		t.Error("invalid queue size", size, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := &Storage{
+		Address:           "127.0.0.1:6379",
+		Prefix:            "compress_test",
+		QueueMode:         QueueReliable,
+		CompressThreshold: 64,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	big := []byte(`{"URL":"http://example.com/","Headers":"` + strings.Repeat("x", 4096) + `"}`)
+	if err := s.AddRequests([][]byte{big, []byte("http://example.com/small")}); err != nil {
+		t.Error("failed to add requests: " + err.Error())
+		return
+	}
+	stored, err := s.Client.LIndex(context.Background(), s.getQueueID(), -1).Bytes()
+	if err != nil || len(stored) >= len(big) {
+		t.Error("request was not compressed")
+		return
+	}
+	r, err := s.GetRequest()
+	if err != nil || !bytes.Equal(r, big) {
+		t.Error("failed to decompress request")
+		return
+	}
+	if err := s.Ack(r); err != nil {
+		t.Error("failed to ack compressed request: " + err.Error())
+		return
+	}
+	if r, err := s.GetRequest(); err != nil || string(r) != "http://example.com/small" {
+		t.Error("failed to get uncompressed request")
+	}
+	// Raw payloads looking compressed are returned unchanged.
+	compressed := s.encode(big)
+	s.CompressThreshold = 0
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("body"))
+	w.Close()
+	for _, p := range [][]byte{gz.Bytes(), compressed} {
+		s.AddRequest(p)
+		if r, err := s.GetRequest(); err != nil || !bytes.Equal(r, p) {
+			t.Errorf("raw payload changed: %q %v", r, err)
+		}
+	}
+}
+
+func TestMaxQueueSize(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "capacity_test",
+		QueueMode:    QueuePriority,
+		MaxQueueSize: 2,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.AddRequestWithPriority([]byte("http://example.com/1"), 5); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := s.AddRequest([]byte("http://example.com/2")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := s.AddRequest([]byte("http://example.com/3")); err != ErrQueueFull {
+		t.Error("full queue did not return ErrQueueFull")
+		return
+	}
+	if err := s.AddRequests([][]byte{[]byte("http://example.com/4")}); err != ErrQueueFull {
+		t.Error("full queue did not return ErrQueueFull for batch")
+		return
+	}
+	s.BlockWhenFull = true
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.GetRequest()
+	}()
+	if err := s.AddRequest([]byte("http://example.com/3")); err != nil {
+		t.Error("blocked add failed: " + err.Error())
+	}
+	// A batch larger than the queue never fits.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	batch := [][]byte{[]byte("http://example.com/5"), []byte("http://example.com/6"), []byte("http://example.com/7")}
+	if err := s.AddRequestsCtx(ctx, batch); err != ErrQueueFull {
+		t.Error("oversized batch did not return ErrQueueFull", err)
+	}
+}
+
+func TestGetRequests(t *testing.T) {
+	for _, mode := range []QueueMode{QueueSet, QueueList, QueuePriority, QueueReliable, QueueStream, QueueHost} {
+		s := &Storage{
+			Address:   "127.0.0.1:6379",
+			Prefix:    "batch_get_test",
+			QueueMode: mode,
+		}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		urls := [][]byte{[]byte("http://a.com/"), []byte("http://b.com/"), []byte("http://c.com/")}
+		if err := s.AddRequests(urls); err != nil {
+			t.Error("failed to add requests: " + err.Error())
+			return
+		}
+		rs, err := s.GetRequests(2)
+		if err != nil || len(rs) != 2 {
+			t.Errorf("failed to get requests in mode %d: %v", mode, err)
+		}
+		rs, err = s.GetRequests(5)
+		if err != nil || len(rs) != 1 {
+			t.Errorf("failed to get remaining request in mode %d: %v", mode, err)
+		}
+		if _, err := s.GetRequests(5); err != ErrQueueEmpty {
+			t.Errorf("empty queue did not return ErrQueueEmpty in mode %d", mode)
+		}
+		s.Clear()
+	}
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	s := &Storage{
+		Address:           "127.0.0.1:6379",
+		Prefix:            "visibility_test",
+		QueueMode:         QueueReliable,
+		ConsumerID:        "crashed",
+		VisibilityTimeout: time.Hour,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	for _, u := range []string{"http://example.com/1", "http://example.com/2"} {
+		if err := s.AddRequest([]byte(u)); err != nil {
+			t.Error("failed to add request: " + err.Error())
+			return
+		}
+	}
+	if _, err := s.GetRequests(2); err != nil {
+		t.Error("failed to get requests: " + err.Error())
+		return
+	}
+	if err := s.Ack([]byte("http://example.com/2")); err != nil {
+		t.Error("failed to ack request: " + err.Error())
+		return
+	}
+	if n, err := s.RequeueStale(); n != 0 || err != nil {
+		t.Error("request requeued before the visibility timeout")
+		return
+	}
+	// The reaper of s reads VisibilityTimeout, so a second storage with a
+	// short timeout reaps.
+	reaper := &Storage{
+		Address:           "127.0.0.1:6379",
+		Prefix:            "visibility_test",
+		QueueMode:         QueueReliable,
+		ConsumerID:        "reaper",
+		VisibilityTimeout: time.Millisecond,
+	}
+	if err := reaper.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer reaper.Close()
+	time.Sleep(10 * time.Millisecond)
+	if n, err := reaper.RequeueStale(); n != 1 || err != nil {
+		t.Errorf("failed to requeue stale request: %d %v", n, err)
+		return
+	}
+	if size, err := s.QueueSize(); size != 1 || err != nil {
+		t.Error("invalid queue size")
+	}
+	if n, err := s.InFlight(); n != 0 || err != nil {
+		t.Error("stale request is still in flight")
+	}
+}
+
+func TestQueueStrategy(t *testing.T) {
+	s := &Storage{
+		Address:       "127.0.0.1:6379",
+		Prefix:        "strategy_test",
+		QueueStrategy: LIFO,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	urls := [][]byte{[]byte("http://example.com/"), []byte("http://example.com/a"), []byte("http://example.com/a/b")}
+	if err := s.AddRequests(urls); err != nil {
+		t.Error("failed to add requests: " + err.Error())
+		return
+	}
+	if size, err := s.QueueSize(); size != 3 || err != nil {
+		t.Error("invalid queue size")
+		return
+	}
+	for i := len(urls) - 1; i >= 0; i-- {
+		r, err := s.GetRequest()
+		if err != nil || !bytes.Equal(r, urls[i]) {
+			t.Errorf("invalid request order: got %q, want %q", r, urls[i])
+			return
+		}
+	}
+	if _, err := s.GetRequest(); err != ErrQueueEmpty {
+		t.Error("empty queue did not return ErrQueueEmpty")
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	for _, mode := range []QueueMode{QueueList, QueueHost} {
+		s := &Storage{
+			Address:     "127.0.0.1:6379",
+			Prefix:      fmt.Sprintf("dedup_test_%d", mode),
+			QueueMode:   mode,
+			Deduplicate: true,
+		}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		defer s.Clear()
+		if err := s.Visited(RequestID([]byte("http://example.com/visited"))); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+		rs := [][]byte{
+			[]byte("http://example.com/1"),
+			[]byte("http://example.com/1"),
+			[]byte("http://example.com/visited"),
+		}
+		if err := s.AddRequests(rs); err != nil {
+			t.Error("failed to add requests: " + err.Error())
+			return
+		}
+		if err := s.AddRequest([]byte("http://example.com/1")); err != nil {
+			t.Error("failed to add duplicate: " + err.Error())
+			return
+		}
+		if size, _ := s.QueueSize(); size != 1 {
+			t.Errorf("mode %d: queue size is %d instead of 1", mode, size)
+			return
+		}
+		if _, err := s.GetRequest(); err != nil {
+			t.Error("failed to get request: " + err.Error())
+			return
+		}
+		// Popped requests can be queued again until they are visited.
+		if err := s.AddRequest([]byte("http://example.com/1")); err != nil {
+			t.Error("failed to add request: " + err.Error())
+			return
+		}
+		if size, _ := s.QueueSize(); size != 1 {
+			t.Errorf("mode %d: popped request was not queued again", mode)
+		}
+	}
+}
+
+func TestAddRequestIfNew(t *testing.T) {
+	for _, mode := range []QueueMode{QueueSet, QueueHost} {
+		s := &Storage{
+			Address:   "127.0.0.1:6379",
+			Prefix:    fmt.Sprintf("ifnew_test_%d", mode),
+			QueueMode: mode,
+		}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		defer s.Clear()
+		if err := s.Visited(1); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+		if ok, err := s.AddRequestIfNew(1, []byte("http://example.com/1")); err != nil || ok {
+			t.Errorf("mode %d: visited request added: %v", mode, err)
+		}
+		if ok, err := s.AddRequestIfNew(2, []byte("http://example.com/2")); err != nil || !ok {
+			t.Errorf("mode %d: new request not added: %v", mode, err)
+		}
+		if size, _ := s.QueueSize(); size != 1 {
+			t.Errorf("mode %d: queue size is %d instead of 1", mode, size)
+		}
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	s := &Storage{
+		Address:         "127.0.0.1:6379",
+		Prefix:          "queue_stats_test",
+		QueueMode:       QueueList,
+		TrackQueueStats: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if age, err := s.OldestQueuedAge(); err != nil || age != 0 {
+		t.Errorf("empty queue has age %s: %v", age, err)
+	}
+	s.AddRequest([]byte("http://example.com/1"))
+	time.Sleep(20 * time.Millisecond)
+	s.AddRequests([][]byte{[]byte("http://example.com/2"), []byte("http://example.com/3")})
+	if age, _ := s.OldestQueuedAge(); age < 20*time.Millisecond {
+		t.Errorf("oldest request has age %s", age)
+	}
+	s.GetRequest()
+	if age, _ := s.OldestQueuedAge(); age >= 20*time.Millisecond {
+		t.Errorf("age of taken request reported: %s", age)
+	}
+	if rate, _ := s.EnqueueRate(); rate != 3/rateWindow.Seconds() {
+		t.Errorf("invalid enqueue rate %f", rate)
+	}
+	if rate, _ := s.DequeueRate(); rate != 1/rateWindow.Seconds() {
+		t.Errorf("invalid dequeue rate %f", rate)
+	}
+}
+
+func TestQueueStatsCleanup(t *testing.T) {
+	s := &Storage{
+		Address:         "127.0.0.1:6379",
+		Prefix:          "queue_stats_cleanup_test",
+		QueueMode:       QueueList,
+		TrackQueueStats: true,
+		QueueItemTTL:    time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	r := []byte("http://example.com/broken")
+	s.AddRequest(r)
+	if ttl, _ := s.Client.PTTL(context.Background(), s.getEnqueuedID()).Result(); ttl <= 0 {
+		t.Errorf("enqueue times do not expire with the queue: %s", ttl)
+	}
+	if err := s.MoveToDLQ(r); err != nil {
+		t.Error("failed to move request to DLQ: " + err.Error())
+		return
+	}
+	if n, _ := s.Client.ZCard(context.Background(), s.getEnqueuedID()).Result(); n != 0 {
+		t.Error("enqueue time of dead-lettered request kept")
+	}
+}
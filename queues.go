@@ -0,0 +1,50 @@
+package redisstorage
+
+// Queue returns a storage for the named queue. It shares the client,
+// prefix, visited requests and cookies with s, but has its own request
+// queue, so one crawler process can maintain separate frontiers, e.g.
+// for images and pages. The queue settings like QueueMode are copied
+// from s and can be changed on the returned storage before use.
+//
+// Closing the returned storage closes the shared client.
+func (s *Storage) Queue(name string) *Storage {
+	q := s.clone()
+	q.needsInit.Store(s.needsInit.Load())
+	q.queueName = name
+	if q.ConsumerGroup == "" {
+		q.ConsumerGroup = "colly"
+	}
+	return q
+}
+
+// nestedClass separates the prefix of s from the one of WithPrefix. It
+// is not a key class, so the keys of the nested storage never collide
+// with the ones of s.
+const nestedClass = "ns"
+
+// WithPrefix returns a storage sharing the client and settings of s
+// whose keys are nested in the namespace of s, e.g. colly:ns:sub, so one
+// process can run isolated crawls over the same connections. The
+// returned storage must be initialized with Init, which opens no
+// connections, and its settings can be changed before. Until then its
+// methods return ErrNotInitialized.
+//
+// Closing the returned storage closes the shared client.
+func (s *Storage) WithPrefix(prefix string) *Storage {
+	c := s.clone()
+	c.needsInit.Store(true)
+	if s.Prefix != "" {
+		c.Prefix = s.Prefix + ":" + nestedClass + ":" + prefix
+	} else {
+		c.Prefix = prefix
+	}
+	// The caches, the bloom filter, the control channel and the kill
+	// switch belong to the namespace of s.
+	c.cache = nil
+	c.cookies = nil
+	c.async = nil
+	c.bloom = false
+	c.control = nil
+	c.kill = nil
+	return c
+}
@@ -0,0 +1,173 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateWindow is the time over which EnqueueRate and DequeueRate average
+const rateWindow = time.Minute
+
+// ErrQueueStatsDisabled is returned by the queue age and throughput
+// methods if TrackQueueStats is not set
+var ErrQueueStatsDisabled = errors.New("redisstorage: TrackQueueStats is not enabled")
+
+// OldestQueuedAge returns how long the oldest queued request has been
+// waiting, or 0 if the queue is empty. It requires TrackQueueStats.
+// Requests returned to the queue by Nack or RequeueStale are not
+// tracked again.
+func (s *Storage) OldestQueuedAge() (time.Duration, error) {
+	return s.OldestQueuedAgeCtx(context.Background())
+}
+
+// OldestQueuedAgeCtx is the context-aware variant of OldestQueuedAge
+func (s *Storage) OldestQueuedAgeCtx(ctx context.Context) (time.Duration, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	if !s.TrackQueueStats {
+		return 0, ErrQueueStatsDisabled
+	}
+	zs, err := s.Client.ZRangeWithScores(ctx, s.getEnqueuedID(), 0, 0).Result()
+	if err != nil || len(zs) == 0 {
+		return 0, err
+	}
+	return time.Since(time.UnixMilli(int64(zs[0].Score))), nil
+}
+
+// EnqueueRate returns the number of requests added to the queue per
+// second, averaged over the last minute. It requires TrackQueueStats.
+func (s *Storage) EnqueueRate() (float64, error) {
+	return s.EnqueueRateCtx(context.Background())
+}
+
+// EnqueueRateCtx is the context-aware variant of EnqueueRate
+func (s *Storage) EnqueueRateCtx(ctx context.Context) (float64, error) {
+	return s.rate(ctx, "enq")
+}
+
+// DequeueRate returns the number of requests taken from the queue per
+// second, averaged over the last minute. It requires TrackQueueStats.
+func (s *Storage) DequeueRate() (float64, error) {
+	return s.DequeueRateCtx(context.Background())
+}
+
+// DequeueRateCtx is the context-aware variant of DequeueRate
+func (s *Storage) DequeueRateCtx(ctx context.Context) (float64, error) {
+	return s.rate(ctx, "deq")
+}
+
+// rate sums the per second counters of kind over rateWindow
+func (s *Storage) rate(ctx context.Context, kind string) (float64, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	if !s.TrackQueueStats {
+		return 0, ErrQueueStatsDisabled
+	}
+	now := time.Now().Unix()
+	n := int64(rateWindow / time.Second)
+	cmds := make([]*redis.StringCmd, n)
+	// GETs instead of MGET, as the counters are spread over slots on a
+	// cluster.
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range cmds {
+			cmds[i] = pipe.Get(ctx, s.getRateID(kind, now-int64(i)))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	var sum int64
+	for _, cmd := range cmds {
+		v, _ := cmd.Int64()
+		sum += v
+	}
+	return float64(sum) / rateWindow.Seconds(), nil
+}
+
+// onAdded counts the requests rs added to the queue and passes them to
+// OnEnqueue. The statistics are advisory, so failing to record them does
+// not fail the addition.
+func (s *Storage) onAdded(ctx context.Context, rs ...[]byte) {
+	s.metrics.added(len(rs))
+	if s.OnEnqueue != nil {
+		for _, r := range rs {
+			s.OnEnqueue(r)
+		}
+	}
+	if !s.TrackQueueStats || len(rs) == 0 {
+		return
+	}
+	now := time.Now()
+	zs := make([]redis.Z, len(rs))
+	for i, r := range rs {
+		zs[i] = redis.Z{Score: float64(now.UnixMilli()), Member: enqueuedMember(r)}
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// The first of identical requests determines the age.
+		pipe.ZAddNX(ctx, s.getEnqueuedID(), zs...)
+		s.countRate(ctx, pipe, "enq", now, len(rs))
+		return nil
+	})
+	s.queueStatsErr(err)
+}
+
+// onPopped counts the requests rs taken from the queue and passes them
+// to OnDequeue
+func (s *Storage) onPopped(ctx context.Context, rs ...[]byte) {
+	s.metrics.popped(len(rs))
+	if s.OnDequeue != nil {
+		for _, r := range rs {
+			s.OnDequeue(r)
+		}
+	}
+	if !s.TrackQueueStats || len(rs) == 0 {
+		return
+	}
+	members := make([]interface{}, len(rs))
+	for i, r := range rs {
+		members[i] = enqueuedMember(r)
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.getEnqueuedID(), members...)
+		s.countRate(ctx, pipe, "deq", time.Now(), len(rs))
+		return nil
+	})
+	s.queueStatsErr(err)
+}
+
+func (s *Storage) queueStatsErr(err error) {
+	if err != nil {
+		s.errs.record(err)
+		s.logf("queue stats error %s", err)
+	}
+}
+
+func (s *Storage) countRate(ctx context.Context, pipe redis.Pipeliner, kind string, now time.Time, n int) {
+	key := s.getRateID(kind, now.Unix())
+	pipe.IncrBy(ctx, key, int64(n))
+	pipe.Expire(ctx, key, rateWindow+time.Second)
+}
+
+// enqueuedMember returns the member tracking the age of r, a hash to
+// keep the set small
+func enqueuedMember(r []byte) string {
+	h := fnv.New64a()
+	h.Write(r)
+	return strconv.FormatUint(h.Sum64(), 10)
+}
+
+func (s *Storage) getEnqueuedID() string {
+	return s.queueKey("enqueued")
+}
+
+func (s *Storage) getRateID(kind string, sec int64) string {
+	return s.queueKey("rate", kind, strconv.FormatInt(sec, 10))
+}
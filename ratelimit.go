@@ -0,0 +1,109 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// rateLimitScript records a request in the sliding window of a host if
+// less than the limit were recorded within the window. It returns 0 if
+// the request is allowed, else the milliseconds until the oldest
+// request leaves the window.
+// KEYS: window
+// ARGV: now, window in milliseconds, limit, member
+var rateLimitScript = newScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	return math.max(tonumber(oldest[2]) + window - now, 1)
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return 0
+`)
+
+// ErrRateLimit is returned by RateLimiter for a limit which is not
+// positive or a window shorter than a millisecond
+var ErrRateLimit = errors.New("redisstorage: rate limit and window must be positive")
+
+// RateLimiter allows up to Limit requests per host within a sliding
+// window. The budget is shared by all RateLimiters using the prefix of
+// the storage, so a fleet of crawlers can be polite as a whole.
+type RateLimiter struct {
+	s      *Storage
+	limit  int
+	window time.Duration
+}
+
+// RateLimiter returns a RateLimiter allowing limit requests per host
+// within window. The window is counted in milliseconds, so it must be
+// at least a millisecond long.
+func (s *Storage) RateLimiter(limit int, window time.Duration) (*RateLimiter, error) {
+	if limit <= 0 || window < time.Millisecond {
+		return nil, ErrRateLimit
+	}
+	return &RateLimiter{s: s, limit: limit, window: window}, nil
+}
+
+// Allow reports whether a request to host is allowed now. Allowed
+// requests are counted.
+func (l *RateLimiter) Allow(host string) (bool, error) {
+	return l.AllowCtx(context.Background(), host)
+}
+
+// AllowCtx is the context-aware variant of Allow
+func (l *RateLimiter) AllowCtx(ctx context.Context, host string) (bool, error) {
+	wait, err := l.reserve(ctx, host)
+	return wait == 0, err
+}
+
+// Wait blocks until a request to host is allowed and counts it
+func (l *RateLimiter) Wait(host string) error {
+	return l.WaitCtx(context.Background(), host)
+}
+
+// WaitCtx is the context-aware variant of Wait. It returns the error of
+// ctx if it is done before the request is allowed.
+func (l *RateLimiter) WaitCtx(ctx context.Context, host string) error {
+	for {
+		wait, err := l.reserve(ctx, host)
+		if err != nil || wait == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reserve counts a request to host if it is allowed. Otherwise it
+// returns how long to wait before trying again.
+func (l *RateLimiter) reserve(ctx context.Context, host string) (time.Duration, error) {
+	if err := l.s.check(); err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixMilli()
+	keys := []string{l.s.getRateLimitID(host)}
+	ms, err := l.s.runScript(ctx, l.s.Client, rateLimitScript, keys, now, l.window.Milliseconds(), l.limit, timeMember(now)).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// timeMember returns a unique member of a sorted set of events scored by
+// their time now. Events in the same millisecond need distinct members.
+func timeMember(now int64) string {
+	return strconv.FormatInt(now, 10) + "-" + strconv.FormatUint(rand.Uint64(), 36)
+}
+
+func (s *Storage) getRateLimitID(host string) string {
+	return s.key("ratelimit", host)
+}
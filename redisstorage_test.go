@@ -1,7 +1,32 @@
 package redisstorage
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gocolly/colly/v2/queue"
+	collystorage "github.com/gocolly/colly/v2/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// The storages implement the interfaces of Colly v2, which are the ones
+// of v1.
+var (
+	_ collystorage.Storage = (*Storage)(nil)
+	_ queue.Storage        = (*Storage)(nil)
+	_ collystorage.Storage = (*HybridStorage)(nil)
+	_ queue.Storage        = (*HybridStorage)(nil)
+	_ collystorage.Storage = (*ShardedStorage)(nil)
+	_ queue.Storage        = (*ShardedStorage)(nil)
 )
 
 func TestQueue(t *testing.T) {
@@ -35,3 +60,2664 @@ func TestQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestInitURL(t *testing.T) {
+	s := &Storage{
+		URL:    "redis://127.0.0.1:6379/0?dial_timeout=3s&pool_size=5",
+		Prefix: "url_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	s = &Storage{URL: "http://127.0.0.1:6379"}
+	if err := s.Init(); err == nil {
+		t.Error("invalid URL accepted")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "close_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	if err := s.Close(); err != nil {
+		t.Error("failed to close storage: " + err.Error())
+		return
+	}
+	if err := s.Visited(1); err != ErrClosed {
+		t.Error("Visited after Close did not return ErrClosed")
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Error("second Close did not return ErrClosed")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "errors_test"}
+	if err := s.Visited(1); err != ErrNotInitialized {
+		t.Errorf("Visited before Init returned %v", err)
+	}
+	s = &Storage{Address: "127.0.0.1:1", Prefix: "errors_test", DialTimeout: 100 * time.Millisecond}
+	defer s.Close()
+	if err := s.Init(); !errors.Is(err, ErrConnection) || !IsRetriable(err) {
+		t.Errorf("unexpected Init error: %v", err)
+	}
+}
+
+func TestErrorValues(t *testing.T) {
+	if err := (&Storage{Address: "127.0.0.1:6379", Expires: -time.Second}).Init(); !errors.Is(err, ErrNegativeExpiration) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := (&Storage{Address: "127.0.0.1:6379", HashTag: true}).Init(); !errors.Is(err, ErrHashTagPrefix) {
+		t.Errorf("unexpected error %v", err)
+	}
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"a": "127.0.0.1:6379"}})
+	if err := (&Storage{Client: ring, QueueMode: QueueHost}).Init(); !errors.Is(err, ErrHostHashTag) {
+		t.Errorf("unexpected error %v", err)
+	}
+	ring.Close()
+	if _, err := NewShardedStorage(); !errors.Is(err, ErrNoShards) {
+		t.Errorf("unexpected error %v", err)
+	}
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "error_values_test"}
+	if _, err := s.RateLimiter(0, time.Second); !errors.Is(err, ErrRateLimit) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	if _, err := s.MirrorConsistency(); !errors.Is(err, ErrMirrorDisabled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := s.OldestQueuedAge(); !errors.Is(err, ErrQueueStatsDisabled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := s.GetVisitInfo(1); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := s.Publish("restart"); !errors.Is(err, ErrUnknownSignal) {
+		t.Errorf("unexpected error %v", err)
+	}
+	s.AddRequest(itemMagic)
+	if _, err := s.GetItem(); !errors.Is(err, ErrInvalidItem) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestInitWithRetry(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:1", Prefix: "retry_test", DialTimeout: 10 * time.Millisecond}
+	defer s.Close()
+	start := time.Now()
+	if err := s.InitWithRetry(context.Background(), 300*time.Millisecond); !errors.Is(err, ErrConnection) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Errorf("gave up after %s", d)
+	}
+	s = &Storage{Address: "127.0.0.1:6379", Prefix: "retry_test"}
+	defer s.Close()
+	if err := s.InitWithRetry(context.Background(), time.Second); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+	}
+}
+
+func TestConcurrentInit(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "init_test", CollectMetrics: true}
+	defer s.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Init(); err != nil {
+				t.Error("failed to initialize client: " + err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	n := s.Metrics().Latency.Count
+	s.Client.Ping(context.Background())
+	if m := s.Metrics(); m.Latency.Count != n+1 {
+		t.Errorf("hooks added more than once: %d observations", m.Latency.Count-n)
+	}
+	s = &Storage{Address: "127.0.0.1:1", Prefix: "init_test", DialTimeout: 10 * time.Millisecond, SkipPing: true}
+	defer s.Close()
+	if err := s.Init(); err != nil {
+		t.Errorf("Init without ping failed: %v", err)
+	}
+	if err := s.Visited(1); err == nil {
+		t.Error("Visited of an unreachable server succeeded")
+	}
+}
+
+func TestClearAsync(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "clear_async_test"}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	for i := uint64(0); i < 10; i++ {
+		s.Visited(i)
+	}
+	s.AddRequest([]byte("http://example.com"))
+	removed := 0
+	if err := <-s.ClearAsync(context.Background(), func(n int) { removed = n }); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+	}
+	if removed != 11 {
+		t.Errorf("%d keys reported removed, expected 11", removed)
+	}
+	if v, _ := s.IsVisited(1); v {
+		t.Error("request still visited after Clear")
+	}
+}
+
+func TestKeyScheme(t *testing.T) {
+	for _, keys := range []KeyScheme{KeyLayout{Separator: "/", ClassFirst: true}, HashedKeys{}} {
+		s := &Storage{Address: "127.0.0.1:6379", Prefix: "keys_test", Keys: keys}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		s.Visited(1)
+		s.AddRequest([]byte("http://example.com"))
+		u, _ := url.Parse("http://example.com")
+		s.SetCookies(u, "a=1")
+		if ok, _ := s.IsVisited(1); !ok {
+			t.Error("visit not found")
+		}
+		if c := s.Cookies(u); c != "a=1" {
+			t.Errorf("invalid cookies %q", c)
+		}
+		if st, _ := s.Stats(); st.Visited != 1 || st.QueueSize != 1 || st.CookieHosts != 1 {
+			t.Errorf("invalid stats %+v", st)
+		}
+		if c := s.KeyClass(s.getQueueID()); c != "queue" {
+			t.Errorf("invalid key class %q", c)
+		}
+		removed := 0
+		if err := s.ClearProgress(context.Background(), func(n int) { removed = n }); err != nil {
+			t.Error("failed to clear storage: " + err.Error())
+		}
+		if removed != 3 {
+			t.Errorf("%d keys removed, expected 3", removed)
+		}
+		s.Close()
+	}
+	s := &Storage{Prefix: "keys_test", Keys: KeyLayout{Separator: "/", ClassFirst: true}}
+	if k := s.getIDStr(1); k != "request/keys_test/1" {
+		t.Errorf("invalid key %q", k)
+	}
+	if k := (&Storage{Prefix: "keys_test"}).getProcessingID(); k != "keys_test:queue:processing:" {
+		t.Errorf("invalid key %q", k)
+	}
+	if k := s.KeyClass("keys_test:request:1"); k != "" {
+		t.Errorf("key of another scheme has class %q", k)
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	if err := (&Storage{Address: "127.0.0.1:6379", HashTag: true}).Init(); err != ErrHashTagPrefix {
+		t.Error("HashTag accepted without Prefix")
+	}
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "tag_test", HashTag: true}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	if k := s.getIDStr(1); k != "{tag_test}:request:1" {
+		t.Errorf("invalid key %q", k)
+	}
+	s.Visited(1)
+	s.AddRequest([]byte("http://example.com"))
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+	}
+	if n, _ := s.Client.Exists(context.Background(), s.getIDStr(1), s.getQueueID()).Result(); n != 0 {
+		t.Errorf("%d keys left after Clear", n)
+	}
+	h := &Storage{Prefix: "tag_test", HashTag: true, Keys: HashedKeys{}}
+	if k := h.getIDStr(1); !strings.HasPrefix(k, "{tag_test}") || len(k) != len("{tag_test}")+11+1 {
+		t.Errorf("invalid hashed key %q", k)
+	}
+}
+
+func TestRingClient(t *testing.T) {
+	// The shards are the databases 0 and 1 of the test server.
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "localhost:6379"},
+		NewClient: func(opt *redis.Options) *redis.Client {
+			if strings.HasPrefix(opt.Addr, "localhost") {
+				opt.DB = 1
+			}
+			return redis.NewClient(opt)
+		},
+	})
+	s := &Storage{Client: ring, Prefix: "ring_test", HashTag: true}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	for i := uint64(0); i < 10; i++ {
+		if err := s.Visited(i); err != nil {
+			t.Error("failed to store visit: " + err.Error())
+		}
+	}
+	if v, err := s.IsVisited(3); err != nil || !v {
+		t.Error("visit not found", err)
+	}
+	if err := (&Storage{Client: ring, WaitReplicas: 1}).Init(); err != ErrWaitCluster {
+		t.Error("WaitReplicas accepted on a ring")
+	}
+	// The shards are scanned concurrently, but the callback serially.
+	active, overlapped, scanned := 0, false, 0
+	err := s.scan(context.Background(), s.keyPattern("request"), func(keys []string) error {
+		active++
+		overlapped = overlapped || active > 1
+		time.Sleep(10 * time.Millisecond)
+		scanned += len(keys)
+		active--
+		return nil
+	})
+	if err != nil || overlapped || scanned != 10 {
+		t.Error("invalid scan", err, overlapped, scanned)
+	}
+	if st, err := s.Stats(); err != nil || st.Visited != 10 {
+		t.Error("invalid number of visits", st.Visited, err)
+	}
+	last, shrank := 0, false
+	err = s.ClearProgress(context.Background(), func(removed int) {
+		shrank = shrank || removed < last
+		last = removed
+	})
+	if err != nil || shrank || last != 10 {
+		t.Error("invalid progress of Clear", err, shrank, last)
+	}
+	if v, _ := s.IsVisited(3); v {
+		t.Error("visit left after Clear")
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "ns_test", VisitedCacheSize: 10}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	c := s.WithPrefix("sub")
+	if _, err := c.IsVisited(1); err != ErrNotInitialized {
+		t.Error("child used before Init", err)
+	}
+	if err := c.PrefetchCookies([]string{"example.com"}); err != ErrNotInitialized {
+		t.Error("child prefetched cookies before Init", err)
+	}
+	if k := s.WithPrefix("kv").getIDStr(1); k == s.getKVID("request:1") {
+		t.Errorf("key %q of the child collides with the parent", k)
+	}
+	if err := c.Init(); err != nil {
+		t.Error("failed to initialize child: " + err.Error())
+		return
+	}
+	if c.Client != s.Client {
+		t.Error("client not shared")
+	}
+	if k := c.getIDStr(1); k != "ns_test:ns:sub:request:1" {
+		t.Errorf("invalid key %q", k)
+	}
+	s.Visited(1)
+	if v, _ := c.IsVisited(1); v {
+		t.Error("visit of the parent found in the child")
+	}
+	c.Visited(2)
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+	}
+	if v, _ := c.IsVisited(2); !v {
+		t.Error("visit of the child removed by the parent")
+	}
+	if err := c.Clear(); err != nil {
+		t.Error("failed to clear child: " + err.Error())
+	}
+}
+
+func TestKV(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "kv_test"}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	if _, err := s.Get("checkpoint"); err != ErrNoValue {
+		t.Error("unexpected value", err)
+	}
+	if err := s.Set("checkpoint", []byte("page 3"), time.Minute); err != nil {
+		t.Error("failed to set value: " + err.Error())
+	}
+	if v, err := s.Get("checkpoint"); err != nil || string(v) != "page 3" {
+		t.Errorf("invalid value %q %v", v, err)
+	}
+	if err := s.Set("checkpoint", nil, -time.Second); err != ErrNegativeExpiration {
+		t.Error("negative expiration accepted")
+	}
+	s.Incr("results", 2)
+	if n, err := s.Incr("results", 3); err != nil || n != 5 {
+		t.Error("invalid counter", n, err)
+	}
+	if c := s.KeyClass(s.getKVID("results")); c != "kv" {
+		t.Errorf("invalid key class %q", c)
+	}
+	if n, err := s.Delete("checkpoint", "missing"); err != nil || n != 1 {
+		t.Error("invalid number of deleted values", n, err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+	}
+	if _, err := s.Get("results"); err != ErrNoValue {
+		t.Error("value left after Clear", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var names []string
+	logOps := func(next OpFunc) OpFunc {
+		return func(ctx context.Context, op *Op) error {
+			names = append(names, op.Name)
+			return next(ctx, op)
+		}
+	}
+	// The requests are stored in upper case and returned in lower case.
+	upper := func(next OpFunc) OpFunc {
+		return func(ctx context.Context, op *Op) error {
+			if op.Name == "AddRequest" {
+				op.Request = bytes.ToUpper(op.Request)
+			}
+			err := next(ctx, op)
+			if op.Name == "GetRequest" {
+				op.Request = bytes.ToLower(op.Request)
+			}
+			return err
+		}
+	}
+	errChaos := errors.New("chaos")
+	chaos := func(next OpFunc) OpFunc {
+		return func(ctx context.Context, op *Op) error {
+			if op.Name == "IsVisited" {
+				return errChaos
+			}
+			return next(ctx, op)
+		}
+	}
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "middleware_test", Middleware: []Middleware{logOps, upper, chaos}}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.Visited(1)
+	if _, err := s.IsVisited(1); err != errChaos {
+		t.Error("error of the middleware not returned", err)
+	}
+	s.AddRequest([]byte("http://example.com"))
+	if r, _ := s.Client.SRandMember(context.Background(), s.getQueueID()).Result(); r != "HTTP://EXAMPLE.COM" {
+		t.Errorf("request stored as %q", r)
+	}
+	if r, err := s.GetRequest(); err != nil || string(r) != "http://example.com" {
+		t.Errorf("invalid request %q %v", r, err)
+	}
+	if n, err := s.QueueSize(); err != nil || n != 0 {
+		t.Error("invalid queue size", n, err)
+	}
+	if got := strings.Join(names, ","); got != "Visited,IsVisited,AddRequest,GetRequest,QueueSize" {
+		t.Errorf("invalid operations %s", got)
+	}
+	names = nil
+	s.AddRequests([][]byte{[]byte("http://example.org")})
+	s.PeekRequests(1)
+	if rs, err := s.GetRequests(1); err == nil {
+		s.MoveToDLQ(rs[0])
+	}
+	s.ListDLQ(1)
+	s.DLQSize()
+	s.RequeueFromDLQ(1)
+	s.Set("checkpoint", []byte("1"), 0)
+	s.Get("checkpoint")
+	s.Incr("pages", 1)
+	s.Delete("checkpoint", "pages")
+	if l, err := s.Lock("sitemap", time.Second); err == nil {
+		l.Unlock()
+	}
+	want := "AddRequests,PeekRequests,GetRequests,MoveToDLQ,ListDLQ,DLQSize,RequeueFromDLQ,Set,Get,Incr,Delete,Lock"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("invalid operations %s", got)
+	}
+}
+
+func TestEventHooks(t *testing.T) {
+	var visited []uint64
+	var enqueued, dequeued []string
+	var failed []string
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "events_test",
+		OnVisited: func(id uint64) { visited = append(visited, id) },
+		OnEnqueue: func(r []byte) { enqueued = append(enqueued, string(r)) },
+		OnDequeue: func(r []byte) { dequeued = append(dequeued, string(r)) },
+		OnError:   func(op string, err error) { failed = append(failed, op) },
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.Visited(1)
+	s.VisitedWithTTL(2, time.Minute)
+	s.VisitedWithTTL(3, -time.Minute)
+	s.AddRequest([]byte("http://example.com"))
+	s.GetRequest()
+	s.GetRequest()
+	if len(visited) != 2 || visited[0] != 1 || visited[1] != 2 {
+		t.Error("invalid visits", visited)
+	}
+	if len(enqueued) != 1 || len(dequeued) != 1 || dequeued[0] != "http://example.com" {
+		t.Error("invalid requests", enqueued, dequeued)
+	}
+	if len(failed) != 1 || failed[0] != "VisitedWithTTL" {
+		t.Error("invalid errors", failed)
+	}
+	enqueued, dequeued = nil, nil
+	s.AddRequests([][]byte{[]byte("http://example.org"), []byte("http://example.net")})
+	if rs, err := s.GetRequests(2); err != nil || len(rs) != 2 {
+		t.Error("failed to get requests", rs, err)
+	}
+	if len(enqueued) != 2 || len(dequeued) != 2 {
+		t.Error("invalid batch requests", enqueued, dequeued)
+	}
+}
+
+func TestEventHooksBlocking(t *testing.T) {
+	var enqueued, dequeued []string
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "events_blocking_test",
+		QueueMode: QueueList,
+		OnEnqueue: func(r []byte) { enqueued = append(enqueued, string(r)) },
+		OnDequeue: func(r []byte) { dequeued = append(dequeued, string(r)) },
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.AddRequest([]byte("http://example.com"))
+	if r, err := s.GetRequestBlocking(time.Second); err != nil || string(r) != "http://example.com" {
+		t.Errorf("invalid request %q %v", r, err)
+	}
+	if len(enqueued) != 1 || len(dequeued) != 1 || dequeued[0] != "http://example.com" {
+		t.Error("invalid requests", enqueued, dequeued)
+	}
+}
+
+func TestEventHooksDeduplicate(t *testing.T) {
+	var enqueued []string
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "events_dedup_test",
+		Deduplicate: true,
+		OnEnqueue:   func(r []byte) { enqueued = append(enqueued, string(r)) },
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.AddRequest([]byte("http://example.com"))
+	s.AddRequest([]byte("http://example.com"))
+	s.AddRequests([][]byte{[]byte("http://example.com"), []byte("http://example.org")})
+	if ok, err := s.AddRequestIfNew(1, []byte("http://example.net")); err != nil || !ok {
+		t.Error("request not added", err)
+	}
+	if len(enqueued) != 3 {
+		t.Error("dropped requests passed to OnEnqueue", enqueued)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "codec_test"}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	type envelope struct {
+		URL   string
+		Depth int
+	}
+	if err := s.Enqueue(envelope{"http://example.com", 2}); err != nil {
+		t.Error("failed to enqueue value: " + err.Error())
+	}
+	var e envelope
+	if err := s.Dequeue(&e); err != nil || e.URL != "http://example.com" || e.Depth != 2 {
+		t.Error("invalid value", e, err)
+	}
+	if err := s.Dequeue(&e); err != ErrQueueEmpty {
+		t.Error("value dequeued from an empty queue", err)
+	}
+	s.Codec = Raw
+	if err := s.Enqueue(e); err == nil {
+		t.Error("Raw encoded a struct")
+	}
+	s.Enqueue("http://example.org")
+	var r string
+	if err := s.Dequeue(&r); err != nil || r != "http://example.org" {
+		t.Errorf("invalid value %q %v", r, err)
+	}
+}
+
+func TestItems(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "items_test", QueueMode: QueuePriority, DelayedRequests: true}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.AddItem(Item{Payload: []byte("low"), Priority: 2})
+	s.AddItem(Item{Payload: []byte("high"), Priority: 1, Attempts: 3})
+	s.AddItem(Item{Payload: []byte("later"), NotBefore: time.Now().Add(time.Hour)})
+	s.AddRequestWithPriority([]byte("raw"), 3)
+	it, err := s.GetItem()
+	if err != nil || string(it.Payload) != "high" || it.Attempts != 3 || it.Priority != 1 {
+		t.Error("invalid item", it, err)
+		return
+	}
+	if w := it.Wait(time.Now()); w < 0 || w > time.Minute {
+		t.Error("invalid wait", w)
+	}
+	if it, _ := s.GetItem(); it == nil || string(it.Payload) != "low" {
+		t.Error("invalid item", it)
+	}
+	if it, _ := s.GetItem(); it == nil || string(it.Payload) != "raw" || !it.Enqueued.IsZero() {
+		t.Error("invalid raw item", it)
+	}
+	if _, err := s.GetItem(); err != ErrQueueEmpty {
+		t.Error("delayed item returned", err)
+	}
+	if n, _ := s.DelayedSize(); n != 1 {
+		t.Error("item not delayed")
+	}
+}
+
+func TestLock(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "lock_test"}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	l, err := s.Lock("sitemap", time.Second)
+	if err != nil {
+		t.Error("failed to acquire lock: " + err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.LockCtx(ctx, "sitemap", time.Second); err != context.DeadlineExceeded {
+		t.Error("lock acquired twice", err)
+	}
+	if err := l.Extend(time.Minute); err != nil {
+		t.Error("failed to extend lock: " + err.Error())
+	}
+	if err := l.Unlock(); err != nil {
+		t.Error("failed to release lock: " + err.Error())
+	}
+	if err := l.Unlock(); err != ErrLockNotHeld {
+		t.Error("lock released twice", err)
+	}
+	if _, err := s.Lock("seeds", 0); err != ErrLockTTL {
+		t.Error("lock without ttl acquired")
+	}
+	l, err = s.Lock("sitemap", time.Second)
+	if err != nil {
+		t.Error("failed to acquire released lock: " + err.Error())
+		return
+	}
+	// PEXPIRE 0 would delete the held lock.
+	if err := l.Extend(time.Microsecond); !errors.Is(err, ErrLockTTL) {
+		t.Error("lock extended by less than a millisecond", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Error("lock not held after rejected Extend", err)
+	}
+}
+
+func TestControl(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "control_test", Control: true}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	if err := s.Publish("restart"); err != ErrUnknownSignal {
+		t.Error("unknown signal published", err)
+	}
+	s.AddRequest([]byte("http://example.com"))
+	s.Publish(SignalPause)
+	waitFor := func(sig Signal) {
+		for i := 0; i < 100 && s.ControlState() != sig; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(SignalPause)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetRequestCtx(ctx); err != context.DeadlineExceeded {
+		t.Error("request returned while paused", err)
+	}
+	// A storage initialized later follows the stored signal.
+	other := &Storage{Address: "127.0.0.1:6379", Prefix: "control_test", Control: true}
+	if err := other.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer other.Close()
+	if sig := other.ControlState(); sig != SignalPause {
+		t.Errorf("invalid state %q", sig)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.GetRequest()
+		done <- err
+	}()
+	s.Publish(SignalResume)
+	if err := <-done; err != nil {
+		t.Error("failed to get request after resume: " + err.Error())
+	}
+	s.AddRequest([]byte("http://example.com"))
+	s.Publish(SignalStop)
+	waitFor(SignalStop)
+	if _, err := s.GetRequest(); err != ErrStopped {
+		t.Error("request returned after stop", err)
+	}
+	if n, _ := s.QueueSize(); n != 0 {
+		t.Error("queue size reported after stop", n)
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "kill_test", KillSwitch: true}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	s.AddRequest([]byte("http://example.com"))
+	if err := s.SetKillSwitch(true); err != nil {
+		t.Error("failed to set kill switch: " + err.Error())
+	}
+	if _, err := s.GetRequest(); err != ErrKilled {
+		t.Error("request returned while killed", err)
+	}
+	if n, _ := s.QueueSize(); n != 0 {
+		t.Error("queue size reported while killed", n)
+	}
+	// The capacity is still enforced.
+	s.MaxQueueSize = 1
+	if err := s.AddRequests([][]byte{[]byte("http://example.org")}); err != ErrQueueFull {
+		t.Error("queue exceeded MaxQueueSize while killed", err)
+	}
+	s.MaxQueueSize = 0
+	// A restarted worker finds the switch set.
+	other := &Storage{Address: "127.0.0.1:6379", Prefix: "kill_test", KillSwitch: true}
+	if err := other.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer other.Close()
+	if killed, err := other.IsKilled(); err != nil || !killed {
+		t.Error("kill switch not found", err)
+	}
+	if _, err := other.GetRequest(); err != ErrKilled {
+		t.Error("request returned while killed", err)
+	}
+	s.SetKillSwitch(false)
+	if killed, _ := other.IsKilled(); !killed {
+		t.Error("kill switch not cached")
+	}
+	if r, err := s.GetRequest(); err != nil || string(r) != "http://example.com" {
+		t.Errorf("invalid request %q %v", r, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "config_test"}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	if _, err := s.GetConfig("delay"); err != ErrNoValue {
+		t.Error("unexpected parameter", err)
+	}
+	s.SetConfig("delay", "1s")
+	s.SetConfig("concurrency", "4")
+	if v, err := s.GetConfig("delay"); err != nil || v != "1s" {
+		t.Errorf("invalid parameter %q %v", v, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchConfig(ctx, func(name, value string) {
+			changes <- name + "=" + value
+		})
+	}()
+	var got []string
+	for len(got) < 2 {
+		got = append(got, <-changes)
+	}
+	s.SetConfig("delay", "2s")
+	got = append(got, <-changes)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("invalid error of WatchConfig", err)
+	}
+	if strings.Join(got, ",") != "concurrency=4,delay=1s,delay=2s" {
+		t.Error("invalid changes", got)
+	}
+}
+
+func TestShardedStorage(t *testing.T) {
+	if _, err := NewShardedStorage(); err == nil {
+		t.Error("storage without shards accepted")
+	}
+	a := &Storage{Address: "127.0.0.1:6379", Prefix: "sharded_test"}
+	b := &Storage{Address: "127.0.0.1:6379", Prefix: "sharded_test", DB: 1}
+	sh, _ := NewShardedStorage(a, b)
+	if err := sh.Init(); err != nil {
+		t.Error("failed to initialize shards: " + err.Error())
+		return
+	}
+	defer sh.Close()
+	defer sh.Clear()
+	for i := uint64(0); i < 20; i++ {
+		sh.Visited(i)
+	}
+	sa, _ := a.Stats()
+	sb, _ := b.Stats()
+	na, nb := sa.Visited, sb.Visited
+	if na+nb != 20 || na == 0 || nb == 0 {
+		t.Errorf("visits not spread over the shards: %d and %d", na, nb)
+	}
+	for i := uint64(0); i < 20; i++ {
+		if ok, _ := sh.IsVisited(i); !ok {
+			t.Errorf("visit %d not found", i)
+		}
+	}
+	u, _ := url.Parse("http://example.com")
+	sh.SetCookies(u, "a=1")
+	if c := sh.Cookies(u); c != "a=1" {
+		t.Errorf("invalid cookies %q", c)
+	}
+	for _, h := range []string{"a.com", "b.com", "c.com", "d.com", "e.com"} {
+		sh.AddRequest([]byte("http://" + h + "/"))
+	}
+	if n, _ := sh.QueueSize(); n != 5 {
+		t.Errorf("queue size is %d, expected 5", n)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sh.GetRequest(); err != nil {
+			t.Error("failed to get request: " + err.Error())
+		}
+	}
+	if _, err := sh.GetRequest(); err != ErrQueueEmpty {
+		t.Error("request returned from empty shards")
+	}
+	for key := uint64(0); key < 1000; key++ {
+		if n := jumpHash(key, 3); n != jumpHash(key, 2) && n != 2 {
+			t.Errorf("key %d moved between kept shards", key)
+		}
+	}
+}
+
+func TestSubStores(t *testing.T) {
+	cookies := &MemoryCookies{}
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "substores_test",
+		CookieStore:  cookies,
+		VisitedStore: &MemoryVisited{},
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	s.SetCookies(u, "a=1")
+	if c := cookies.Cookies(u); c != "a=1" {
+		t.Errorf("cookies not set in the cookie store: %q", c)
+	}
+	if c := s.Cookies(u); c != "a=1" {
+		t.Errorf("invalid cookies %q", c)
+	}
+	s.Visited(1)
+	if ok, _ := s.IsVisited(1); !ok {
+		t.Error("visit not found")
+	}
+	s.AddRequest([]byte("http://example.com"))
+	if n, _ := s.Client.Exists(context.Background(), s.getCookieID(u.Host), s.getIDStr(1), s.getQueueID()).Result(); n != 1 {
+		t.Errorf("%d keys in redis, expected only the queue", n)
+	}
+	q := &Storage{Address: "127.0.0.1:6379", Prefix: "substores_test", QueueStore: &MemoryQueue{}}
+	if err := q.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer q.Close()
+	q.AddRequest([]byte("r1"))
+	q.AddRequest([]byte("r2"))
+	if n, _ := q.QueueSize(); n != 2 {
+		t.Errorf("queue size is %d, expected 2", n)
+	}
+	if r, _ := q.GetRequest(); string(r) != "r1" {
+		t.Errorf("invalid request %q", r)
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	s, err := NewStorage("127.0.0.1:6379", WithPrefix("new_test"), WithExpiration(time.Minute))
+	if err != nil {
+		t.Error("failed to create storage: " + err.Error())
+		return
+	}
+	defer s.Close()
+	if s.Prefix != "new_test" || s.Expires != time.Minute {
+		t.Error("options not applied")
+	}
+	if _, err := NewStorage(""); err == nil {
+		t.Error("empty address accepted")
+	}
+	if _, err := NewStorage("127.0.0.1:6379", WithExpiration(-time.Second)); err == nil {
+		t.Error("negative expiration accepted")
+	}
+}
+
+func TestClear(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "clear_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	other := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "clear_test_other",
+	}
+	if err := other.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer other.Clear()
+	// More keys than one SCAN batch.
+	for i := uint64(0); i < 2*scanBatch+1; i++ {
+		if err := s.Visited(i); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	if err := s.AddRequest([]byte("http://example.com")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if err := other.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+		return
+	}
+	for _, i := range []uint64{0, scanBatch, 2 * scanBatch} {
+		if v, _ := s.IsVisited(i); v {
+			t.Errorf("request %d still visited after Clear", i)
+		}
+	}
+	if size, _ := s.QueueSize(); size != 0 {
+		t.Error("queue not empty after Clear")
+	}
+	if v, _ := other.IsVisited(1); !v {
+		t.Error("Clear removed keys of another prefix")
+	}
+}
+
+func TestVisitedExpires(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "expires_test",
+		Expires: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	ttl, err := s.Client.TTL(context.Background(), s.getIDStr(1)).Result()
+	if err != nil {
+		t.Error("failed to get TTL: " + err.Error())
+		return
+	}
+	if ttl <= 0 || ttl > time.Minute {
+		t.Errorf("visit has TTL %s instead of %s", ttl, time.Minute)
+	}
+}
+
+func TestIsVisitedBatch(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "batch_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, id := range []uint64{1, 3} {
+		if err := s.Visited(id); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	visited, err := s.IsVisitedBatch([]uint64{1, 2, 3})
+	if err != nil {
+		t.Error("failed to check visits: " + err.Error())
+		return
+	}
+	if len(visited) != 3 || !visited[0] || visited[1] || !visited[2] {
+		t.Errorf("invalid visits: %v", visited)
+	}
+}
+
+func TestVisitedCache(t *testing.T) {
+	s := &Storage{
+		Address:          "127.0.0.1:6379",
+		Prefix:           "cache_test",
+		VisitedCacheSize: 2,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, id := range []uint64{1, 2, 3} {
+		if err := s.Visited(id); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	// Remove the visits behind the back of the cache.
+	if err := s.Client.Del(context.Background(), s.getIDStr(1), s.getIDStr(3)).Err(); err != nil {
+		t.Error("failed to delete visits: " + err.Error())
+		return
+	}
+	if v, _ := s.IsVisited(3); !v {
+		t.Error("cached visit not returned")
+	}
+	if v, _ := s.IsVisited(1); v {
+		t.Error("evicted visit returned")
+	}
+	visited, err := s.IsVisitedBatch([]uint64{2, 3, 4})
+	if err != nil {
+		t.Error("failed to check visits: " + err.Error())
+		return
+	}
+	if !visited[0] || !visited[1] || visited[2] {
+		t.Errorf("invalid visits: %v", visited)
+	}
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+		return
+	}
+	if v, _ := s.IsVisited(3); v {
+		t.Error("Clear did not purge the cache")
+	}
+}
+
+func TestVisitedBloom(t *testing.T) {
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "bloom_test",
+		VisitedMode: VisitedBloom,
+		Deduplicate: true,
+	}
+	// Servers without RedisBloom fall back to VisitedKeys.
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	visited, err := s.IsVisitedBatch([]uint64{1, 2})
+	if err != nil {
+		t.Error("failed to check visits: " + err.Error())
+		return
+	}
+	if !visited[0] || visited[1] {
+		t.Errorf("invalid visits: %v", visited)
+	}
+	if err := s.Visited(RequestID([]byte("http://example.com/"))); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if err := s.AddRequest([]byte("http://example.com/")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+		return
+	}
+	if size, _ := s.QueueSize(); size != 0 {
+		t.Error("visited request was queued")
+	}
+}
+
+func TestVisitedCountApprox(t *testing.T) {
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "count_test",
+		CountVisits: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, id := range []uint64{1, 2, 3, 2} {
+		if err := s.Visited(id); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	n, err := s.VisitedCountApprox()
+	if err != nil {
+		t.Error("failed to count visits: " + err.Error())
+		return
+	}
+	if n != 3 {
+		t.Errorf("counted %d visits instead of 3", n)
+	}
+	if err := s.Clear(); err != nil {
+		t.Error("failed to clear storage: " + err.Error())
+		return
+	}
+	if n, _ := s.VisitedCountApprox(); n != 0 {
+		t.Error("Clear did not reset the visit count")
+	}
+}
+
+func TestDomainVisitLimit(t *testing.T) {
+	s := &Storage{
+		Address:          "127.0.0.1:6379",
+		Prefix:           "domain_test",
+		Expires:          time.Minute,
+		DomainVisitLimit: 2,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for i := 0; i < 2; i++ {
+		if err := s.VisitDomain("example.com"); err != nil {
+			t.Error("failed to visit domain: " + err.Error())
+			return
+		}
+	}
+	if err := s.VisitDomain("example.com"); err != ErrVisitLimitReached {
+		t.Error("visit over the limit did not return ErrVisitLimitReached")
+	}
+	if err := s.VisitDomain("example.org"); err != nil {
+		t.Error("limit of another domain reached: " + err.Error())
+	}
+	if n, _ := s.DomainVisits("example.com"); n != 2 {
+		t.Errorf("counted %d visits instead of 2", n)
+	}
+	ttl, _ := s.Client.TTL(context.Background(), s.getDomainID("example.com")).Result()
+	if ttl <= 0 {
+		t.Error("domain counter has no TTL")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "ratelimit_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if _, err := s.RateLimiter(0, time.Second); err == nil {
+		t.Error("zero limit accepted")
+	}
+	if _, err := s.RateLimiter(2, 0); err == nil {
+		t.Error("zero window accepted")
+	}
+	l, err := s.RateLimiter(2, 300*time.Millisecond)
+	if err != nil {
+		t.Error("failed to create rate limiter: " + err.Error())
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if ok, err := l.Allow("example.com"); err != nil || !ok {
+			t.Errorf("request %d not allowed: %v", i, err)
+			return
+		}
+	}
+	if ok, _ := l.Allow("example.com"); ok {
+		t.Error("request over the limit allowed")
+	}
+	if ok, _ := l.Allow("example.org"); !ok {
+		t.Error("request of another host not allowed")
+	}
+	start := time.Now()
+	if err := l.Wait("example.com"); err != nil {
+		t.Error("failed to wait: " + err.Error())
+		return
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Wait returned before the window passed")
+	}
+}
+
+func TestRemoveVisited(t *testing.T) {
+	s := &Storage{
+		Address:          "127.0.0.1:6379",
+		Prefix:           "remove_test",
+		VisitedCacheSize: 10,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if err := s.RemoveVisited(1); err != nil {
+		t.Error("failed to remove visit: " + err.Error())
+		return
+	}
+	if v, _ := s.IsVisited(1); v {
+		t.Error("removed visit still visited")
+	}
+}
+
+func TestIterateVisited(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "iterate_test",
+		Expires: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, id := range []uint64{1, 2, 3} {
+		if err := s.Visited(id); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	seen := map[uint64]bool{}
+	err := s.IterateVisited(func(id uint64, count int, ttl time.Duration) bool {
+		if count != 1 || ttl <= 0 || ttl > time.Minute {
+			t.Errorf("invalid visit %d: count %d, ttl %s", id, count, ttl)
+		}
+		seen[id] = true
+		return true
+	})
+	if err != nil {
+		t.Error("failed to iterate visits: " + err.Error())
+		return
+	}
+	if len(seen) != 3 || !seen[1] || !seen[2] || !seen[3] {
+		t.Errorf("invalid visits: %v", seen)
+	}
+	n := 0
+	s.IterateVisited(func(uint64, int, time.Duration) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Error("iteration did not stop")
+	}
+}
+
+func TestExportVisited(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "export_test",
+		Expires: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for _, id := range []uint64{1, 2} {
+		if err := s.Visited(id); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := s.ExportVisited(&buf); err != nil {
+		t.Error("failed to export visits: " + err.Error())
+		return
+	}
+	d := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "import_test",
+	}
+	if err := d.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer d.Clear()
+	if err := d.ImportVisited(strings.NewReader(buf.String() + "3 0\n")); err != nil {
+		t.Error("failed to import visits: " + err.Error())
+		return
+	}
+	visited, _ := d.IsVisitedBatch([]uint64{1, 2, 3, 4})
+	if !visited[0] || !visited[1] || !visited[2] || visited[3] {
+		t.Errorf("invalid visits: %v", visited)
+	}
+	if ttl, _ := d.Client.TTL(context.Background(), d.getIDStr(1)).Result(); ttl <= 0 {
+		t.Error("imported visit lost its TTL")
+	}
+	if err := d.ImportVisited(strings.NewReader("x 0\n")); err == nil {
+		t.Error("invalid visit accepted")
+	}
+}
+
+func TestSeedVisited(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "seed_test",
+		Expires: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	ids := make([]uint64, 2500)
+	for i := range ids {
+		ids[i] = uint64(i)
+	}
+	if err := s.SeedVisited(ids); err != nil {
+		t.Error("failed to seed visits: " + err.Error())
+		return
+	}
+	visited, _ := s.IsVisitedBatch([]uint64{0, 1500, 2499, 2500})
+	if !visited[0] || !visited[1] || !visited[2] || visited[3] {
+		t.Errorf("invalid visits: %v", visited)
+	}
+	if ttl, _ := s.Client.TTL(context.Background(), s.getIDStr(2499)).Result(); ttl <= 0 {
+		t.Error("seeded visit has no TTL")
+	}
+}
+
+func TestNeverExpire(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "never_test",
+		Expires: NeverExpire,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if ttl, _ := s.Client.TTL(context.Background(), s.getIDStr(1)).Result(); ttl != -1 {
+		t.Errorf("visit has TTL %s instead of none", ttl)
+	}
+	n := &Storage{
+		Address: "127.0.0.1:6379",
+		Expires: -time.Second,
+	}
+	if err := n.Init(); err == nil {
+		t.Error("negative expiration accepted")
+	}
+}
+
+func TestVisitedKeepsWindow(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "window_test",
+		Expires: time.Hour,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	ctx := context.Background()
+	s.Client.Expire(ctx, s.getIDStr(1), time.Minute)
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if ttl, _ := s.Client.TTL(ctx, s.getIDStr(1)).Result(); ttl > time.Minute {
+		t.Error("repeated visit reset the TTL")
+	}
+}
+
+func TestTTLs(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "ttl_test",
+		Expires:      time.Hour,
+		VisitedTTL:   time.Minute,
+		CookieTTL:    time.Minute,
+		QueueItemTTL: time.Minute,
+		QueueMode:    QueueList,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	s.Visited(1)
+	s.SetCookies(u, "a=b")
+	s.AddRequest([]byte("http://example.com"))
+	ctx := context.Background()
+	for _, k := range []string{s.getIDStr(1), s.getCookieID(u.Host), s.getQueueID()} {
+		if ttl, _ := s.Client.TTL(ctx, k).Result(); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("key %s has TTL %s instead of %s", k, ttl, time.Minute)
+		}
+	}
+}
+
+func TestVisitedWithTTL(t *testing.T) {
+	s := &Storage{
+		Address:    "127.0.0.1:6379",
+		Prefix:     "customttl_test",
+		VisitedTTL: time.Hour,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.VisitedWithTTL(1, time.Minute); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if ttl, _ := s.Client.TTL(context.Background(), s.getIDStr(1)).Result(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("visit has TTL %s instead of %s", ttl, time.Minute)
+	}
+	if err := s.VisitedWithTTL(2, -time.Minute); err == nil {
+		t.Error("negative TTL accepted")
+	}
+}
+
+func TestVisitTTL(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "visitttl_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.VisitedWithTTL(1, time.Minute)
+	s.VisitedWithTTL(2, NeverExpire)
+	if ttl, err := s.VisitTTL(1); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("visit has TTL %s instead of %s: %v", ttl, time.Minute, err)
+	}
+	if ttl, _ := s.VisitTTL(2); ttl >= 0 {
+		t.Error("permanent visit has no negative TTL")
+	}
+	if ttl, _ := s.VisitTTL(3); ttl != 0 {
+		t.Error("unvisited request has a TTL")
+	}
+}
+
+func TestVisitInfo(t *testing.T) {
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "info_test",
+		VisitedTTL:     time.Minute,
+		RecordMetadata: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	start := time.Now().Add(-time.Second)
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+		return
+	}
+	if err := s.SetVisitInfo(1, 200, 1234); err != nil {
+		t.Error("failed to set visit info: " + err.Error())
+		return
+	}
+	info, err := s.GetVisitInfo(1)
+	if err != nil || info == nil {
+		t.Errorf("failed to get visit info: %v", err)
+		return
+	}
+	if info.Time.Before(start) || info.Status != 200 || info.Size != 1234 {
+		t.Errorf("invalid visit info: %+v", info)
+	}
+	if ttl, _ := s.Client.TTL(context.Background(), s.getVisitInfoID(1)).Result(); ttl <= 0 {
+		t.Error("visit info has no TTL")
+	}
+	if info, _ := s.GetVisitInfo(2); info != nil {
+		t.Error("info of unvisited request returned")
+	}
+}
+
+func TestVisitsInWindow(t *testing.T) {
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "window_count_test",
+		VisitWindow: time.Hour,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	for i := 0; i < 3; i++ {
+		if err := s.Visited(1); err != nil {
+			t.Error("failed to mark visited: " + err.Error())
+			return
+		}
+	}
+	if n, err := s.VisitsInWindow(1, time.Minute); err != nil || n != 3 {
+		t.Errorf("counted %d visits instead of 3: %v", n, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n, _ := s.VisitsInWindow(1, 10*time.Millisecond); n != 0 {
+		t.Errorf("counted %d visits outside the window", n)
+	}
+}
+
+func TestCookiesE(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "cookies_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	u, _ := url.Parse("http://example.com")
+	if err := s.SetCookiesE(u, "a=b"); err != nil {
+		t.Error("failed to set cookies: " + err.Error())
+		return
+	}
+	if c, err := s.CookiesE(u); err != nil || c != "a=b" {
+		t.Errorf("got cookies %q instead of %q: %v", c, "a=b", err)
+	}
+	s.Clear()
+	s.Close()
+	if _, err := s.CookiesE(u); err != ErrClosed {
+		t.Error("CookiesE after Close did not return ErrClosed")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "jar_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	var jar http.CookieJar = s.CookieJar()
+	u, _ := url.Parse("https://www.example.com/a/b")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Path: "/", Secure: true},
+		{Name: "expired", Value: "4", MaxAge: -1},
+		{Name: "foreign", Value: "5", Domain: "example.org"},
+		{Name: "tld", Value: "6", Domain: "com"},
+	})
+	names := func(u string) string {
+		p, _ := url.Parse(u)
+		var ns []string
+		for _, c := range jar.Cookies(p) {
+			ns = append(ns, c.Name+"="+c.Value)
+		}
+		return strings.Join(ns, ";")
+	}
+	if c := names("https://www.example.com/a/c"); c != "host=1;domain=2;secure=3" {
+		t.Errorf("invalid cookies %q", c)
+	}
+	if c := names("http://www.example.com/"); c != "domain=2" {
+		t.Errorf("invalid insecure cookies %q", c)
+	}
+	if c := names("https://api.example.com/a/"); c != "domain=2" {
+		t.Errorf("invalid subdomain cookies %q", c)
+	}
+	if c := names("https://example.org/"); c != "" {
+		t.Errorf("foreign cookies %q", c)
+	}
+	jar.SetCookies(u, []*http.Cookie{{Name: "domain", Domain: "example.com", Path: "/", MaxAge: -1}})
+	if c := names("https://api.example.com/"); c != "" {
+		t.Errorf("deleted cookie returned: %q", c)
+	}
+}
+
+func TestCookieExpiration(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "cookie_expiration_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	s.SetCookies(u, "a=1; Max-Age=60\nb=2; Max-Age=30\nc=3; Expires=Thu, 01 Jan 1970 00:00:00 GMT")
+	c := s.Cookies(u)
+	if !strings.HasPrefix(c, "a=1; Expires=") || !strings.Contains(c, "\nb=2; Expires=") || strings.Contains(c, "c=3") {
+		t.Errorf("invalid cookies %q", c)
+	}
+	ttl, _ := s.Client.TTL(context.Background(), s.getCookieID(u.Host)).Result()
+	if ttl <= 30*time.Second || ttl > 61*time.Second {
+		t.Errorf("cookies have TTL %s instead of a minute", ttl)
+	}
+	s.SetCookies(u, "a=1\nb=2; Max-Age=30")
+	if ttl, _ := s.Client.TTL(context.Background(), s.getCookieID(u.Host)).Result(); ttl != -1 {
+		t.Error("session cookies expire")
+	}
+	s.SetCookies(u, "c=3; Max-Age=-1")
+	if c := s.Cookies(u); c != "" {
+		t.Errorf("expired cookies returned: %q", c)
+	}
+}
+
+func TestCookieEncryption(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "crypt_test",
+		CookieKey: bytes.Repeat([]byte{1}, 32),
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("https://example.com")
+	if err := s.SetCookiesE(u, "session=secret"); err != nil {
+		t.Error("failed to set cookies: " + err.Error())
+		return
+	}
+	s.CookieJar().SetCookies(u, []*http.Cookie{{Name: "jar", Value: "secret"}})
+	ctx := context.Background()
+	raw, _ := s.Client.Get(ctx, s.getCookieID(u.Host)).Result()
+	jar, _ := s.Client.HGetAll(ctx, s.getJarID(u.Host)).Result()
+	for _, v := range append([]string{raw}, jar["/;jar"]) {
+		if v == "" || strings.Contains(v, "secret") {
+			t.Errorf("cookies stored in plain text: %q", v)
+		}
+	}
+	if c, err := s.CookiesE(u); err != nil || c != "session=secret" {
+		t.Errorf("got cookies %q instead of %q: %v", c, "session=secret", err)
+	}
+	if cs := s.CookieJar().Cookies(u); len(cs) != 1 || cs[0].Value != "secret" {
+		t.Errorf("invalid jar cookies %v", cs)
+	}
+	other, _ := url.Parse("https://example.org")
+	s.Client.Set(ctx, s.getCookieID(other.Host), raw, 0)
+	if c, err := s.CookiesE(other); err == nil {
+		t.Errorf("cookies of another host decrypted: %q", c)
+	}
+	if err := (&Storage{Address: "127.0.0.1:6379", CookieKey: []byte("short")}).Init(); err == nil {
+		t.Error("invalid key accepted")
+	}
+}
+
+func TestCookieLock(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "cookie_lock_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	unlock, err := s.lock(context.Background(), s.getCookieLockID(u.Host), time.Minute)
+	if err != nil {
+		t.Error("failed to lock: " + err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.SetCookiesECtx(ctx, u, "a=b"); err != context.DeadlineExceeded {
+		t.Errorf("locked cookies were set: %v", err)
+	}
+	unlock()
+	if err := s.SetCookiesE(u, "a=b"); err != nil {
+		t.Error("failed to set cookies: " + err.Error())
+	}
+}
+
+func TestMergeCookies(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "merge_test",
+		MergeCookies: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	s.SetCookies(u, "a=1\nb=2")
+	s.SetCookies(u, "b=3\nc=4")
+	if c := s.Cookies(u); c != "a=1\nb=3\nc=4" {
+		t.Errorf("invalid merged cookies %q", c)
+	}
+	s.SetCookies(u, "a=; Max-Age=-1")
+	if c := s.Cookies(u); c != "b=3\nc=4" {
+		t.Errorf("expired cookie not removed: %q", c)
+	}
+}
+
+func TestHashCookies(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "hash_cookies_test",
+		MergeCookies: true,
+		HashCookies:  true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	s.SetCookies(u, "b=2\na=1")
+	s.SetCookies(u, "b=3\nc=4")
+	if c := s.Cookies(u); c != "a=1\nb=3\nc=4" {
+		t.Errorf("invalid merged cookies %q", c)
+	}
+	if v, _ := s.Client.HGet(context.Background(), s.getCookieID(u.Host), "b").Result(); v != "b=3" {
+		t.Errorf("invalid cookie field %q", v)
+	}
+	s.SetCookies(u, "a=; Max-Age=-1")
+	if c := s.Cookies(u); c != "b=3\nc=4" {
+		t.Errorf("expired cookie not removed: %q", c)
+	}
+	s.Client.HSet(context.Background(), s.getCookieID(u.Host), "e", "e=6; Expires=Mon, 01 Jan 2001 00:00:00 GMT")
+	s.SetCookies(u, "b=4")
+	if ok, _ := s.Client.HExists(context.Background(), s.getCookieID(u.Host), "e").Result(); ok {
+		t.Error("expired cookie field not deleted")
+	}
+	if c := s.Cookies(u); c != "b=4\nc=4" {
+		t.Errorf("invalid merged cookies %q", c)
+	}
+	s.MergeCookies = false
+	s.SetCookies(u, "d=5")
+	if c := s.Cookies(u); c != "d=5" {
+		t.Errorf("cookies not replaced: %q", c)
+	}
+}
+
+func TestHTTPCookies(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "http_cookies_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	u, _ := url.Parse("http://example.com")
+	err := s.SetHTTPCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2", HttpOnly: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Cookies(u); c != "a=1; Path=/\nb=2; HttpOnly" {
+		t.Errorf("invalid serialized cookies %q", c)
+	}
+	cookies, err := s.GetHTTPCookies(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 2 || cookies[0].Name != "a" || cookies[0].Path != "/" || !cookies[1].HttpOnly {
+		t.Errorf("invalid cookies %v", cookies)
+	}
+}
+
+func TestParentDomainCookies(t *testing.T) {
+	s := &Storage{
+		Address:             "127.0.0.1:6379",
+		Prefix:              "parent_cookies_test",
+		ParentDomainCookies: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	parent, _ := url.Parse("http://example.com")
+	s.SetCookies(parent, "a=1; Domain=example.com\nb=2\nc=3; Domain=example.com")
+	u, _ := url.Parse("http://shop.example.com")
+	s.SetCookies(u, "c=4")
+	if c := s.Cookies(u); c != "c=4\na=1; Domain=example.com" {
+		t.Errorf("invalid cookies %q", c)
+	}
+	other, _ := url.Parse("http://shop.example.org")
+	if c := s.Cookies(other); c != "" {
+		t.Errorf("cookies of unrelated domain returned: %q", c)
+	}
+}
+
+func TestPrefetchCookies(t *testing.T) {
+	s := &Storage{
+		Address:           "127.0.0.1:6379",
+		Prefix:            "prefetch_cookies_test",
+		CookiePrefetchTTL: time.Minute,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	a, _ := url.Parse("http://a.example.com")
+	b, _ := url.Parse("http://b.example.com")
+	s.SetCookies(a, "a=1")
+	if err := s.PrefetchCookies([]string{a.Host, b.Host}); err != nil {
+		t.Fatal(err)
+	}
+	// Changes by other processes are not noticed while prefetched.
+	s.Client.Set(context.Background(), s.getCookieID(a.Host), "a=2", 0)
+	s.Client.Set(context.Background(), s.getCookieID(b.Host), "b=2", 0)
+	if c := s.Cookies(a); c != "a=1" {
+		t.Errorf("prefetched cookies not used: %q", c)
+	}
+	if c := s.Cookies(b); c != "" {
+		t.Errorf("prefetched missing cookies not used: %q", c)
+	}
+	s.SetCookies(b, "b=3")
+	if c := s.Cookies(b); c != "b=3" {
+		t.Errorf("set cookies not returned: %q", c)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "metrics_test",
+		CollectMetrics: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.Visited(1)
+	s.IsVisited(1)
+	s.IsVisitedBatch([]uint64{1, 2, 3})
+	s.AddRequests([][]byte{[]byte("http://example.com/1"), []byte("http://example.com/2")})
+	s.GetRequest()
+	m := s.Metrics()
+	if m.VisitedMarks != 1 || m.VisitedHits != 2 || m.VisitedMisses != 2 {
+		t.Errorf("invalid visit counters %+v", m)
+	}
+	if m.QueueAdds != 2 || m.QueuePops != 1 {
+		t.Errorf("invalid queue counters %+v", m)
+	}
+	if m.Latency.Count == 0 || m.Latency.Counts[len(m.Latency.Counts)-1] != m.Latency.Count {
+		t.Errorf("invalid latency histogram %+v", m.Latency)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := &Storage{
+		Address:   "127.0.0.1:6379",
+		Prefix:    "stats_test",
+		QueueMode: QueueReliable,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.Visited(1)
+	s.Visited(2)
+	s.AddRequests([][]byte{[]byte("http://example.com/1"), []byte("http://example.com/2")})
+	s.GetRequest()
+	u, _ := url.Parse("http://example.com")
+	s.SetCookies(u, "a=1")
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Visited != 2 || st.QueueSize != 1 || st.InFlight != 1 || st.CookieHosts != 1 {
+		t.Errorf("invalid stats %+v", st)
+	}
+	if st.LastError != nil {
+		t.Errorf("unexpected error %v", st.LastError)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "healthy_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	latency, err := s.Healthy(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 {
+		t.Errorf("invalid latency %s", latency)
+	}
+	s.Clear()
+	s.Close()
+	if _, err := s.Healthy(context.Background()); err != ErrClosed {
+		t.Errorf("closed storage reported healthy: %v", err)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "pool_stats_test",
+	}
+	if s.PoolStats() != nil {
+		t.Error("pool stats before Init")
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.IsVisited(1)
+	if p := s.PoolStats(); p == nil || p.TotalConns == 0 {
+		t.Errorf("invalid pool stats %+v", p)
+	}
+}
+
+func TestCountLookups(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "count_lookups_test",
+		CountLookups: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	worker := &Storage{Client: s.Client, Prefix: s.Prefix, CountLookups: true}
+	if err := worker.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Visited(1)
+	s.IsVisited(1)
+	worker.IsVisited(2)
+	worker.IsVisitedBatch([]uint64{1, 3})
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.VisitedHits != 2 || st.VisitedMisses != 2 || st.HitRatio() != 0.5 {
+		t.Errorf("invalid lookup counts %+v", st)
+	}
+}
+
+type countingSink struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	timed  int
+}
+
+func (c *countingSink) Count(name string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[name] += n
+}
+
+func (c *countingSink) Timing(name string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timed++
+}
+
+func TestMetricsSink(t *testing.T) {
+	sink := &countingSink{counts: map[string]int64{}}
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "metrics_sink_test",
+		MetricsSink: sink,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	s.Visited(1)
+	s.IsVisited(1)
+	s.IsVisited(2)
+	s.AddRequest([]byte("http://example.com/1"))
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.counts["visited.marks"] != 1 || sink.counts["visited.hits"] != 1 ||
+		sink.counts["visited.misses"] != 1 || sink.counts["queue.adds"] != 1 {
+		t.Errorf("invalid counts %v", sink.counts)
+	}
+	if sink.timed == 0 {
+		t.Error("no latency recorded")
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Storage{
+		Address:       "127.0.0.1:6379",
+		Prefix:        "slow_test",
+		SlowThreshold: time.Nanosecond,
+		Logger:        log.New(&buf, "", 0),
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	buf.Reset()
+	s.IsVisited(1)
+	if l := buf.String(); !strings.Contains(l, `cmd=get key="slow_test:request:1" duration=`) {
+		t.Errorf("slow command not logged: %q", l)
+	}
+	// Waiting for a request is not slow.
+	s.QueueMode = QueueList
+	buf.Reset()
+	s.GetRequestBlocking(10 * time.Millisecond)
+	if l := buf.String(); strings.Contains(l, "brpop") {
+		t.Errorf("blocking command logged: %q", l)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}
+	calls := 0
+	process := retryHook{p}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		calls++
+		if calls < 3 {
+			cmd.SetErr(errors.New("LOADING Redis is loading the dataset in memory"))
+		} else {
+			cmd.SetErr(nil)
+		}
+		return cmd.Err()
+	})
+	if err := process(context.Background(), redis.NewCmd(context.Background(), "get", "k")); err != nil || calls != 3 {
+		t.Errorf("command not retried: %d calls, %v", calls, err)
+	}
+	calls = 0
+	process = retryHook{p}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		calls++
+		cmd.SetErr(redis.Nil)
+		return cmd.Err()
+	})
+	if err := process(context.Background(), redis.NewCmd(context.Background(), "get", "k")); err != redis.Nil || calls != 1 {
+		t.Errorf("missing key retried: %d calls, %v", calls, err)
+	}
+	if d := p.backoff(20); d != time.Second {
+		t.Errorf("backoff not limited: %s", d)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "breaker_test",
+		CircuitBreaker: &CircuitBreaker{Failures: 1, Cooldown: 50 * time.Millisecond},
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	live := s.Client
+	s.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	if err := s.Visited(1); err != nil {
+		t.Errorf("visit not buffered: %v", err)
+	}
+	if ok, err := s.IsVisited(1); !ok || err != nil {
+		t.Errorf("buffered visit not found: %v", err)
+	}
+	if _, err := s.IsVisited(2); err != ErrCircuitOpen {
+		t.Errorf("open breaker did not fail fast: %v", err)
+	}
+	if err := s.AddRequest([]byte("http://example.com/1")); err != nil {
+		t.Errorf("request not buffered: %v", err)
+	}
+	s.Client.Close()
+	s.Client = live
+	time.Sleep(60 * time.Millisecond)
+	if ok, err := s.IsVisited(2); ok || err != nil {
+		t.Errorf("breaker did not close: %v", err)
+	}
+	if _, err := s.Client.Get(context.Background(), s.getIDStr(1)).Result(); err != nil {
+		t.Errorf("buffered visit not replayed: %v", err)
+	}
+	if size, _ := s.QueueSize(); size != 1 {
+		t.Errorf("buffered request not replayed, queue size %d", size)
+	}
+}
+
+func TestCircuitBreakerQueueFull(t *testing.T) {
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "breaker_full_test",
+		QueueMode:      QueueList,
+		MaxQueueSize:   1,
+		BlockWhenFull:  true,
+		CircuitBreaker: &CircuitBreaker{Failures: 1, Cooldown: 50 * time.Millisecond},
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	live := s.Client
+	s.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	for i := 1; i <= 3; i++ {
+		if err := s.AddRequest([]byte("http://example.com/" + strconv.Itoa(i))); err != nil {
+			t.Errorf("request not buffered: %v", err)
+		}
+	}
+	s.Client.Close()
+	s.Client = live
+	time.Sleep(60 * time.Millisecond)
+	// The replay neither waits for room nor keeps the rejected requests.
+	start := time.Now()
+	if _, err := s.IsVisited(1); err != nil {
+		t.Errorf("breaker did not close: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("replay waited %s for room", d)
+	}
+	if n := s.CircuitBreaker.size(); n != 0 {
+		t.Errorf("%d rejected requests left in the buffer", n)
+	}
+	if size, _ := s.QueueSize(); size != 1 {
+		t.Errorf("invalid queue size %d", size)
+	}
+}
+
+func TestAsyncVisited(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "async_test",
+		AsyncVisited: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer c.Close()
+	defer c.Del(context.Background(), s.getIDStr(1), s.getIDStr(2))
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+	}
+	if ok, _ := s.IsVisited(1); !ok {
+		t.Error("queued visit not found")
+	}
+	if err := s.Flush(); err != nil {
+		t.Error("failed to flush: " + err.Error())
+	}
+	if n, _ := c.Exists(context.Background(), s.getIDStr(1)).Result(); n != 1 {
+		t.Error("visit not written by Flush")
+	}
+	s.Visited(2)
+	if err := s.Close(); err != nil {
+		t.Error("failed to close storage: " + err.Error())
+	}
+	if n, _ := c.Exists(context.Background(), s.getIDStr(2)).Result(); n != 1 {
+		t.Error("visit not written by Close")
+	}
+}
+
+func TestClientSideCache(t *testing.T) {
+	s := &Storage{
+		Address:             "127.0.0.1:6379",
+		Prefix:              "csc_test",
+		ClientSideCacheSize: 100,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer c.Close()
+	defer c.Del(context.Background(), s.getIDStr(1))
+	for i := 0; i < 2; i++ {
+		if ok, err := s.IsVisited(1); err != nil || ok {
+			t.Error("unvisited request reported visited")
+		}
+	}
+	// Set by another client, the cached miss is invalidated.
+	c.Set(context.Background(), s.getIDStr(1), "1", 0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		ok, err := s.IsVisited(1)
+		if err != nil {
+			t.Error("failed to check visit: " + err.Error())
+			return
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("stale cached visit")
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplicaAddrs(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "replica_test",
+		ReplicaAddrs: []string{"127.0.0.1:6379", "127.0.0.1:1"},
+		MergeCookies: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer s.Client.Del(context.Background(), s.getIDStr(1))
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+	}
+	// Reads alternate between the replicas, one of which is down.
+	var found, failed int
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		ok, err := s.IsVisitedCtx(ctx, 1)
+		cancel()
+		if err != nil {
+			failed++
+		} else if ok {
+			found++
+		}
+	}
+	if found != 2 || failed != 2 {
+		t.Errorf("reads not routed to replicas: %d found, %d failed", found, failed)
+	}
+	// Merging cookies reads them from the server.
+	u, _ := url.Parse("http://example.com")
+	defer s.Client.Del(context.Background(), s.getCookieID(u.Host))
+	for i := 0; i < 2; i++ {
+		if err := s.SetCookiesE(u, "a=1"); err != nil {
+			t.Error("failed to set cookies: " + err.Error())
+		}
+	}
+}
+
+func TestScripts(t *testing.T) {
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "scripts_test",
+		RecordMetadata: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if !s.scriptsLoaded {
+		t.Fatal("scripts not loaded")
+	}
+	if err := s.Client.ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Visited(1); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+	}
+	if n, _ := s.Client.Exists(context.Background(), s.getVisitInfoID(1)).Result(); n != 1 {
+		t.Error("lost script not run again")
+	}
+	if ok, _ := s.Client.ScriptExists(context.Background(), setInfoScript.Hash()).Result(); !ok[0] {
+		t.Error("scripts not reloaded")
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	s := &Storage{
+		Address:     "127.0.0.1:6379",
+		Prefix:      "functions_test",
+		Functions:   true,
+		Deduplicate: true,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	// The test server does not support functions, so the library is
+	// only compiled, with a stub for register_function.
+	_, code := library()
+	code = code[strings.Index(code, "\n")+1:]
+	code = "local function register(name, f) end\n" + strings.ReplaceAll(code, "redis.register_function(", "register(")
+	if err := s.Client.Eval(context.Background(), code, nil).Err(); err != nil && err != redis.Nil {
+		t.Errorf("invalid library: %v", err)
+	}
+	if s.functions || !s.scriptsLoaded {
+		t.Error("storage did not fall back to scripts")
+	}
+	if err := s.AddRequest([]byte("http://example.com/")); err != nil {
+		t.Error("failed to add request: " + err.Error())
+	}
+	if size, _ := s.QueueSize(); size != 1 {
+		t.Errorf("queue size %d, expected 1", size)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	s := &Storage{
+		Address:            "127.0.0.1:6379",
+		Prefix:             "batch_test",
+		CollectMetrics:     true,
+		VisitedBatching:    Batching{Window: 50 * time.Millisecond, Size: 10},
+		AddRequestBatching: Batching{Window: time.Millisecond},
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	n := s.Metrics().Latency.Count
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			if err := s.Visited(id); err != nil {
+				t.Error("failed to mark visited: " + err.Error())
+			}
+			if err := s.AddRequest([]byte("http://example.com/" + string(rune('a'+id)))); err != nil {
+				t.Error("failed to add request: " + err.Error())
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	if m := s.Metrics(); m.VisitedMarks != 10 || m.QueueAdds != 10 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	if size, _ := s.QueueSize(); size != 10 {
+		t.Errorf("queue size %d, expected 10", size)
+	}
+	s.cache = nil
+	for i := uint64(0); i < 10; i++ {
+		if ok, _ := s.IsVisited(i); !ok {
+			t.Errorf("batched visit %d not found", i)
+		}
+	}
+	// One pipeline for the full batch of visits, at most one per
+	// request, one for QueueSize and one per IsVisited.
+	if d := s.Metrics().Latency.Count - n; d > 1+10+1+10 {
+		t.Errorf("%d round trips", d)
+	}
+}
+
+func TestWaitReplicas(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "wait_test",
+		WaitReplicas: 1,
+		WaitTimeout:  10 * time.Millisecond,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	if err := s.Visited(1); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("unreplicated visit returned %v", err)
+	}
+	if err := s.AddRequest([]byte("http://example.com/")); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("unreplicated request returned %v", err)
+	}
+	s.WaitReplicas = 0
+	if ok, _ := s.IsVisited(1); !ok {
+		t.Error("visit not written to the primary")
+	}
+	if err := s.Visited(2); err != nil {
+		t.Error("failed to mark visited: " + err.Error())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	mirror := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
+	defer mirror.Close()
+	defer mirror.FlushDB(context.Background())
+	s := &Storage{
+		Address:        "127.0.0.1:6379",
+		Prefix:         "flush_test",
+		CircuitBreaker: &CircuitBreaker{Failures: 1, Cooldown: 50 * time.Millisecond},
+		Mirror:         mirror,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	live := s.Client
+	s.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	if err := s.Visited(1); err != nil {
+		t.Errorf("visit not buffered: %v", err)
+	}
+	if err := s.Flush(); err != ErrCircuitOpen {
+		t.Errorf("flush of an open breaker returned %v", err)
+	}
+	s.Client.Close()
+	s.Client = live
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Error("failed to close storage: " + err.Error())
+	}
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer c.Close()
+	if n, _ := c.Del(context.Background(), s.getIDStr(1)).Result(); n != 1 {
+		t.Error("buffered visit not flushed on Close")
+	}
+	if n, _ := mirror.Exists(context.Background(), s.getIDStr(1)).Result(); n != 1 {
+		t.Error("flushed visit not mirrored on Close")
+	}
+}
+
+func TestHybridStorage(t *testing.T) {
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "hybrid_test",
+	}
+	h := s.Hybrid()
+	h.RetryInterval = 20 * time.Millisecond
+	if err := h.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	live := s.Client
+	s.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	u, _ := url.Parse("http://example.com")
+	if err := h.Visited(1); err != nil {
+		t.Errorf("visit not stored locally: %v", err)
+	}
+	if !h.Offline() {
+		t.Error("storage did not switch to the local store")
+	}
+	if ok, _ := h.IsVisited(1); !ok {
+		t.Error("local visit not found")
+	}
+	h.SetCookies(u, "a=1")
+	if c := h.Cookies(u); c != "a=1" {
+		t.Errorf("invalid local cookies %q", c)
+	}
+	h.AddRequest([]byte("http://example.com/1"))
+	if r, err := h.GetRequest(); err != nil || string(r) != "http://example.com/1" {
+		t.Errorf("invalid local request %q: %v", r, err)
+	}
+	h.AddRequest([]byte("http://example.com/2"))
+	s.Client.Close()
+	s.Client = live
+	time.Sleep(30 * time.Millisecond)
+	if n, err := h.QueueSize(); n != 1 || err != nil {
+		t.Errorf("local queue not merged, size %d: %v", n, err)
+	}
+	if h.Offline() {
+		t.Error("storage did not switch back to redis")
+	}
+	if ok, _ := s.IsVisited(1); !ok {
+		t.Error("local visit not merged")
+	}
+	if c := s.Cookies(u); c != "a=1" {
+		t.Errorf("local cookies not merged: %q", c)
+	}
+}
+
+func TestHybridStorageQueueFull(t *testing.T) {
+	s := &Storage{
+		Address:      "127.0.0.1:6379",
+		Prefix:       "hybrid_full_test",
+		MaxQueueSize: 1,
+	}
+	h := s.Hybrid()
+	h.RetryInterval = 20 * time.Millisecond
+	if err := h.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	live := s.Client
+	s.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	h.AddRequest([]byte("http://example.com/1"))
+	h.AddRequest([]byte("http://example.com/2"))
+	if !h.Offline() {
+		t.Error("storage did not switch to the local store")
+	}
+	s.Client.Close()
+	s.Client = live
+	time.Sleep(30 * time.Millisecond)
+	// The local requests exceed MaxQueueSize, which must not keep the
+	// storage offline.
+	if err := h.Visited(1); err != nil {
+		t.Errorf("visit not stored: %v", err)
+	}
+	if h.Offline() {
+		t.Error("storage did not switch back to redis")
+	}
+	if ok, _ := s.IsVisited(1); !ok {
+		t.Error("visit not stored in redis")
+	}
+	if n, err := h.QueueSize(); n != 2 || err != nil {
+		t.Errorf("invalid queue size %d: %v", n, err)
+	}
+	for i := 1; i <= 2; i++ {
+		if r, err := h.GetRequest(); err != nil || string(r) != "http://example.com/"+strconv.Itoa(i) {
+			t.Errorf("invalid rejected request %q: %v", r, err)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	mirror := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
+	defer mirror.Close()
+	s := &Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "mirror_test",
+		Mirror:  mirror,
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	defer mirror.FlushDB(context.Background())
+	u, _ := url.Parse("http://example.com/")
+	s.Visited(1)
+	s.Visited(2)
+	s.SetCookies(u, "a=1")
+	s.AddRequest([]byte("r1"))
+	s.AddRequest([]byte("r2"))
+	if _, err := s.GetRequest(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.MirrorConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Keys == 0 || r.Keys != r.MirrorKeys || r.MissingCount != 0 || r.ExtraCount != 0 {
+		t.Errorf("mirror diverged: %+v", r)
+	}
+	if n, _ := mirror.SCard(context.Background(), s.getQueueID()).Result(); n != 1 {
+		t.Errorf("mirrored queue size is %d, expected 1", n)
+	}
+	mirror.Del(context.Background(), s.getIDStr(1))
+	mirror.Set(context.Background(), s.getIDStr(3), 1, 0)
+	r, err = s.MirrorConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MissingCount != 1 || r.Missing[0] != s.getIDStr(1) || r.ExtraCount != 1 || r.Extra[0] != s.getIDStr(3) {
+		t.Errorf("unexpected report: %+v", r)
+	}
+}
+
+func TestMirrorBlocking(t *testing.T) {
+	mirror := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
+	defer mirror.Close()
+	for _, mode := range []QueueMode{QueueList, QueuePriority, QueueReliable} {
+		s := &Storage{
+			Address:   "127.0.0.1:6379",
+			Prefix:    "mirror_blocking_test",
+			QueueMode: mode,
+			Mirror:    mirror,
+		}
+		if err := s.Init(); err != nil {
+			t.Error("failed to initialize client: " + err.Error())
+			return
+		}
+		// Empty pops are not mirrored, so the mirror does not wait for
+		// the timeout while later writes pile up.
+		if _, err := s.GetRequestBlocking(100 * time.Millisecond); err != ErrQueueEmpty {
+			t.Errorf("mode %d: unexpected error %v", mode, err)
+		}
+		s.AddRequest([]byte("r1"))
+		s.AddRequest([]byte("r2"))
+		if r, err := s.GetRequestBlocking(time.Second); err != nil || r == nil {
+			t.Errorf("mode %d: got request %q: %v", mode, r, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		r, err := s.MirrorConsistencyCtx(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Keys != r.MirrorKeys || r.MissingCount != 0 || r.ExtraCount != 0 || r.Dropped != 0 {
+			t.Errorf("mode %d: mirror diverged: %+v", mode, r)
+		}
+		if n, _ := s.QueueSize(); n != 1 {
+			t.Errorf("mode %d: queue size is %d, expected 1", mode, n)
+		}
+		// The popped request was removed from the mirror as well.
+		var n int64
+		if mode == QueuePriority {
+			n, _ = mirror.ZCard(context.Background(), s.getQueueID()).Result()
+		} else {
+			n, _ = mirror.LLen(context.Background(), s.getQueueID()).Result()
+		}
+		if n != 1 {
+			t.Errorf("mode %d: mirrored queue size is %d, expected 1", mode, n)
+		}
+		s.Clear()
+		s.Close()
+		mirror.FlushDB(context.Background())
+	}
+}
+
+func TestMirrorRing(t *testing.T) {
+	// The mirror spreads the keys over the databases 1 and 2, which are
+	// scanned concurrently.
+	mirror := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"a": "127.0.0.1:6379", "b": "localhost:6379"},
+		NewClient: func(opt *redis.Options) *redis.Client {
+			opt.DB = 1
+			if strings.HasPrefix(opt.Addr, "localhost") {
+				opt.DB = 2
+			}
+			return redis.NewClient(opt)
+		},
+	})
+	defer mirror.Close()
+	s := &Storage{Address: "127.0.0.1:6379", Prefix: "mirror_ring_test", Mirror: mirror}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Close()
+	defer mirror.ForEachShard(context.Background(), func(ctx context.Context, c *redis.Client) error {
+		return c.FlushDB(ctx).Err()
+	})
+	defer s.Clear()
+	for i := uint64(0); i < 20; i++ {
+		s.Visited(i)
+	}
+	r, err := s.MirrorConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Keys != 20 || r.MirrorKeys != 20 || r.MissingCount != 0 || r.ExtraCount != 0 {
+		t.Errorf("mirror diverged: %+v", r)
+	}
+}
@@ -0,0 +1,248 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotInFlight is returned by Ack and Nack if the request is not in
+// the processing list of the consumer
+var ErrNotInFlight = errors.New("redisstorage: request is not in flight")
+
+// nackScript moves a request from the processing list back to the
+// tail of the queue if, and only if, it is still in flight.
+// KEYS: processing list, queue, claims
+// ARGV: request, claim
+var nackScript = newScript(`
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("LPUSH", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[2])
+return 1
+`)
+
+// claimScript moves a request to the processing list and records the
+// time of the claim for the visibility timeout.
+// KEYS: queue, processing list, claims
+// ARGV: now, consumer
+var claimScript = newScript(`
+local r = redis.call("LMOVE", KEYS[1], KEYS[2], "RIGHT", "LEFT")
+if not r then
+	return false
+end
+redis.call("ZADD", KEYS[3], ARGV[1], ARGV[2] .. "\n" .. r)
+return r
+`)
+
+// reapScript returns requests claimed before a deadline to the queue.
+// Claims are stored as consumer and request separated by a newline.
+// KEYS: claims, queue
+// ARGV: deadline, processing list key prefix
+var reapScript = newScript(`
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+local n = 0
+for _, m in ipairs(stale) do
+	local i = string.find(m, "\n", 1, true)
+	local r = string.sub(m, i + 1)
+	redis.call("ZREM", KEYS[1], m)
+	if redis.call("LREM", ARGV[2] .. string.sub(m, 1, i - 1), 1, r) > 0 then
+		redis.call("LPUSH", KEYS[2], r)
+		n = n + 1
+	end
+end
+return n
+`)
+
+// Ack acknowledges a request returned by GetRequest and removes it from
+// the processing list. Its attempt counter is reset. It is only
+// supported by QueueReliable and QueueStream.
+func (s *Storage) Ack(r []byte) error {
+	return s.AckCtx(context.Background(), r)
+}
+
+// AckCtx is the context-aware variant of Ack
+func (s *Storage) AckCtx(ctx context.Context, r []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.intercept(ctx, &Op{Name: "Ack", Request: r}, func(ctx context.Context, op *Op) error {
+		return s.ack(ctx, op.Request)
+	})
+}
+
+func (s *Storage) ack(ctx context.Context, r []byte) error {
+	if s.QueueMode == QueueStream {
+		return s.ackStream(ctx, r)
+	}
+	if s.QueueMode != QueueReliable {
+		return ErrUnsupportedQueueMode
+	}
+	p := s.encode(r)
+	var rem *redis.IntCmd
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		rem = pipe.LRem(ctx, s.getProcessingID(), 1, p)
+		pipe.ZRem(ctx, s.getClaimsID(), s.claimMember(p))
+		pipe.HDel(ctx, s.getAttemptsID(), attemptsField(r))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rem.Val() == 0 {
+		return ErrNotInFlight
+	}
+	return nil
+}
+
+// Nack returns a request obtained by GetRequest to the tail of the
+// queue, e.g. because processing it failed. It is only supported by
+// QueueReliable and QueueStream.
+func (s *Storage) Nack(r []byte) error {
+	return s.NackCtx(context.Background(), r)
+}
+
+// NackCtx is the context-aware variant of Nack
+func (s *Storage) NackCtx(ctx context.Context, r []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.intercept(ctx, &Op{Name: "Nack", Request: r}, func(ctx context.Context, op *Op) error {
+		return s.nack(ctx, op.Request)
+	})
+}
+
+func (s *Storage) nack(ctx context.Context, r []byte) error {
+	if s.QueueMode == QueueStream {
+		return s.nackStream(ctx, r)
+	}
+	if s.QueueMode != QueueReliable {
+		return ErrUnsupportedQueueMode
+	}
+	p := s.encode(r)
+	keys := []string{s.getProcessingID(), s.getQueueID(), s.getClaimsID()}
+	n, err := s.runScript(ctx, s.Client, nackScript, keys, p, s.claimMember(p)).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotInFlight
+	}
+	return nil
+}
+
+// InFlight returns the number of requests in the processing list of
+// the consumer
+func (s *Storage) InFlight() (int, error) {
+	return s.InFlightCtx(context.Background())
+}
+
+// InFlightCtx is the context-aware variant of InFlight
+func (s *Storage) InFlightCtx(ctx context.Context) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	i, err := s.Client.LLen(ctx, s.getProcessingID()).Result()
+	return int(i), err
+}
+
+// RequeueStale returns the requests of all consumers which were claimed
+// longer than VisibilityTimeout ago and not acknowledged since, e.g.
+// because their consumer crashed, to the queue. It returns the number of
+// requeued requests. While VisibilityTimeout is set, Init starts a
+// goroutine calling it periodically until Close.
+func (s *Storage) RequeueStale() (int, error) {
+	return s.RequeueStaleCtx(context.Background())
+}
+
+// RequeueStaleCtx is the context-aware variant of RequeueStale
+func (s *Storage) RequeueStaleCtx(ctx context.Context) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	if s.QueueMode != QueueReliable || s.VisibilityTimeout <= 0 {
+		return 0, ErrUnsupportedQueueMode
+	}
+	deadline := strconv.FormatInt(time.Now().Add(-s.VisibilityTimeout).UnixMilli(), 10)
+	keys := []string{s.getClaimsID(), s.getQueueID()}
+	return s.runScript(ctx, s.Client, reapScript, keys, deadline, s.getProcessingPrefix()).Int()
+}
+
+// reap calls RequeueStale until stop is closed
+func (s *Storage) reap(stop chan struct{}) {
+	interval := s.VisibilityTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if _, err := s.RequeueStale(); err != nil && err != ErrClosed {
+				s.errs.record(err)
+				s.logf("RequeueStale() error %s", err)
+			}
+		}
+	}
+}
+
+// claim moves the next request to the processing list of the consumer
+func (s *Storage) claim(ctx context.Context) ([]byte, error) {
+	if s.VisibilityTimeout <= 0 {
+		return s.Client.LMove(ctx, s.getQueueID(), s.getProcessingID(), "RIGHT", "LEFT").Bytes()
+	}
+	keys := []string{s.getQueueID(), s.getProcessingID(), s.getClaimsID()}
+	r, err := s.runScript(ctx, s.Client, claimScript, keys, time.Now().UnixMilli(), s.ConsumerID).Text()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r), nil
+}
+
+// claimN moves up to n requests to the processing list of the consumer
+func (s *Storage) claimN(ctx context.Context, n int) ([]string, error) {
+	keys := []string{s.getQueueID(), s.getProcessingID(), s.getClaimsID()}
+	now := time.Now().UnixMilli()
+	cmds, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < n; i++ {
+			if s.VisibilityTimeout <= 0 {
+				pipe.LMove(ctx, s.getQueueID(), s.getProcessingID(), "RIGHT", "LEFT")
+			} else {
+				s.evalScript(ctx, pipe, claimScript, keys, now, s.ConsumerID)
+			}
+		}
+		return nil
+	})
+	return pipelinedStrings(cmds, err)
+}
+
+// claimBlocking is like claim, but waits up to timeout for a request.
+// Scripts can not block, so the claim time is recorded separately.
+func (s *Storage) claimBlocking(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	r, err := s.Client.BLMove(ctx, s.getQueueID(), s.getProcessingID(), "RIGHT", "LEFT", timeout).Bytes()
+	if err != nil || s.VisibilityTimeout <= 0 {
+		return r, err
+	}
+	z := redis.Z{Score: float64(time.Now().UnixMilli()), Member: s.claimMember(r)}
+	if err := s.Client.ZAdd(ctx, s.getClaimsID(), z).Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// claimMember returns the member of the claims set for the encoded
+// request p claimed by this consumer
+func (s *Storage) claimMember(p []byte) string {
+	return s.ConsumerID + "\n" + string(p)
+}
+
+func (s *Storage) getClaimsID() string {
+	return s.queueKey("claims")
+}
@@ -0,0 +1,82 @@
+package redisstorage
+
+import (
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replicas are the clients IsVisited and Cookies read from instead of
+// the primary, see ReplicaAddrs and RouteReadsToReplicas
+type replicas struct {
+	clients []redis.UniversalClient
+	next    atomic.Uint64
+}
+
+// newReplicas returns the clients of ReplicaAddrs or, with
+// RouteReadsToReplicas, of the replicas of the cluster or sentinel
+// master, or nil if reads are not routed to replicas
+func (s *Storage) newReplicas() (*replicas, error) {
+	r := &replicas{}
+	switch {
+	case len(s.ReplicaAddrs) > 0 && s.URL != "":
+		for _, addr := range s.ReplicaAddrs {
+			opts, err := s.urlOptions()
+			if err != nil {
+				return nil, err
+			}
+			opts.Addr = addr
+			r.clients = append(r.clients, redis.NewClient(opts))
+		}
+	case len(s.ReplicaAddrs) > 0:
+		for _, addr := range s.ReplicaAddrs {
+			opts := s.universalOptions()
+			opts.Addrs = []string{addr}
+			r.clients = append(r.clients, redis.NewClient(opts.Simple()))
+		}
+	case s.RouteReadsToReplicas && (s.SentinelMasterName != "" || len(s.ClusterAddrs) > 0):
+		// Cluster clients read from replicas, sentinel clients connect
+		// to a replica.
+		opts := s.universalOptions()
+		opts.ReadOnly = true
+		r.clients = append(r.clients, redis.NewUniversalClient(opts))
+	default:
+		return nil, nil
+	}
+	for _, c := range r.clients {
+		if s.RetryPolicy != nil {
+			c.AddHook(retryHook{s.RetryPolicy})
+		}
+		if s.SlowThreshold > 0 {
+			c.AddHook(slowHook{s})
+		}
+		if s.metrics != nil {
+			c.AddHook(metricsHook{s.metrics, s.errs})
+		}
+	}
+	return r, nil
+}
+
+// reader returns the client reads which may lag behind the primary are
+// sent to, taking the replicas in turn
+func (s *Storage) reader() redis.UniversalClient {
+	if s.replicas == nil {
+		return s.Client
+	}
+	n := s.replicas.next.Add(1)
+	return s.replicas.clients[n%uint64(len(s.replicas.clients))]
+}
+
+// close closes the clients of the replicas
+func (r *replicas) close() error {
+	if r == nil {
+		return nil
+	}
+	var err error
+	for _, c := range r.clients {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
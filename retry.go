@@ -0,0 +1,88 @@
+package redisstorage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrMaxRetries is returned by RequeueRequest if the request exceeded
+// MaxRetries and was moved to the dead-letter queue
+var ErrMaxRetries = errors.New("redisstorage: request exceeded the maximum number of retries")
+
+// RequeueRequest returns a failed request to the queue and increments
+// its attempt counter. If the counter exceeds MaxRetries, the request is
+// moved to the dead-letter queue instead and ErrMaxRetries is returned.
+// With QueueReliable and QueueStream the request must be in flight, like
+// for Nack.
+func (s *Storage) RequeueRequest(r []byte) error {
+	return s.RequeueRequestCtx(context.Background(), r)
+}
+
+// RequeueRequestCtx is the context-aware variant of RequeueRequest
+func (s *Storage) RequeueRequestCtx(ctx context.Context, r []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.intercept(ctx, &Op{Name: "RequeueRequest", Request: r}, func(ctx context.Context, op *Op) error {
+		return s.requeue(ctx, op.Request)
+	})
+}
+
+func (s *Storage) requeue(ctx context.Context, r []byte) error {
+	n, err := s.Client.HIncrBy(ctx, s.getAttemptsID(), attemptsField(r), 1).Result()
+	if err != nil {
+		return err
+	}
+	if s.MaxRetries > 0 && n > int64(s.MaxRetries) {
+		if err := s.moveToDLQ(ctx, r); err != nil {
+			return err
+		}
+		if err := s.Client.HDel(ctx, s.getAttemptsID(), attemptsField(r)).Err(); err != nil {
+			return err
+		}
+		return ErrMaxRetries
+	}
+	switch s.QueueMode {
+	case QueueReliable, QueueStream:
+		return s.nack(ctx, r)
+	default:
+		// Colly marks requests visited before fetching them, so only
+		// the pending check of Deduplicate applies.
+		chk := dedupCheck(r, s.Deduplicate)
+		chk.visited = false
+		_, err := s.addRequest(ctx, r, chk)
+		return err
+	}
+}
+
+// Attempts returns how often a request was requeued by RequeueRequest
+func (s *Storage) Attempts(r []byte) (int, error) {
+	return s.AttemptsCtx(context.Background(), r)
+}
+
+// AttemptsCtx is the context-aware variant of Attempts
+func (s *Storage) AttemptsCtx(ctx context.Context, r []byte) (int, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
+	n, err := s.Client.HGet(ctx, s.getAttemptsID(), attemptsField(r)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// attemptsField returns the hash field of the attempt counter of r.
+// Requests are hashed to keep the fields small.
+func attemptsField(r []byte) string {
+	h := sha1.Sum(r)
+	return hex.EncodeToString(h[:])
+}
+
+func (s *Storage) getAttemptsID() string {
+	return s.queueKey("attempts")
+}
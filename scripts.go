@@ -0,0 +1,129 @@
+package redisstorage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scripts maps the SHA1 digests of the Lua scripts of the package to
+// their source, so EVALSHA can be replayed on a server not knowing the
+// script
+var scripts = map[string]string{}
+
+func newScript(src string) *redis.Script {
+	s := redis.NewScript(src)
+	scripts[s.Hash()] = src
+	return s
+}
+
+// loadScripts loads the scripts of the package into the script cache of
+// the server, so pipelines can run them by their digest. On a cluster
+// or ring every shard loads them.
+func (s *Storage) loadScripts(ctx context.Context) error {
+	return forEachNode(ctx, s.Client, func(ctx context.Context, n redis.Cmdable) error {
+		_, err := n.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, src := range scripts {
+				pipe.ScriptLoad(ctx, src)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// evalScript queues script in a pipeline. Unlike Script.Run, pipelines
+// can not fall back from EVALSHA to EVAL, so the body is sent unless Init
+// loaded the scripts or functions; scriptHook runs the scripts lost by
+// the server again.
+func (s *Storage) evalScript(ctx context.Context, pipe redis.Cmdable, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	if s.functions {
+		return pipe.FCall(ctx, functionName(script), keys, args...)
+	}
+	if s.scriptsLoaded {
+		return script.EvalSha(ctx, pipe, keys, args...)
+	}
+	return script.Eval(ctx, pipe, keys, args...)
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// scriptHook reloads the scripts or functions if the server lost them,
+// e.g. after a restart or failover, and runs the scripts which failed
+// again. Pipelined ones then run after the other commands of their
+// pipeline.
+type scriptHook struct {
+	s *Storage
+}
+
+// lost reports whether cmd failed because the server lost its script
+func (h scriptHook) lost(cmd redis.Cmder) bool {
+	switch cmd.Name() {
+	case "fcall":
+		return isNoFunction(cmd.Err())
+	case "evalsha":
+		return isNoScript(cmd.Err())
+	}
+	return false
+}
+
+// reload loads the scripts or functions again
+func (h scriptHook) reload(ctx context.Context) error {
+	var err error
+	if h.s.functions {
+		err = h.s.loadFunctions(ctx)
+	} else {
+		err = h.s.loadScripts(ctx)
+	}
+	if err != nil {
+		h.s.errs.record(err)
+		h.s.logf("reloading scripts error %s", err)
+	}
+	return err
+}
+
+func (h scriptHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h scriptHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		// Script.Run falls back from EVALSHA to EVAL on its own.
+		if cmd.Name() != "fcall" || !isNoFunction(cmd.Err()) || h.reload(ctx) != nil {
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h scriptHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		// Transactions are not split.
+		if len(cmds) == 0 || cmds[0].Name() == "multi" {
+			return err
+		}
+		var lost []redis.Cmder
+		for _, cmd := range cmds {
+			if h.lost(cmd) {
+				lost = append(lost, cmd)
+			}
+		}
+		if len(lost) == 0 || h.reload(ctx) != nil {
+			return err
+		}
+		if err := next(ctx, lost); err != nil && err != redis.Nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
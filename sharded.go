@@ -0,0 +1,217 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sync/atomic"
+)
+
+// ShardedStorage spreads a crawl over independent redis servers, for
+// crawls whose visits and queue exceed the memory of one server. Visits
+// are stored on the shard of their request ID, cookies on the shard of
+// their host and requests on the shard of the host of their URL, using
+// a consistent hash: appending a shard moves only the share of the keys
+// the new shard takes over, other changes of the order move most of
+// them. Cookies of parent domains, see ParentDomainCookies, are only
+// found on the shard of the host.
+type ShardedStorage struct {
+	// HostFunc returns the host of a request, which selects its shard.
+	// Default is RequestHost.
+	HostFunc func(r []byte) string
+
+	shards []*Storage
+	next   atomic.Uint64 // The shard GetRequest starts at.
+}
+
+// ErrNoShards is returned by NewShardedStorage without shards
+var ErrNoShards = errors.New("redisstorage: no shards")
+
+// NewShardedStorage returns a storage spreading the crawl over shards,
+// which must be distinct storages with their own servers. It implements
+// the storage and queue interfaces of Colly.
+func NewShardedStorage(shards ...*Storage) (*ShardedStorage, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	return &ShardedStorage{shards: shards}, nil
+}
+
+// Shards returns the storages of the shards
+func (sh *ShardedStorage) Shards() []*Storage {
+	return sh.shards
+}
+
+// Init initializes the storages of the shards
+func (sh *ShardedStorage) Init() error {
+	return sh.InitCtx(context.Background())
+}
+
+// InitCtx is the context-aware variant of Init
+func (sh *ShardedStorage) InitCtx(ctx context.Context) error {
+	return sh.each(func(s *Storage) error {
+		return s.InitCtx(ctx)
+	})
+}
+
+// Close closes the storages of the shards
+func (sh *ShardedStorage) Close() error {
+	return sh.each(func(s *Storage) error {
+		return s.Close()
+	})
+}
+
+// Flush flushes the storages of the shards, see Storage.Flush
+func (sh *ShardedStorage) Flush() error {
+	return sh.FlushCtx(context.Background())
+}
+
+// FlushCtx is the context-aware variant of Flush
+func (sh *ShardedStorage) FlushCtx(ctx context.Context) error {
+	return sh.each(func(s *Storage) error {
+		return s.FlushCtx(ctx)
+	})
+}
+
+// Clear removes all entries from the storages of the shards
+func (sh *ShardedStorage) Clear() error {
+	return sh.ClearCtx(context.Background())
+}
+
+// ClearCtx is the context-aware variant of Clear
+func (sh *ShardedStorage) ClearCtx(ctx context.Context) error {
+	return sh.each(func(s *Storage) error {
+		return s.ClearCtx(ctx)
+	})
+}
+
+// Visited implements colly/storage.Visited()
+func (sh *ShardedStorage) Visited(requestID uint64) error {
+	return sh.VisitedCtx(context.Background(), requestID)
+}
+
+// VisitedCtx is the context-aware variant of Visited
+func (sh *ShardedStorage) VisitedCtx(ctx context.Context, requestID uint64) error {
+	return sh.shard(requestID).VisitedCtx(ctx, requestID)
+}
+
+// IsVisited implements colly/storage.IsVisited()
+func (sh *ShardedStorage) IsVisited(requestID uint64) (bool, error) {
+	return sh.IsVisitedCtx(context.Background(), requestID)
+}
+
+// IsVisitedCtx is the context-aware variant of IsVisited
+func (sh *ShardedStorage) IsVisitedCtx(ctx context.Context, requestID uint64) (bool, error) {
+	return sh.shard(requestID).IsVisitedCtx(ctx, requestID)
+}
+
+// SetCookies implements colly/storage.SetCookies()
+func (sh *ShardedStorage) SetCookies(u *url.URL, cookies string) {
+	sh.SetCookiesCtx(context.Background(), u, cookies)
+}
+
+// SetCookiesCtx is the context-aware variant of SetCookies
+func (sh *ShardedStorage) SetCookiesCtx(ctx context.Context, u *url.URL, cookies string) {
+	sh.hostShard(u.Host).SetCookiesCtx(ctx, u, cookies)
+}
+
+// Cookies implements colly/storage.Cookies()
+func (sh *ShardedStorage) Cookies(u *url.URL) string {
+	return sh.CookiesCtx(context.Background(), u)
+}
+
+// CookiesCtx is the context-aware variant of Cookies
+func (sh *ShardedStorage) CookiesCtx(ctx context.Context, u *url.URL) string {
+	return sh.hostShard(u.Host).CookiesCtx(ctx, u)
+}
+
+// AddRequest implements queue.Storage.AddRequest() function
+func (sh *ShardedStorage) AddRequest(r []byte) error {
+	return sh.AddRequestCtx(context.Background(), r)
+}
+
+// AddRequestCtx is the context-aware variant of AddRequest
+func (sh *ShardedStorage) AddRequestCtx(ctx context.Context, r []byte) error {
+	host := RequestHost(r)
+	if sh.HostFunc != nil {
+		host = sh.HostFunc(r)
+	}
+	return sh.hostShard(host).AddRequestCtx(ctx, r)
+}
+
+// GetRequest implements queue.Storage.GetRequest() function. The shards
+// are asked in turn, so their queues are drained evenly.
+func (sh *ShardedStorage) GetRequest() ([]byte, error) {
+	return sh.GetRequestCtx(context.Background())
+}
+
+// GetRequestCtx is the context-aware variant of GetRequest
+func (sh *ShardedStorage) GetRequestCtx(ctx context.Context) ([]byte, error) {
+	start := sh.next.Add(1)
+	for i := range sh.shards {
+		s := sh.shards[(start+uint64(i))%uint64(len(sh.shards))]
+		r, err := s.GetRequestCtx(ctx)
+		if errors.Is(err, ErrQueueEmpty) {
+			continue
+		}
+		return r, err
+	}
+	return nil, ErrQueueEmpty
+}
+
+// QueueSize implements queue.Storage.QueueSize() function
+func (sh *ShardedStorage) QueueSize() (int, error) {
+	return sh.QueueSizeCtx(context.Background())
+}
+
+// QueueSizeCtx is the context-aware variant of QueueSize
+func (sh *ShardedStorage) QueueSizeCtx(ctx context.Context) (int, error) {
+	total := 0
+	for _, s := range sh.shards {
+		n, err := s.QueueSizeCtx(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// shard returns the shard of a request ID
+func (sh *ShardedStorage) shard(requestID uint64) *Storage {
+	return sh.shards[jumpHash(requestID, len(sh.shards))]
+}
+
+// hostShard returns the shard of a host
+func (sh *ShardedStorage) hostShard(host string) *Storage {
+	f := fnv.New64a()
+	f.Write([]byte(host))
+	return sh.shards[jumpHash(f.Sum64(), len(sh.shards))]
+}
+
+// each calls fn for every shard and returns the errors, prefixed with
+// the number of their shard
+func (sh *ShardedStorage) each(fn func(s *Storage) error) error {
+	var errs []error
+	for i, s := range sh.shards {
+		if err := fn(s); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// jumpHash returns the bucket of key among n buckets using the jump
+// consistent hash of Lamping and Veach. Adding a bucket moves 1/n of
+// the keys, all of them to the new bucket.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
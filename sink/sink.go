@@ -0,0 +1,71 @@
+// Package sink implements redisstorage.MetricsSink for statsd and
+// expvar, for deployments which do not scrape Prometheus metrics.
+package sink
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Statsd sends the metrics to a statsd server over UDP. Metrics which
+// can not be sent are dropped, as usual for statsd.
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsd returns a sink sending to the statsd server at addr, e.g.
+// "127.0.0.1:8125". The metric names start with prefix, e.g. "colly.".
+func NewStatsd(addr, prefix string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{conn: conn, prefix: prefix}, nil
+}
+
+// Count implements redisstorage.MetricsSink
+func (s *Statsd) Count(name string, n int64) {
+	fmt.Fprintf(s.conn, "%s%s:%d|c", s.prefix, name, n)
+}
+
+// Timing implements redisstorage.MetricsSink
+func (s *Statsd) Timing(name string, d time.Duration) {
+	fmt.Fprintf(s.conn, "%s%s:%g|ms", s.prefix, name, float64(d)/float64(time.Millisecond))
+}
+
+// Close closes the connection to the server
+func (s *Statsd) Close() error {
+	return s.conn.Close()
+}
+
+// Expvar publishes the metrics as an expvar map. Counters are published
+// under their name, timers as the number of observations "<name>.count"
+// and their sum in seconds "<name>.seconds".
+type Expvar struct {
+	m *expvar.Map
+}
+
+// NewExpvar returns a sink publishing the map name. Like expvar.NewMap
+// it panics if name is already published.
+func NewExpvar(name string) *Expvar {
+	return &Expvar{m: expvar.NewMap(name)}
+}
+
+// Count implements redisstorage.MetricsSink
+func (e *Expvar) Count(name string, n int64) {
+	e.m.Add(name, n)
+}
+
+// Timing implements redisstorage.MetricsSink
+func (e *Expvar) Timing(name string, d time.Duration) {
+	e.m.Add(name+".count", 1)
+	e.m.AddFloat(name+".seconds", d.Seconds())
+}
+
+// Map returns the published map
+func (e *Expvar) Map() *expvar.Map {
+	return e.m
+}
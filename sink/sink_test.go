@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := NewStatsd(l.LocalAddr().String(), "colly.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Count("queue.adds", 2)
+	s.Timing("redis.latency", 1500*time.Microsecond)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	for _, want := range []string{"colly.queue.adds:2|c", "colly.redis.latency:1.5|ms"} {
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("got %q instead of %q", got, want)
+		}
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	e := NewExpvar("redisstorage_test")
+	e.Count("queue.adds", 2)
+	e.Count("queue.adds", 1)
+	e.Timing("redis.latency", time.Second)
+	if v := e.Map().Get("queue.adds").(*expvar.Int).Value(); v != 3 {
+		t.Errorf("invalid counter %d", v)
+	}
+	if v := e.Map().Get("redis.latency.seconds").(*expvar.Float).Value(); v != 1 {
+		t.Errorf("invalid timer sum %f", v)
+	}
+}
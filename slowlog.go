@@ -0,0 +1,89 @@
+package redisstorage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slowHook logs the commands taking longer than SlowThreshold. Blocking
+// commands wait for requests on purpose and are not logged.
+type slowHook struct {
+	s *Storage
+}
+
+func (h slowHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h slowHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		if d := time.Since(start); d > h.s.SlowThreshold && !isBlocking(cmd) {
+			h.s.logf("slow redis command cmd=%s key=%q duration=%s", cmd.Name(), cmdKey(cmd), d)
+		}
+		return err
+	}
+}
+
+func (h slowHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		if d := time.Since(start); d > h.s.SlowThreshold && !anyBlocking(cmds) {
+			names := make([]string, len(cmds))
+			for i, cmd := range cmds {
+				names[i] = cmd.Name()
+			}
+			key := ""
+			if len(cmds) > 0 {
+				key = cmdKey(cmds[0])
+			}
+			h.s.logf("slow redis pipeline cmds=%s key=%q duration=%s", strings.Join(names, ","), key, d)
+		}
+		return err
+	}
+}
+
+// cmdKey returns the first key of cmd, or "" if it has none
+func cmdKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	i := 1
+	switch cmd.Name() {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		i = 3
+	}
+	if len(args) <= i {
+		return ""
+	}
+	key, _ := args[i].(string)
+	return key
+}
+
+// isBlocking reports whether cmd waits on the server until data arrives
+// or its timeout passes
+func isBlocking(cmd redis.Cmder) bool {
+	switch cmd.Name() {
+	case "blpop", "brpop", "brpoplpush", "blmove", "blmpop", "bzpopmin", "bzpopmax", "bzmpop":
+		return true
+	case "xread", "xreadgroup":
+		for _, arg := range cmd.Args() {
+			if a, ok := arg.(string); ok && a == "block" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyBlocking(cmds []redis.Cmder) bool {
+	for _, cmd := range cmds {
+		if isBlocking(cmd) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package redisstorage
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stats is a snapshot of the contents of a storage, see Stats
+type Stats struct {
+	// Visited is the number of stored visits. It is approximate with
+	// VisitedBloom.
+	Visited int
+	// QueueSize is the number of queued requests, see QueueSize
+	QueueSize int
+	// InFlight is the number of requests taken but not acknowledged yet
+	// with QueueReliable, by this consumer, and QueueStream, by the
+	// consumer group. It is 0 for other queue modes.
+	InFlight int
+	// CookieHosts is the number of hosts cookies are stored for
+	CookieHosts int
+	// VisitedHits and VisitedMisses are the numbers of IsVisited
+	// answers for visited and new requests. They are counted by all
+	// workers with CountLookups and by this process with
+	// CollectMetrics, and are 0 otherwise.
+	VisitedHits   int64
+	VisitedMisses int64
+	// LastError is the last error the storage logged instead of
+	// returning it or, with CollectMetrics, of a failed redis command.
+	// LastErrorTime is when it occurred.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// Stats returns the sizes of the visits, the queue and the cookies of
+// the storage. Visits and cookies are counted by scanning their keys,
+// which takes a while for large crawls.
+func (s *Storage) Stats() (Stats, error) {
+	return s.StatsCtx(context.Background())
+}
+
+// StatsCtx is the context-aware variant of Stats
+func (s *Storage) StatsCtx(ctx context.Context) (Stats, error) {
+	var st Stats
+	if err := s.check(); err != nil {
+		return st, err
+	}
+	st.LastError, st.LastErrorTime = s.errs.last()
+	var err error
+	if s.bloom {
+		st.Visited, err = s.bloomCard(ctx)
+	} else {
+		st.Visited, err = s.count(ctx, s.keyPattern("request"))
+	}
+	if err != nil {
+		return st, err
+	}
+	if st.QueueSize, err = s.QueueSizeCtx(ctx); err != nil {
+		return st, err
+	}
+	switch s.QueueMode {
+	case QueueReliable:
+		st.InFlight, err = s.InFlightCtx(ctx)
+	case QueueStream:
+		var p int64
+		p, err = s.streamPending(ctx)
+		st.InFlight = int(p)
+	}
+	if err != nil {
+		return st, err
+	}
+	if st.CookieHosts, err = s.count(ctx, s.keyPattern("cookie")); err != nil {
+		return st, err
+	}
+	if !s.CountLookups {
+		m := s.Metrics()
+		st.VisitedHits, st.VisitedMisses = int64(m.VisitedHits), int64(m.VisitedMisses)
+		return st, nil
+	}
+	counts, err := s.Client.HGetAll(ctx, s.getLookupsID()).Result()
+	if err != nil {
+		return st, err
+	}
+	st.VisitedHits, _ = strconv.ParseInt(counts["hit"], 10, 64)
+	st.VisitedMisses, _ = strconv.ParseInt(counts["miss"], 10, 64)
+	return st, nil
+}
+
+// HitRatio returns the share of IsVisited answers for visited requests,
+// or 0 if none were counted
+func (st Stats) HitRatio() float64 {
+	n := st.VisitedHits + st.VisitedMisses
+	if n == 0 {
+		return 0
+	}
+	return float64(st.VisitedHits) / float64(n)
+}
+
+// countLookups counts the answers of IsVisited. Like queue statistics,
+// failing to count them does not fail IsVisited.
+func (s *Storage) countLookups(ctx context.Context, hits, misses int) {
+	s.metrics.lookups(hits, misses)
+	if !s.CountLookups {
+		return
+	}
+	_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if hits > 0 {
+			pipe.HIncrBy(ctx, s.getLookupsID(), "hit", int64(hits))
+		}
+		if misses > 0 {
+			pipe.HIncrBy(ctx, s.getLookupsID(), "miss", int64(misses))
+		}
+		return nil
+	})
+	if err != nil {
+		s.errs.record(err)
+		s.logf("lookup count error %s", err)
+	}
+}
+
+func (s *Storage) getLookupsID() string {
+	return s.key("visited", "lookups")
+}
+
+// count returns the number of keys matching pattern
+func (s *Storage) count(ctx context.Context, pattern string) (int, error) {
+	n := 0
+	// The callback is called serially, also on a cluster or ring.
+	err := s.scan(ctx, pattern, func(keys []string) error {
+		n += len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// errorLog remembers the last error of a storage and the ones returned
+// by Queue
+type errorLog struct {
+	mu  sync.Mutex
+	err error
+	at  time.Time
+}
+
+// record remembers err unless it is nil. It does nothing on a nil
+// receiver.
+func (l *errorLog) record(err error) {
+	if l == nil || err == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err, l.at = err, time.Now()
+}
+
+func (l *errorLog) last() (error, time.Time) {
+	if l == nil {
+		return nil, time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err, l.at
+}
+
+// PoolStats returns the statistics of the connection pool of the
+// client. Many Timeouts or WaitCount growing with the load mean the
+// pool is exhausted and PoolSize should be raised. It returns nil
+// before Init.
+func (s *Storage) PoolStats() *redis.PoolStats {
+	if s.Client == nil {
+		return nil
+	}
+	return s.Client.PoolStats()
+}
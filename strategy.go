@@ -0,0 +1,90 @@
+package redisstorage
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// QueueStrategy implements the request queue on top of a single redis
+// key. It can be set on a Storage to replace the built-in QueueMode
+// implementations. Payloads are passed already compressed, see
+// CompressThreshold.
+type QueueStrategy interface {
+	// Push adds requests to the queue stored at key
+	Push(ctx context.Context, c redis.Cmdable, key string, rs ...[]byte) error
+	// Pop removes and returns the next request. It returns redis.Nil
+	// if the queue is empty.
+	Pop(ctx context.Context, c redis.Cmdable, key string) ([]byte, error)
+	// Size returns the number of queued requests
+	Size(ctx context.Context, c redis.Cmdable, key string) (int64, error)
+}
+
+var (
+	// FIFO returns requests in insertion order, which results in a
+	// breadth-first crawl
+	FIFO QueueStrategy = listStrategy{lifo: false}
+	// LIFO returns the most recently added request first, which
+	// results in a depth-first crawl
+	LIFO QueueStrategy = listStrategy{lifo: true}
+	// Random returns requests in random order and stores identical
+	// requests only once, like QueueSet
+	Random QueueStrategy = setStrategy{}
+)
+
+type listStrategy struct {
+	lifo bool
+}
+
+func (l listStrategy) Push(ctx context.Context, c redis.Cmdable, key string, rs ...[]byte) error {
+	return c.LPush(ctx, key, bytesArgs(rs)...).Err()
+}
+
+func (l listStrategy) Pop(ctx context.Context, c redis.Cmdable, key string) ([]byte, error) {
+	if l.lifo {
+		return c.LPop(ctx, key).Bytes()
+	}
+	return c.RPop(ctx, key).Bytes()
+}
+
+func (l listStrategy) Size(ctx context.Context, c redis.Cmdable, key string) (int64, error) {
+	return c.LLen(ctx, key).Result()
+}
+
+type setStrategy struct{}
+
+func (setStrategy) Push(ctx context.Context, c redis.Cmdable, key string, rs ...[]byte) error {
+	return c.SAdd(ctx, key, bytesArgs(rs)...).Err()
+}
+
+func (setStrategy) Pop(ctx context.Context, c redis.Cmdable, key string) ([]byte, error) {
+	return c.SPop(ctx, key).Bytes()
+}
+
+func (setStrategy) Size(ctx context.Context, c redis.Cmdable, key string) (int64, error) {
+	return c.SCard(ctx, key).Result()
+}
+
+func bytesArgs(rs [][]byte) []interface{} {
+	args := make([]interface{}, len(rs))
+	for i, r := range rs {
+		args[i] = r
+	}
+	return args
+}
+
+// popStrategyN pops up to n requests from a QueueStrategy. Strategies
+// only pop single requests, so this costs one round trip per request.
+func (s *Storage) popStrategyN(ctx context.Context, n int) ([]string, error) {
+	var vs []string
+	for i := 0; i < n; i++ {
+		p, err := s.QueueStrategy.Pop(ctx, s.Client, s.getQueueID())
+		if err == redis.Nil {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		vs = append(vs, string(p))
+	}
+	return vs, nil
+}
@@ -0,0 +1,386 @@
+package redisstorage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PendingRequest describes a request of a QueueStream queue which was
+// delivered to a consumer but not acknowledged yet
+type PendingRequest struct {
+	// ID is the stream entry ID
+	ID string
+	// Consumer is the name of the consumer owning the request
+	Consumer string
+	// Idle is the time elapsed since the last delivery
+	Idle time.Duration
+	// Deliveries is the number of times the request was delivered
+	Deliveries int64
+}
+
+// PendingRequests returns up to count unacknowledged requests of the
+// consumer group. It is only supported by QueueStream.
+func (s *Storage) PendingRequests(count int64) ([]PendingRequest, error) {
+	return s.PendingRequestsCtx(context.Background(), count)
+}
+
+// PendingRequestsCtx is the context-aware variant of PendingRequests
+func (s *Storage) PendingRequestsCtx(ctx context.Context, count int64) ([]PendingRequest, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if s.QueueMode != QueueStream {
+		return nil, ErrUnsupportedQueueMode
+	}
+	p, err := s.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: s.getQueueID(),
+		Group:  s.ConsumerGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+	if isNoGroup(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]PendingRequest, len(p))
+	for i, e := range p {
+		rs[i] = PendingRequest{
+			ID:         e.ID,
+			Consumer:   e.Consumer,
+			Idle:       e.Idle,
+			Deliveries: e.RetryCount,
+		}
+	}
+	return rs, nil
+}
+
+// ClaimStale takes over up to count requests which are pending for
+// longer than minIdle, e.g. because their consumer crashed, and returns
+// them for processing by this consumer. The returned requests must be
+// acknowledged with Ack like the ones returned by GetRequest. It is
+// only supported by QueueStream.
+func (s *Storage) ClaimStale(minIdle time.Duration, count int64) ([][]byte, error) {
+	return s.ClaimStaleCtx(context.Background(), minIdle, count)
+}
+
+// ClaimStaleCtx is the context-aware variant of ClaimStale
+func (s *Storage) ClaimStaleCtx(ctx context.Context, minIdle time.Duration, count int64) ([][]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if s.QueueMode != QueueStream {
+		return nil, ErrUnsupportedQueueMode
+	}
+	msgs, _, err := s.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   s.getQueueID(),
+		Group:    s.ConsumerGroup,
+		Consumer: s.ConsumerID,
+		MinIdle:  minIdle,
+		Start:    "0-0",
+		Count:    count,
+	}).Result()
+	if isNoGroup(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		r, err := s.decode(s.trackStream(m))
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// isNoGroup reports whether err tells that the stream or its consumer
+// group do not exist, e.g. after Clear
+func isNoGroup(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "NOGROUP") || err.Error() == "ERR no such key")
+}
+
+func (s *Storage) createGroup(ctx context.Context) error {
+	err := s.Client.XGroupCreateMkStream(ctx, s.getQueueID(), s.ConsumerGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) xadd(ctx context.Context, c redis.Cmdable, r []byte) *redis.StringCmd {
+	return c.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.getQueueID(),
+		Values: []interface{}{"r", r},
+	})
+}
+
+// readStream reads the next undelivered request of the consumer group.
+// Like SPOP it returns redis.Nil if there is none.
+func (s *Storage) readStream(ctx context.Context) ([]byte, error) {
+	return s.readStreamBlocking(ctx, -1)
+}
+
+// readStreamBlocking is like readStream, but waits up to timeout for a
+// request. A negative timeout does not wait at all.
+func (s *Storage) readStreamBlocking(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	res, err := s.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.ConsumerGroup,
+		Consumer: s.ConsumerID,
+		Streams:  []string{s.getQueueID(), ">"},
+		Count:    1,
+		Block:    timeout,
+	}).Result()
+	if isNoGroup(err) {
+		// The stream was removed, e.g. by Clear, or belongs to a
+		// named queue which was not read before.
+		if err := s.createGroup(ctx); err != nil {
+			return nil, err
+		}
+		return s.readStreamBlocking(ctx, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 || len(res[0].Messages) == 0 {
+		return nil, redis.Nil
+	}
+	return s.trackStream(res[0].Messages[0]), nil
+}
+
+// readStreamN reads up to n undelivered requests of the consumer group
+func (s *Storage) readStreamN(ctx context.Context, n int) ([]string, error) {
+	res, err := s.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.ConsumerGroup,
+		Consumer: s.ConsumerID,
+		Streams:  []string{s.getQueueID(), ">"},
+		Count:    int64(n),
+		Block:    -1,
+	}).Result()
+	if isNoGroup(err) {
+		if err := s.createGroup(ctx); err != nil {
+			return nil, err
+		}
+		return s.readStreamN(ctx, n)
+	}
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var vs []string
+	for _, m := range res[0].Messages {
+		vs = append(vs, string(s.trackStream(m)))
+	}
+	return vs, nil
+}
+
+// streamTracked is the maximum number of delivered requests whose entry
+// IDs are kept in memory. Colly never acknowledges requests, so older
+// ones are forgotten and looked up with XPENDING if they are
+// acknowledged after all.
+const streamTracked = 10000
+
+// streamEntry is a delivered request and its entry ID
+type streamEntry struct {
+	p  string
+	id string
+}
+
+// trackStream remembers the entry ID of a delivered request, so that
+// Ack and Nack can find it by its encoded payload.
+func (s *Storage) trackStream(m redis.XMessage) []byte {
+	v, _ := m.Values["r"].(string)
+	s.smu.Lock()
+	if s.streamIDs == nil {
+		s.streamIDs = make(map[string][]string)
+	}
+	s.streamIDs[v] = append(s.streamIDs[v], m.ID)
+	s.streamOrder = append(s.streamOrder, streamEntry{v, m.ID})
+	if len(s.streamOrder) > streamTracked {
+		e := s.streamOrder[0]
+		s.streamOrder = s.streamOrder[1:]
+		s.forgetStream(e.p, e.id)
+	}
+	s.smu.Unlock()
+	return []byte(v)
+}
+
+// forgetStream removes the entry id of the payload p if it is still
+// tracked
+func (s *Storage) forgetStream(p, id string) {
+	ids := s.streamIDs[p]
+	for i, v := range ids {
+		if v != id {
+			continue
+		}
+		if len(ids) == 1 {
+			delete(s.streamIDs, p)
+		} else {
+			s.streamIDs[p] = append(ids[:i:i], ids[i+1:]...)
+		}
+		return
+	}
+}
+
+// untrackStream returns and forgets the entry ID of the delivered
+// request with the encoded payload r. Requests no longer tracked are
+// looked up among the pending entries of the consumer.
+func (s *Storage) untrackStream(ctx context.Context, r []byte) (string, bool, error) {
+	s.smu.Lock()
+	ids := s.streamIDs[string(r)]
+	if len(ids) > 0 {
+		// The entry stays in streamOrder until it is evicted.
+		s.forgetStream(string(r), ids[0])
+		s.smu.Unlock()
+		return ids[0], true, nil
+	}
+	s.smu.Unlock()
+	return s.findPending(ctx, string(r))
+}
+
+// findPending returns the ID of a pending entry of the consumer with
+// the encoded payload p
+func (s *Storage) findPending(ctx context.Context, p string) (string, bool, error) {
+	start := "-"
+	for {
+		pending, err := s.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   s.getQueueID(),
+			Group:    s.ConsumerGroup,
+			Start:    start,
+			End:      "+",
+			Count:    100,
+			Consumer: s.ConsumerID,
+		}).Result()
+		if isNoGroup(err) {
+			return "", false, nil
+		}
+		if err != nil || len(pending) == 0 {
+			return "", false, err
+		}
+		cmds := make([]*redis.XMessageSliceCmd, len(pending))
+		_, err = s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, e := range pending {
+				cmds[i] = pipe.XRange(ctx, s.getQueueID(), e.ID, e.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", false, err
+		}
+		for _, cmd := range cmds {
+			for _, m := range cmd.Val() {
+				if v, _ := m.Values["r"].(string); v == p {
+					return m.ID, true, nil
+				}
+			}
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// peekStream returns up to n requests which were not delivered to the
+// consumer group yet
+func (s *Storage) peekStream(ctx context.Context, n int) ([][]byte, error) {
+	groups, err := s.Client.XInfoGroups(ctx, s.getQueueID()).Result()
+	if isNoGroup(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	last := "0-0"
+	for _, g := range groups {
+		if g.Name == s.ConsumerGroup {
+			last = g.LastDeliveredID
+		}
+	}
+	msgs, err := s.Client.XRangeN(ctx, s.getQueueID(), "("+last, "+", int64(n)).Result()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]string, len(msgs))
+	for i, m := range msgs {
+		vs[i], _ = m.Values["r"].(string)
+	}
+	return s.decodeAll(vs)
+}
+
+// streamSize returns the number of undelivered requests. Acknowledged
+// entries are deleted from the stream, so these are all entries which
+// are not pending.
+func (s *Storage) streamSize(ctx context.Context) (int64, error) {
+	var l *redis.IntCmd
+	var p *redis.XPendingCmd
+	s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		l = pipe.XLen(ctx, s.getQueueID())
+		p = pipe.XPending(ctx, s.getQueueID(), s.ConsumerGroup)
+		return nil
+	})
+	if err := l.Err(); err != nil {
+		return 0, err
+	}
+	// Without the group no entry is pending.
+	if err := p.Err(); isNoGroup(err) {
+		return l.Val(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	return l.Val() - p.Val().Count, nil
+}
+
+// streamPending returns the number of requests read but not
+// acknowledged by the consumer group
+func (s *Storage) streamPending(ctx context.Context) (int64, error) {
+	p, err := s.Client.XPending(ctx, s.getQueueID(), s.ConsumerGroup).Result()
+	if isNoGroup(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return p.Count, nil
+}
+
+func (s *Storage) ackStream(ctx context.Context, r []byte) error {
+	id, ok, err := s.untrackStream(ctx, s.encode(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotInFlight
+	}
+	_, err = s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, s.getQueueID(), s.ConsumerGroup, id)
+		pipe.XDel(ctx, s.getQueueID(), id)
+		pipe.HDel(ctx, s.getAttemptsID(), attemptsField(r))
+		return nil
+	})
+	return err
+}
+
+func (s *Storage) nackStream(ctx context.Context, r []byte) error {
+	p := s.encode(r)
+	id, ok, err := s.untrackStream(ctx, p)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotInFlight
+	}
+	_, err = s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.xadd(ctx, pipe, p)
+		pipe.XAck(ctx, s.getQueueID(), s.ConsumerGroup, id)
+		pipe.XDel(ctx, s.getQueueID(), id)
+		return nil
+	})
+	return err
+}
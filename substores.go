@@ -0,0 +1,162 @@
+package redisstorage
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// VisitedStore stores the visited requests. Storage, HybridStorage,
+// ShardedStorage and MemoryVisited implement it, see
+// Storage.VisitedStore.
+type VisitedStore interface {
+	VisitedCtx(ctx context.Context, requestID uint64) error
+	IsVisitedCtx(ctx context.Context, requestID uint64) (bool, error)
+}
+
+// CookieStore stores the cookies of the hosts. Storage, HybridStorage,
+// ShardedStorage and MemoryCookies implement it, see
+// Storage.CookieStore.
+type CookieStore interface {
+	SetCookiesCtx(ctx context.Context, u *url.URL, cookies string)
+	CookiesCtx(ctx context.Context, u *url.URL) string
+}
+
+// QueueStore stores the queued requests. Storage, HybridStorage,
+// ShardedStorage and MemoryQueue implement it, see Storage.QueueStore.
+type QueueStore interface {
+	AddRequestCtx(ctx context.Context, r []byte) error
+	GetRequestCtx(ctx context.Context) ([]byte, error)
+	QueueSizeCtx(ctx context.Context) (int, error)
+}
+
+var (
+	_ VisitedStore = (*Storage)(nil)
+	_ CookieStore  = (*Storage)(nil)
+	_ QueueStore   = (*Storage)(nil)
+	_ VisitedStore = (*HybridStorage)(nil)
+	_ CookieStore  = (*HybridStorage)(nil)
+	_ QueueStore   = (*HybridStorage)(nil)
+	_ VisitedStore = (*ShardedStorage)(nil)
+	_ CookieStore  = (*ShardedStorage)(nil)
+	_ QueueStore   = (*ShardedStorage)(nil)
+)
+
+// MemoryVisited is a VisitedStore keeping the visits in process, so
+// they are not shared with other processes and lost on exit. The zero
+// value is ready to use.
+type MemoryVisited struct {
+	mu      sync.Mutex
+	visited map[uint64]bool
+}
+
+// Visited implements colly/storage.Visited()
+func (m *MemoryVisited) Visited(requestID uint64) error {
+	return m.VisitedCtx(context.Background(), requestID)
+}
+
+// VisitedCtx is the context-aware variant of Visited
+func (m *MemoryVisited) VisitedCtx(ctx context.Context, requestID uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.visited == nil {
+		m.visited = make(map[uint64]bool)
+	}
+	m.visited[requestID] = true
+	return nil
+}
+
+// IsVisited implements colly/storage.IsVisited()
+func (m *MemoryVisited) IsVisited(requestID uint64) (bool, error) {
+	return m.IsVisitedCtx(context.Background(), requestID)
+}
+
+// IsVisitedCtx is the context-aware variant of IsVisited
+func (m *MemoryVisited) IsVisitedCtx(ctx context.Context, requestID uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.visited[requestID], nil
+}
+
+// MemoryCookies is a CookieStore keeping the cookies of the hosts in
+// process. The zero value is ready to use.
+type MemoryCookies struct {
+	mu      sync.Mutex
+	cookies map[string]string
+}
+
+// SetCookies implements colly/storage.SetCookies()
+func (m *MemoryCookies) SetCookies(u *url.URL, cookies string) {
+	m.SetCookiesCtx(context.Background(), u, cookies)
+}
+
+// SetCookiesCtx is the context-aware variant of SetCookies
+func (m *MemoryCookies) SetCookiesCtx(ctx context.Context, u *url.URL, cookies string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cookies == nil {
+		m.cookies = make(map[string]string)
+	}
+	m.cookies[u.Host] = cookies
+}
+
+// Cookies implements colly/storage.Cookies()
+func (m *MemoryCookies) Cookies(u *url.URL) string {
+	return m.CookiesCtx(context.Background(), u)
+}
+
+// CookiesCtx is the context-aware variant of Cookies
+func (m *MemoryCookies) CookiesCtx(ctx context.Context, u *url.URL) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cookies[u.Host]
+}
+
+// MemoryQueue is a QueueStore keeping the requests in process in the
+// order they were added. The zero value is ready to use.
+type MemoryQueue struct {
+	mu    sync.Mutex
+	queue [][]byte
+}
+
+// AddRequest implements queue.Storage.AddRequest() function
+func (m *MemoryQueue) AddRequest(r []byte) error {
+	return m.AddRequestCtx(context.Background(), r)
+}
+
+// AddRequestCtx is the context-aware variant of AddRequest
+func (m *MemoryQueue) AddRequestCtx(ctx context.Context, r []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue = append(m.queue, r)
+	return nil
+}
+
+// GetRequest implements queue.Storage.GetRequest() function
+func (m *MemoryQueue) GetRequest() ([]byte, error) {
+	return m.GetRequestCtx(context.Background())
+}
+
+// GetRequestCtx is the context-aware variant of GetRequest
+func (m *MemoryQueue) GetRequestCtx(ctx context.Context) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.queue) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	r := m.queue[0]
+	m.queue = m.queue[1:]
+	return r, nil
+}
+
+// QueueSize implements queue.Storage.QueueSize() function
+func (m *MemoryQueue) QueueSize() (int, error) {
+	return m.QueueSizeCtx(context.Background())
+}
+
+// QueueSizeCtx is the context-aware variant of QueueSize
+func (m *MemoryQueue) QueueSizeCtx(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue), nil
+}
@@ -0,0 +1,138 @@
+// Package tracing traces the redis commands of a redisstorage.Storage
+// with OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gocolly/redisstorage"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/gocolly/redisstorage/tracing"
+
+// Instrument makes s trace its redis commands with spans of tp, or of
+// the global TracerProvider if tp is nil. Spans are children of the span
+// in the context passed to the context-aware storage methods. It must be
+// called after Init.
+func Instrument(s *redisstorage.Storage, tp trace.TracerProvider) error {
+	if s.Client == nil {
+		return redisstorage.ErrNotInitialized
+	}
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	s.Client.AddHook(hook{
+		tracer: tp.Tracer(instrumentation),
+		class:  s.KeyClass,
+	})
+	return nil
+}
+
+type hook struct {
+	tracer trace.Tracer
+	class  func(key string) string
+}
+
+func (h hook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := h.tracer.Start(ctx, "redisstorage."+cmd.Name(),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "redis"),
+				attribute.String("db.operation.name", cmd.Name()),
+				attribute.String("redisstorage.key_class", h.keyClass(cmd)),
+				attribute.Int("redisstorage.payload_size", payloadSize(cmd)),
+			))
+		defer span.End()
+		err := next(ctx, cmd)
+		recordErr(span, cmd.Err())
+		return err
+	}
+}
+
+func (h hook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		classes := map[string]bool{}
+		size := 0
+		for _, cmd := range cmds {
+			classes[h.keyClass(cmd)] = true
+			size += payloadSize(cmd)
+		}
+		names := make([]string, 0, len(classes))
+		for c := range classes {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+		ctx, span := h.tracer.Start(ctx, "redisstorage.pipeline",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "redis"),
+				attribute.String("db.operation.name", "pipeline"),
+				attribute.Int("db.operation.batch.size", len(cmds)),
+				attribute.StringSlice("redisstorage.key_class", names),
+				attribute.Int("redisstorage.payload_size", size),
+			))
+		defer span.End()
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			if cmd.Err() != nil && cmd.Err() != redis.Nil {
+				recordErr(span, cmd.Err())
+				break
+			}
+		}
+		return err
+	}
+}
+
+// keyClass returns the kind of the key of cmd, like "request" or
+// "queue"
+func (h hook) keyClass(cmd redis.Cmder) string {
+	args := cmd.Args()
+	i := 1
+	switch cmd.Name() {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		i = 3
+	}
+	if len(args) <= i {
+		return ""
+	}
+	key, ok := args[i].(string)
+	if !ok {
+		return ""
+	}
+	return h.class(key)
+}
+
+// payloadSize returns the number of bytes of the string arguments of
+// cmd
+func payloadSize(cmd redis.Cmder) int {
+	n := 0
+	for _, arg := range cmd.Args()[1:] {
+		switch v := arg.(type) {
+		case string:
+			n += len(v)
+		case []byte:
+			n += len(v)
+		}
+	}
+	return n
+}
+
+// recordErr marks span as failed by err. A missing key is not an error.
+func recordErr(span trace.Span, err error) {
+	if err == nil || err == redis.Nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
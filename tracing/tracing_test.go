@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"testing"
+
+	"github.com/gocolly/redisstorage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrument(t *testing.T) {
+	s := &redisstorage.Storage{
+		Address: "127.0.0.1:6379",
+		Prefix:  "tracing_test",
+	}
+	if err := s.Init(); err != nil {
+		t.Error("failed to initialize client: " + err.Error())
+		return
+	}
+	defer s.Clear()
+	rec := tracetest.NewSpanRecorder()
+	if err := Instrument(s, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))); err != nil {
+		t.Fatal(err)
+	}
+	s.IsVisited(1)
+	spans := rec.Ended()
+	if len(spans) != 1 || spans[0].Name() != "redisstorage.get" {
+		t.Fatalf("invalid spans %v", spans)
+	}
+	for _, a := range spans[0].Attributes() {
+		if a.Key == "redisstorage.key_class" && a.Value.AsString() != "request" {
+			t.Errorf("invalid key class %q", a.Value.AsString())
+		}
+	}
+}
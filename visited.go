@@ -0,0 +1,211 @@
+package redisstorage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// visit queues the commands marking requestID as visited for ttl, or
+// forever if ttl is 0
+func (s *Storage) visit(ctx context.Context, pipe redis.Pipeliner, requestID uint64, ttl time.Duration) {
+	if s.bloom {
+		pipe.BFAdd(ctx, s.getBloomID(), idMember(requestID))
+	} else {
+		// A single SET writes the key together with its expiration, so
+		// a visit can never be left without a TTL. NX keeps the window
+		// of the first visit, so pages found again and again still
+		// become revisitable.
+		pipe.SetNX(ctx, s.getIDStr(requestID), "1", ttl)
+	}
+	if s.CountVisits {
+		pipe.PFAdd(ctx, s.getVisitCountID(), idMember(requestID))
+	}
+	if s.RecordMetadata {
+		s.visitInfo(ctx, pipe, requestID, ttl)
+	}
+	if s.VisitWindow > 0 {
+		s.visitTime(ctx, pipe, requestID)
+	}
+}
+
+// errStop ends a scan early
+var errStop = errors.New("stop")
+
+// SeedVisited marks many requests as visited using few round trips,
+// e.g. to skip the pages crawled by a previous system. The visits expire
+// after VisitedTTL like the ones of Visited.
+func (s *Storage) SeedVisited(requestIDs []uint64) error {
+	return s.SeedVisitedCtx(context.Background(), requestIDs)
+}
+
+// SeedVisitedCtx is the context-aware variant of SeedVisited
+func (s *Storage) SeedVisitedCtx(ctx context.Context, requestIDs []uint64) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	for len(requestIDs) > 0 {
+		n := len(requestIDs)
+		if n > addBatch {
+			n = addBatch
+		}
+		_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, id := range requestIDs[:n] {
+				s.visit(ctx, pipe, id, s.visitedTTL())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		requestIDs = requestIDs[n:]
+	}
+	return nil
+}
+
+// ExportVisited writes the visited requests to w, one per line as
+// decimal ID and milliseconds until the visit expires, 0 if it never
+// expires, separated by a space. It is not supported by VisitedBloom.
+func (s *Storage) ExportVisited(w io.Writer) error {
+	return s.ExportVisitedCtx(context.Background(), w)
+}
+
+// ExportVisitedCtx is the context-aware variant of ExportVisited
+func (s *Storage) ExportVisitedCtx(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var werr error
+	err := s.IterateVisitedCtx(ctx, func(id uint64, _ int, ttl time.Duration) bool {
+		ms := ttl.Milliseconds()
+		if ttl > 0 && ms == 0 {
+			// Do not turn visits about to expire into permanent ones.
+			ms = 1
+		}
+		_, werr = fmt.Fprintf(bw, "%d %d\n", id, ms)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	return bw.Flush()
+}
+
+// ImportVisited marks the requests written by ExportVisited as visited,
+// keeping their remaining time until expiration
+func (s *Storage) ImportVisited(r io.Reader) error {
+	return s.ImportVisitedCtx(context.Background(), r)
+}
+
+// ImportVisitedCtx is the context-aware variant of ImportVisited
+func (s *Storage) ImportVisitedCtx(ctx context.Context, r io.Reader) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(r)
+	pipe := s.Client.Pipeline()
+	n := 0
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("redisstorage: invalid visit in line %d", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("redisstorage: invalid visit in line %d: %w", line, err)
+		}
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("redisstorage: invalid TTL in line %d", line)
+		}
+		s.visit(ctx, pipe, id, time.Duration(ms)*time.Millisecond)
+		if n++; n == addBatch {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// IterateVisited calls fn for each visited request with the value of its
+// key and the time until it expires, 0 if it never expires. Iteration
+// stops if fn returns false. Visits made or removed while iterating may
+// or may not be reported. It is not supported by VisitedBloom.
+func (s *Storage) IterateVisited(fn func(id uint64, count int, ttl time.Duration) bool) error {
+	return s.IterateVisitedCtx(context.Background(), fn)
+}
+
+// IterateVisitedCtx is the context-aware variant of IterateVisited
+func (s *Storage) IterateVisitedCtx(ctx context.Context, fn func(id uint64, count int, ttl time.Duration) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if s.bloom {
+		return ErrUnsupportedVisitedMode
+	}
+	prefix := s.key("request", "")
+	// The other nodes of a cluster are still scanned after fn stopped.
+	stopped := false
+	err := s.scan(ctx, s.keyPattern("request"), func(keys []string) error {
+		gets := make([]*redis.StringCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		_, err := s.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				gets[i] = pipe.Get(ctx, k)
+				ttls[i] = pipe.PTTL(ctx, k)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if stopped {
+			return errStop
+		}
+		for i, k := range keys {
+			id, err := strconv.ParseUint(strings.TrimPrefix(k, prefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			v, err := gets[i].Result()
+			if err == redis.Nil {
+				// Expired since the scan.
+				continue
+			}
+			count, err := strconv.Atoi(v)
+			if err != nil {
+				count = 1
+			}
+			ttl := ttls[i].Val()
+			if ttl < 0 {
+				ttl = 0
+			}
+			if !fn(id, count, ttl) {
+				stopped = true
+				return errStop
+			}
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}